@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	"golang.org/x/net/context"
+)
+
+type BucketAlertsRes struct {
+	Flash      *Flash
+	Tenant     *Tenant
+	Alerts     []*BucketAlert
+	Activities map[string]*BucketActivity
+	Notifiers  []string
+}
+
+func (h *adminHandler) bucketAlerts(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	service := &BucketAlertService{ctx}
+	alerts, err := service.All()
+	if err != nil {
+		return err
+	}
+	activities, err := service.Activities()
+	if err != nil {
+		return err
+	}
+	r := BucketAlertsRes{
+		Flash:      c.Get("flash").(*Flash),
+		Tenant:     tenantOf(ctx),
+		Alerts:     alerts,
+		Activities: activities,
+		Notifiers:  ALERT_NOTIFIERS,
+	}
+	return c.Render(http.StatusOK, "bucket_alerts", &r)
+}
+
+// saveBucketAlert creates or updates the alert of the bucket.
+func (h *adminHandler) saveBucketAlert(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	alert := BucketAlert{}
+	c.Bind(&alert)
+	service := &BucketAlertService{ctx}
+	err := service.Save(&alert)
+	if err != nil {
+		h.flash.set(c, "alert", err.Error())
+	} else {
+		h.flash.set(c, "notice", fmt.Sprintf("Alert of %v is saved", alert.Bucket))
+	}
+	return c.Redirect(http.StatusFound, "/admin/bucket_alerts")
+}
+
+func (h *adminHandler) deleteBucketAlertConfirm(c echo.Context) error {
+	bucket := c.Param("bucket")
+	r := ConfirmRes{
+		Flash:   c.Get("flash").(*Flash),
+		Message: fmt.Sprintf("Are you sure to delete the alert of %v?", bucket),
+		Action:  "/admin/bucket_alerts/" + bucket + "/delete",
+		Back:    "/admin/bucket_alerts",
+	}
+	return c.Render(http.StatusOK, "confirm", &r)
+}
+
+func (h *adminHandler) deleteBucketAlert(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	bucket := c.Param("bucket")
+	service := &BucketAlertService{ctx}
+	err := service.Delete(bucket)
+	if err != nil {
+		h.flash.set(c, "alert", fmt.Sprintf("Failed to delete alert of %v. error: %v", bucket, err))
+	} else {
+		h.flash.set(c, "notice", fmt.Sprintf("Alert of %v is deleted successfully", bucket))
+	}
+	return c.Redirect(http.StatusFound, "/admin/bucket_alerts")
+}
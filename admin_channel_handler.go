@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	"golang.org/x/net/context"
+)
+
+type ChannelsRes struct {
+	Flash    *Flash
+	Tenant   *Tenant
+	Channels []*Channel
+	Gaps     []*ChannelGap
+}
+
+func (h *adminHandler) channels(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	service := &ChannelService{ctx}
+	channels, err := service.All()
+	if err != nil {
+		return err
+	}
+	gaps, err := service.Gaps()
+	if err != nil {
+		return err
+	}
+	r := ChannelsRes{
+		Flash:    c.Get("flash").(*Flash),
+		Tenant:   tenantOf(ctx),
+		Channels: channels,
+		Gaps:     gaps,
+	}
+	return c.Render(http.StatusOK, "channels", &r)
+}
+
+func (h *adminHandler) deleteChannelConfirm(c echo.Context) error {
+	id := c.Param("id")
+	r := ConfirmRes{
+		Flash:   c.Get("flash").(*Flash),
+		Message: fmt.Sprintf("Are you sure to delete the record of channel %v? It doesn't stop the channel.", id),
+		Action:  "/admin/channels/" + id + "/delete",
+		Back:    "/admin/channels",
+	}
+	return c.Render(http.StatusOK, "confirm", &r)
+}
+
+func (h *adminHandler) deleteChannel(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	id := c.Param("id")
+	service := &ChannelService{ctx}
+	err := service.Delete(id)
+	if err != nil {
+		h.flash.set(c, "alert", fmt.Sprintf("Failed to delete channel %v. error: %v", id, err))
+	} else {
+		h.flash.set(c, "notice", fmt.Sprintf("Channel %v is deleted successfully", id))
+	}
+	return c.Redirect(http.StatusFound, "/admin/channels")
+}
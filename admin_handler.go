@@ -4,11 +4,14 @@ import (
 	"fmt"
 	"html/template"
 	"io"
+	"mime"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/labstack/echo"
-	// "github.com/labstack/echo/middleware"
+	"github.com/labstack/echo/middleware"
 
 	"golang.org/x/net/context"
 
@@ -19,27 +22,100 @@ import (
 
 type adminHandler struct {
 	flash *FlashHandler
+	csrf  echo.MiddlewareFunc
+
+	// topicAdmin creates the TopicAdmin to check the topics of watches
+	topicAdmin func(ctx context.Context) (TopicAdmin, error)
+	// checkTopics enables to check the topic of a Watch on create and update
+	checkTopics bool
 }
 
-func init() {
-	h := &adminHandler{
+func newAdminHandler() *adminHandler {
+	return &adminHandler{
 		flash: &FlashHandler{
 			path:   "/admin/",
 			expire: 10 * time.Minute,
+			secret: flashSecret(),
 		},
+		// The token is given by the _csrf form value of every POST form in admin/*.html
+		csrf: middleware.CSRFWithConfig(middleware.CSRFConfig{
+			TokenLookup:    "form:_csrf",
+			CookiePath:     "/admin/",
+			CookieHTTPOnly: true,
+		}),
+		topicAdmin:  NewPubsubTopicAdmin,
+		checkTopics: os.Getenv("CHECK_TOPICS") == "true",
 	}
+}
+
+func init() {
+	h := newAdminHandler()
 
 	t := &Template{
-		templates: template.Must(template.ParseGlob("admin/*.html")),
+		templates: template.Must(template.New("admin").Funcs(templateFuncs).ParseGlob("admin/*.html")),
 	}
 	e.Renderer = t
 
 	g := e.Group("/admin/watches")
-	g.GET("", h.wrap(h.index))
-	g.POST("", h.wrap(h.create))
-	g.GET("/:id/edit", h.withId(h.edit))
-	g.POST("/:id/update", h.withId(h.update))
-	g.GET("/:id/delete", h.withId(h.delete))
+	g.GET("", h.wrap(h.require(ROLE_VIEWER, h.index)))
+	g.POST("", h.wrap(h.require(ROLE_EDITOR, h.create)))
+	g.GET("/:id/edit", h.withId(ROLE_EDITOR, h.edit))
+	g.POST("/:id/update", h.withId(ROLE_EDITOR, h.update))
+	g.GET("/:id/delete", h.withId(ROLE_EDITOR, h.deleteConfirm))
+	g.POST("/:id/delete", h.withId(ROLE_EDITOR, h.delete))
+	g.POST("/preview", h.wrap(h.require(ROLE_VIEWER, h.preview)))
+	g.GET("/reorder", h.wrap(h.require(ROLE_EDITOR, h.reorderForm)))
+	g.POST("/reorder", h.wrap(h.require(ROLE_EDITOR, h.reorder)))
+	g.POST("/:id/move_up", h.withId(ROLE_EDITOR, h.moveUp))
+	g.POST("/:id/move_down", h.withId(ROLE_EDITOR, h.moveDown))
+	g.GET("/:id/revisions", h.withId(ROLE_VIEWER, h.revisions))
+	g.POST("/:id/revisions/:revision/rollback", h.withId(ROLE_EDITOR, h.rollback))
+
+	// Tenants are shared by all tenants, so the owners of the default namespace manage them.
+	tg := e.Group("/admin/tenants")
+	tg.GET("", h.wrap(h.requireDefault(ROLE_OWNER, h.tenants)))
+	tg.POST("", h.wrap(h.requireDefault(ROLE_OWNER, h.createTenant)))
+	tg.POST("/use", h.wrap(h.useTenant))
+	tg.POST("/:name/use", h.wrap(h.useTenant))
+	tg.GET("/:name/edit", h.withTenantName(h.editTenant))
+	tg.POST("/:name/update", h.withTenantName(h.updateTenant))
+	tg.GET("/:name/delete", h.withTenantName(h.deleteTenantConfirm))
+	tg.POST("/:name/delete", h.withTenantName(h.deleteTenant))
+
+	rg := e.Group("/admin/roles")
+	rg.GET("", h.wrap(h.require(ROLE_OWNER, h.roles)))
+	rg.POST("", h.wrap(h.require(ROLE_OWNER, h.saveRole)))
+	rg.GET("/:email/delete", h.wrap(h.require(ROLE_OWNER, h.deleteRoleConfirm)))
+	rg.POST("/:email/delete", h.wrap(h.require(ROLE_OWNER, h.deleteRole)))
+
+	ag := e.Group("/admin/bucket_alerts")
+	ag.GET("", h.wrap(h.require(ROLE_VIEWER, h.bucketAlerts)))
+	ag.POST("", h.wrap(h.require(ROLE_EDITOR, h.saveBucketAlert)))
+	ag.GET("/:bucket/delete", h.wrap(h.require(ROLE_EDITOR, h.deleteBucketAlertConfirm)))
+	ag.POST("/:bucket/delete", h.wrap(h.require(ROLE_EDITOR, h.deleteBucketAlert)))
+
+	cg := e.Group("/admin/channels")
+	cg.GET("", h.wrap(h.require(ROLE_VIEWER, h.channels)))
+	cg.GET("/:id/delete", h.wrap(h.require(ROLE_EDITOR, h.deleteChannelConfirm)))
+	cg.POST("/:id/delete", h.wrap(h.require(ROLE_EDITOR, h.deleteChannel)))
+
+	e.GET("/admin/destinations", h.wrap(h.require(ROLE_VIEWER, h.destinations)))
+
+	e.GET("/admin/dry_run", h.wrap(h.require(ROLE_VIEWER, h.dryRunForm)))
+	e.POST("/admin/dry_run", h.wrap(h.require(ROLE_VIEWER, h.dryRun)))
+
+	api := e.Group("/admin/api", requireJSON)
+	api.POST("/dry_run", h.withAEContext(h.apiRequire(ROLE_VIEWER, h.apiDryRun)))
+	api.GET("/watches", h.withAEContext(h.apiRequire(ROLE_VIEWER, h.apiIndex)))
+	api.POST("/watches", h.withAEContext(h.apiRequire(ROLE_EDITOR, h.apiCreate)))
+	api.GET("/watches/:id", h.apiWithId(ROLE_VIEWER, h.apiShow))
+	api.PUT("/watches/:id", h.apiWithId(ROLE_EDITOR, h.apiUpdate))
+	api.POST("/watches/reorder", h.withAEContext(h.apiRequire(ROLE_EDITOR, h.apiReorder)))
+}
+
+// templateFuncs are placeholders replaced for each request in Render.
+var templateFuncs = template.FuncMap{
+	"csrf": func() string { return "" },
 }
 
 type Template struct {
@@ -47,13 +123,27 @@ type Template struct {
 }
 
 func (t *Template) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
-	return t.templates.ExecuteTemplate(w, name, data)
+	tmpl, err := t.templates.Clone()
+	if err != nil {
+		return err
+	}
+	token, _ := c.Get("csrf").(string)
+	tmpl.Funcs(template.FuncMap{
+		"csrf": func() string { return token },
+	})
+	return tmpl.ExecuteTemplate(w, name, data)
 }
 
 type IndexRes struct {
-	Flash   *Flash
-	Watches Watches
-	NewSeq  int
+	Flash        *Flash
+	Tenant       *Tenant
+	Role         string
+	Sort         string
+	Stats        map[string]*WatchStat
+	Groups       []*BucketWatches
+	NewSeq       int
+	PatternTypes []string
+	StaleEvents  []string
 }
 
 func (h *adminHandler) index(c echo.Context) error {
@@ -72,10 +162,30 @@ func (h *adminHandler) index(c echo.Context) error {
 		}
 	}
 	log.Debugf(ctx, "indexPage watches: %v\n", watches)
+	role, err := (&RoleService{ctx}).Current()
+	if err != nil {
+		return err
+	}
+	stats, err := service.Stats()
+	if err != nil {
+		log.Errorf(ctx, "indexPage error: %v\n", err)
+		return err
+	}
+	sortKey := c.QueryParam("sort")
+	if sortKey == "" {
+		sortKey = STAT_SORT_SEQ
+	}
+	watches.SortByStat(stats, sortKey)
 	r := IndexRes{
-		Flash:   c.Get("flash").(*Flash),
-		Watches: watches,
-		NewSeq:  maxSeq + 1,
+		Flash:        c.Get("flash").(*Flash),
+		Tenant:       tenantOf(ctx),
+		Role:         role,
+		Sort:         sortKey,
+		Stats:        stats,
+		Groups:       watches.GroupByBucket(),
+		NewSeq:       maxSeq + 1,
+		PatternTypes: PATTERN_TYPES,
+		StaleEvents:  STALE_EVENTS,
 	}
 	log.Debugf(ctx, "indexPage r: %v\n", r)
 	return c.Render(http.StatusOK, "index", &r)
@@ -84,10 +194,22 @@ func (h *adminHandler) index(c echo.Context) error {
 func (h *adminHandler) create(c echo.Context) error {
 	ctx := c.Get("aecontext").(context.Context)
 	watch := Watch{}
-	c.Bind(&watch)
+	err := h.bindWatch(c, &watch)
+	if err != nil {
+		h.flash.set(c, "alert", err.Error())
+		return c.Redirect(http.StatusFound, "/admin/watches")
+	}
 	log.Debugf(ctx, "Binded Watch: %v\n", watch)
+	opts := DestinationOptions{}
+	c.Bind(&opts)
 	service := &WatchService{ctx}
-	err := service.Create(&watch)
+	err = h.createDestination(ctx, &watch, &opts)
+	if err == nil {
+		err = h.checkTopic(ctx, &watch)
+	}
+	if err == nil {
+		err = service.Create(&watch)
+	}
 	if err != nil {
 		h.flash.set(c, "alert", err.Error())
 	} else {
@@ -96,22 +218,41 @@ func (h *adminHandler) create(c echo.Context) error {
 	return c.Redirect(http.StatusFound, "/admin/watches")
 }
 
+type ConfirmRes struct {
+	Flash   *Flash
+	Message string
+	Action  string
+	Back    string
+}
+
+func (h *adminHandler) deleteConfirm(c echo.Context, w *Watch) error {
+	r := ConfirmRes{
+		Flash:   c.Get("flash").(*Flash),
+		Message: fmt.Sprintf("Are you sure to delete the Watch %v (Pattern: %v, Topic: %v)?", w.ID, w.Pattern, w.Topic),
+		Action:  "/admin/watches/" + w.ID + "/delete",
+		Back:    "/admin/watches",
+	}
+	return c.Render(http.StatusOK, "confirm", &r)
+}
+
 func (h *adminHandler) delete(c echo.Context, w *Watch) error {
 	ctx := c.Get("aecontext").(context.Context)
 	service := &WatchService{ctx}
 	err := service.Delete(w.ID)
 	if err != nil {
-		h.flash.set(c, "alert", fmt.Sprintf("Failed to destroy watch. id: %v error: ", w.ID, err))
-		return c.Redirect(http.StatusFound, "/admin/auths")
+		h.flash.set(c, "alert", fmt.Sprintf("Failed to destroy watch. id: %v error: %v", w.ID, err))
+		return c.Redirect(http.StatusFound, "/admin/watches")
 	}
 	h.flash.set(c, "notice", fmt.Sprintf("The Watch is deleted successfully. id: %v", w.ID))
 	return c.Redirect(http.StatusFound, "/admin/watches")
 }
 
 type EditRes struct {
-	Flash   *Flash
-	Watches Watches
-	Target  string
+	Flash        *Flash
+	Groups       []*BucketWatches
+	Target       string
+	PatternTypes []string
+	StaleEvents  []string
 }
 
 func (h *adminHandler) edit(c echo.Context, w *Watch) error {
@@ -126,9 +267,11 @@ func (h *adminHandler) edit(c echo.Context, w *Watch) error {
 	}
 	log.Debugf(ctx, "edit3: %v\n", w)
 	r := EditRes{
-		Flash:   c.Get("flash").(*Flash),
-		Watches: watches,
-		Target:  w.ID,
+		Flash:        c.Get("flash").(*Flash),
+		Groups:       watches.GroupByBucket(),
+		Target:       w.ID,
+		PatternTypes: PATTERN_TYPES,
+		StaleEvents:  STALE_EVENTS,
 	}
 	log.Debugf(ctx, "edit4: %q\n", r.Target)
 	return c.Render(http.StatusOK, "edit", &r)
@@ -136,32 +279,560 @@ func (h *adminHandler) edit(c echo.Context, w *Watch) error {
 
 func (h *adminHandler) update(c echo.Context, w *Watch) error {
 	ctx := c.Get("aecontext").(context.Context)
-	c.Bind(w)
+	version, err := formVersion(c)
+	if err == nil {
+		err = h.bindWatch(c, w)
+		w.Version = version
+	}
+	if err != nil {
+		h.flash.set(c, "alert", err.Error())
+		return c.Redirect(http.StatusFound, "/admin/watches")
+	}
 	service := &WatchService{ctx}
 	log.Debugf(ctx, "update: %v\n", w)
-	err := service.Update(w)
+	err = h.checkTopic(ctx, w)
+	if err == nil {
+		err = service.Update(w)
+	}
 	if err != nil {
 		h.flash.set(c, "alert", err.Error())
 	} else {
-		h.flash.set(c, "notice", "Watch is created successfully")
+		h.flash.set(c, "notice", "Watch is updated successfully")
 	}
 	return c.Redirect(http.StatusFound, "/admin/watches")
 }
 
+type ReorderRes struct {
+	Flash   *Flash
+	Watches Watches
+}
+
+func (h *adminHandler) reorderForm(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	service := &WatchService{ctx}
+	watches, err := service.All()
+	if err != nil {
+		log.Errorf(ctx, "reorderForm error: %v\n", err)
+		return err
+	}
+	r := ReorderRes{
+		Flash:   c.Get("flash").(*Flash),
+		Watches: watches,
+	}
+	return c.Render(http.StatusOK, "reorder", &r)
+}
+
+func (h *adminHandler) reorder(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	params, err := c.FormParams()
+	if err != nil {
+		return err
+	}
+	service := &WatchService{ctx}
+	err = service.Reorder(params["ids"])
+	if err != nil {
+		h.flash.set(c, "alert", err.Error())
+		return c.Redirect(http.StatusFound, "/admin/watches/reorder")
+	}
+	h.flash.set(c, "notice", "Watches are reordered successfully")
+	return c.Redirect(http.StatusFound, "/admin/watches")
+}
+
+func (h *adminHandler) moveUp(c echo.Context, w *Watch) error {
+	return h.move(c, w, -1)
+}
+
+func (h *adminHandler) moveDown(c echo.Context, w *Watch) error {
+	return h.move(c, w, 1)
+}
+
+func (h *adminHandler) move(c echo.Context, w *Watch, delta int) error {
+	ctx := c.Get("aecontext").(context.Context)
+	service := &WatchService{ctx}
+	err := service.Move(w, delta)
+	if err != nil {
+		h.flash.set(c, "alert", err.Error())
+	}
+	return c.Redirect(http.StatusFound, "/admin/watches")
+}
+
+type RevisionsRes struct {
+	Flash     *Flash
+	Watch     *Watch
+	Revisions []*RevisionDiff
+}
+
+func (h *adminHandler) revisions(c echo.Context, w *Watch) error {
+	ctx := c.Get("aecontext").(context.Context)
+	service := &WatchService{ctx}
+	revisions, err := service.RevisionDiffs(w.ID)
+	if err != nil {
+		log.Errorf(ctx, "revisions: %v, [%T]%v\n", w, err, err)
+		return err
+	}
+	r := RevisionsRes{
+		Flash:     c.Get("flash").(*Flash),
+		Watch:     w,
+		Revisions: revisions,
+	}
+	return c.Render(http.StatusOK, "revisions", &r)
+}
+
+func (h *adminHandler) rollback(c echo.Context, w *Watch) error {
+	ctx := c.Get("aecontext").(context.Context)
+	service := &WatchService{ctx}
+	revision := c.Param("revision")
+	version, err := formVersion(c)
+	if err == nil {
+		// The version of the history page which the user saw
+		w.Version = version
+		err = service.Rollback(w, revision)
+	}
+	if err != nil {
+		h.flash.set(c, "alert", fmt.Sprintf("Failed to roll back to revision %v. error: %v", revision, err))
+	} else {
+		h.flash.set(c, "notice", fmt.Sprintf("Watch is rolled back to revision %v successfully", revision))
+	}
+	return c.Redirect(http.StatusFound, "/admin/watches/"+w.ID+"/revisions")
+}
+
+type DestinationsRes struct {
+	Flash        *Flash
+	Destinations []*Destination
+}
+
+// destinations checks the topics of all the watches.
+func (h *adminHandler) destinations(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	service := &WatchService{ctx}
+	watches, err := service.All()
+	if err != nil {
+		log.Errorf(ctx, "destinations error: %v\n", err)
+		return err
+	}
+	admin, err := h.topicAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	r := DestinationsRes{
+		Flash:        c.Get("flash").(*Flash),
+		Destinations: checkDestinations(admin, watches),
+	}
+	return c.Render(http.StatusOK, "destinations", &r)
+}
+
+// checkTopic returns ValidationError if the topic of the Watch doesn't exist or
+// isn't publishable. It does nothing unless checkTopics is enabled.
+func (h *adminHandler) checkTopic(ctx context.Context, w *Watch) error {
+	if !h.checkTopics || !TOPIC_REGEXP.MatchString(w.Topic) {
+		// An invalid topic is reported by Watch.Validate
+		return nil
+	}
+	admin, err := h.topicAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	return admin.CheckTopic(w.Topic)
+}
+
+// createDestination creates the topic and the subscription of the new Watch if the options are given.
+// They are kept even if the Watch fails to be created after that.
+func (h *adminHandler) createDestination(ctx context.Context, w *Watch, opts *DestinationOptions) error {
+	if !opts.CreateTopic && opts.Subscription == "" {
+		return nil
+	}
+	err := w.Validate()
+	if err != nil {
+		return err
+	}
+	err = validateTenant(ctx, w)
+	if err != nil {
+		return err
+	}
+	admin, err := h.topicAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	return createDestination(admin, w.Topic, opts)
+}
+
+type DryRunRes struct {
+	Flash   *Flash
+	Request *DryRunRequest
+	Result  *DryRunResult
+}
+
+func (h *adminHandler) dryRunForm(c echo.Context) error {
+	r := DryRunRes{
+		Flash:   c.Get("flash").(*Flash),
+		Request: &DryRunRequest{State: "exists"},
+	}
+	return c.Render(http.StatusOK, "dry_run", &r)
+}
+
+func (h *adminHandler) dryRun(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	req := DryRunRequest{}
+	c.Bind(&req)
+	log.Debugf(ctx, "dryRun: %v\n", req)
+	r := DryRunRes{
+		Flash:   c.Get("flash").(*Flash),
+		Request: &req,
+	}
+	service := &WatchService{ctx}
+	res, err := service.dryRun(&req)
+	if err != nil {
+		r.Flash.Add("alert", err.Error())
+	} else {
+		r.Result = res
+	}
+	return c.Render(http.StatusOK, "dry_run", &r)
+}
+
+type PreviewRes struct {
+	Flash   *Flash
+	Watch   *Watch
+	Request *DryRunRequest
+	Result  *DryRunResult
+}
+
+// preview shows the message of the Watch in the form without saving it.
+func (h *adminHandler) preview(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	watch := Watch{}
+	bindErr := h.bindWatch(c, &watch)
+	req := DryRunRequest{}
+	c.Bind(&req)
+	log.Debugf(ctx, "preview: %v %v\n", watch, req)
+	r := PreviewRes{
+		Flash:   c.Get("flash").(*Flash),
+		Watch:   &watch,
+		Request: &req,
+	}
+	if bindErr != nil {
+		r.Flash.Add("alert", bindErr.Error())
+		return c.Render(http.StatusOK, "preview", &r)
+	}
+	service := &WatchService{ctx}
+	res, err := service.preview(&watch, &req)
+	if err != nil {
+		r.Flash.Add("alert", err.Error())
+	} else {
+		r.Result = res
+	}
+	return c.Render(http.StatusOK, "preview", &r)
+}
+
+func (h *adminHandler) apiDryRun(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	req := DryRunRequest{}
+	err := c.Bind(&req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	service := &WatchService{ctx}
+	res, err := service.dryRun(&req)
+	if err != nil {
+		return h.apiError(c, err)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (h *adminHandler) apiIndex(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	service := &WatchService{ctx}
+	watches, err := service.All()
+	if err != nil {
+		return h.apiError(c, err)
+	}
+	return c.JSON(http.StatusOK, watches)
+}
+
+type CreateWatchReq struct {
+	Watch
+	DestinationOptions
+}
+
+// apiCreate creates the Watch with the JSON body.
+// The body can have create_topic and subscription to create the destination of the Watch.
+func (h *adminHandler) apiCreate(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	req := CreateWatchReq{}
+	err := c.Bind(&req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	w := &req.Watch
+	w.ID = ""
+	err = h.createDestination(ctx, w, &req.DestinationOptions)
+	if err != nil {
+		return h.apiError(c, err)
+	}
+	err = h.checkTopic(ctx, w)
+	if err != nil {
+		return h.apiError(c, err)
+	}
+	service := &WatchService{ctx}
+	err = service.Create(w)
+	if err != nil {
+		return h.apiError(c, err)
+	}
+	return c.JSON(http.StatusCreated, w)
+}
+
+func (h *adminHandler) apiShow(c echo.Context, w *Watch) error {
+	return c.JSON(http.StatusOK, w)
+}
+
+// UpdateWatchReq is the body of apiUpdate. The fields not given keep the current values
+// but Version is required not to overwrite the changes which the client hasn't loaded.
+type UpdateWatchReq struct {
+	Watch
+	Version *int `json:"version"`
+}
+
+// watch returns the Watch to update with the version given by the client.
+func (req *UpdateWatchReq) watch() (*Watch, error) {
+	if req.Version == nil {
+		return nil, &ValidationError{"version is required"}
+	}
+	w := req.Watch
+	w.Version = *req.Version
+	return &w, nil
+}
+
+// apiUpdate updates the Watch with the JSON body.
+// The body must have the version of the Watch which the client loaded.
+func (h *adminHandler) apiUpdate(c echo.Context, current *Watch) error {
+	ctx := c.Get("aecontext").(context.Context)
+	req := UpdateWatchReq{Watch: *current}
+	err := c.Bind(&req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	w, err := req.watch()
+	if err != nil {
+		return h.apiError(c, err)
+	}
+	w.ID = current.ID
+	err = h.checkTopic(ctx, w)
+	if err != nil {
+		return h.apiError(c, err)
+	}
+	service := &WatchService{ctx}
+	err = service.Update(w)
+	if err != nil {
+		return h.apiError(c, err)
+	}
+	return c.JSON(http.StatusOK, w)
+}
+
+type ReorderReq struct {
+	IDs []string `json:"ids"`
+}
+
+// apiReorder renumbers Seq of the watches in the order of the given ids.
+func (h *adminHandler) apiReorder(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	req := ReorderReq{}
+	err := c.Bind(&req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	service := &WatchService{ctx}
+	err = service.Reorder(req.IDs)
+	if err != nil {
+		return h.apiError(c, err)
+	}
+	watches, err := service.All()
+	if err != nil {
+		return h.apiError(c, err)
+	}
+	return c.JSON(http.StatusOK, watches)
+}
+
+// apiError responds the error with the status for its type.
+func (h *adminHandler) apiError(c echo.Context, err error) error {
+	status := http.StatusInternalServerError
+	switch err.(type) {
+	case *ValidationError:
+		status = http.StatusBadRequest
+	case *EntityNotFound:
+		status = http.StatusNotFound
+	case *ConflictError:
+		status = http.StatusConflict
+	case *ForbiddenError:
+		status = http.StatusForbidden
+	default:
+		ctx := c.Get("aecontext").(context.Context)
+		log.Errorf(ctx, "API error: [%T]%v\n", err, err)
+	}
+	return c.JSON(status, map[string]string{"error": err.Error()})
+}
+
+// FORM_TIME_LAYOUT is the layout of input[type="datetime-local"] in UTC.
+const FORM_TIME_LAYOUT = "2006-01-02T15:04"
+
+// formVersion returns the version of the Watch which the form was built with.
+func formVersion(c echo.Context) (int, error) {
+	v := c.FormValue("version")
+	if v == "" {
+		return 0, &ValidationError{"version is required"}
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, &ValidationError{fmt.Sprintf("Invalid version: %v", v)}
+	}
+	return version, nil
+}
+
+// bindWatch binds the form to the Watch including the fields which Bind can't handle.
+func (h *adminHandler) bindWatch(c echo.Context, w *Watch) error {
+	c.Bind(w)
+	w.Disabled = c.FormValue("enabled") == ""
+	times := map[string]*time.Time{
+		"active_from":  &w.ActiveFrom,
+		"active_until": &w.ActiveUntil,
+	}
+	for name, t := range times {
+		v := c.FormValue(name)
+		if v == "" {
+			*t = time.Time{}
+			continue
+		}
+		parsed, err := time.Parse(FORM_TIME_LAYOUT, v)
+		if err != nil {
+			return &ValidationError{fmt.Sprintf("Invalid %v: %v", name, v)}
+		}
+		*t = parsed
+	}
+	return nil
+}
+
+// wrap checks the CSRF token before anything else not to touch Datastore for forged requests.
 func (h *adminHandler) wrap(f func(c echo.Context) error) func(c echo.Context) error {
-	return h.flash.with(h.withAEContext(f))
+	return h.withCSRF(h.flash.with(h.withAEContext(f)))
+}
+
+// withCSRF rejects unsafe requests without the valid CSRF token by 403 Forbidden.
+// The token is set to the context as "csrf" for the templates.
+func (h *adminHandler) withCSRF(f func(c echo.Context) error) func(c echo.Context) error {
+	return h.csrf(f)
 }
 
+// withAEContext sets the context in the namespace of the tenant given by
+// tenant query parameter or the tenant cookie.
 func (h *adminHandler) withAEContext(f func(c echo.Context) error) func(c echo.Context) error {
 	return func(c echo.Context) error {
 		ctx := appengine.NewContext(c.Request())
+		name := c.QueryParam("tenant")
+		if name == "" {
+			if cookie, err := c.Cookie("tenant"); err == nil {
+				name = cookie.Value
+			}
+		}
+		var t *Tenant
+		if name != "" {
+			var err error
+			t, err = (&TenantService{ctx}).Find(name)
+			if err != nil {
+				log.Errorf(ctx, "Failed to find tenant %v: %v", name, err)
+				h.setTenantCookie(c, "")
+				if _, ok := err.(*EntityNotFound); ok {
+					return c.String(http.StatusNotFound, fmt.Sprintf("Tenant not found: %v", name))
+				}
+				return err
+			}
+		}
+		ctx, err := withTenant(ctx, t)
+		if err != nil {
+			return err
+		}
 		c.Set("aecontext", ctx)
 		return f(c)
 	}
 }
 
-func (h *adminHandler) withId(f func(c echo.Context, w *Watch) error) func(c echo.Context) error {
-	return h.wrap(func(c echo.Context) error {
+// require responds 403 Forbidden unless the signed-in user has the role
+// in the namespace of the tenant.
+func (h *adminHandler) require(role string, f func(c echo.Context) error) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		ctx := c.Get("aecontext").(context.Context)
+		err := (&RoleService{ctx}).authorize(role)
+		if err != nil {
+			return h.forbidden(c, err)
+		}
+		return f(c)
+	}
+}
+
+// requireDefault is the same as require but checks the role in the default namespace.
+func (h *adminHandler) requireDefault(role string, f func(c echo.Context) error) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		ctx, err := withTenant(c.Get("aecontext").(context.Context), nil)
+		if err != nil {
+			return err
+		}
+		err = (&RoleService{ctx}).authorize(role)
+		if err != nil {
+			return h.forbidden(c, err)
+		}
+		return f(c)
+	}
+}
+
+func (h *adminHandler) forbidden(c echo.Context, err error) error {
+	if _, ok := err.(*ForbiddenError); ok {
+		return c.String(http.StatusForbidden, err.Error())
+	}
+	return err
+}
+
+// requireJSON rejects the API requests except GET unless their body is JSON.
+// The API has no CSRF token, but browsers can't send JSON to another site
+// without a CORS preflight, which is never allowed.
+func requireJSON(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.Method == echo.GET || req.Method == echo.HEAD {
+			return next(c)
+		}
+		mediaType, _, err := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType))
+		if err != nil || mediaType != echo.MIMEApplicationJSON {
+			return c.JSON(http.StatusUnsupportedMediaType, map[string]string{"error": "Content-Type must be application/json"})
+		}
+		return next(c)
+	}
+}
+
+func (h *adminHandler) apiRequire(role string, f func(c echo.Context) error) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		ctx := c.Get("aecontext").(context.Context)
+		err := (&RoleService{ctx}).authorize(role)
+		if err != nil {
+			return h.apiError(c, err)
+		}
+		return f(c)
+	}
+}
+
+func (h *adminHandler) apiWithId(role string, f func(c echo.Context, w *Watch) error) func(c echo.Context) error {
+	return h.withAEContext(h.apiRequire(role, func(c echo.Context) error {
+		ctx := c.Get("aecontext").(context.Context)
+		service := &WatchService{ctx}
+		w, err := service.Find(c.Param("id"))
+		if err != nil {
+			if _, ok := err.(*EntityNotFound); !ok {
+				return h.apiError(c, err)
+			}
+			return h.apiError(c, &EntityNotFound{fmt.Errorf("Watch not found for id: %v", c.Param("id"))})
+		}
+		return f(c, w)
+	}))
+}
+
+func (h *adminHandler) withId(role string, f func(c echo.Context, w *Watch) error) func(c echo.Context) error {
+	return h.wrap(h.require(role, func(c echo.Context) error {
 		ctx := c.Get("aecontext").(context.Context)
 		service := &WatchService{ctx}
 		w, err := service.Find(c.Param("id"))
@@ -171,10 +842,10 @@ func (h *adminHandler) withId(f func(c echo.Context, w *Watch) error) func(c ech
 				h.flash.set(c, "alert", fmt.Sprintf("Watch not found for id: %v", c.Param("id")))
 				return c.Redirect(http.StatusFound, "/admin/watches")
 			default:
-				h.flash.set(c, "alert", fmt.Sprintf("Failed to find watch for id: %v error: ", c.Param("id"), err))
+				h.flash.set(c, "alert", fmt.Sprintf("Failed to find watch for id: %v error: %v", c.Param("id"), err))
 				return c.Redirect(http.StatusFound, "/admin/watches")
 			}
 		}
 		return f(c, w)
-	})
+	}))
 }
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminHandlerWithCSRF(t *testing.T) {
+	h := newAdminHandler()
+	e := echo.New()
+	called := false
+	handler := h.withCSRF(func(c echo.Context) error {
+		called = true
+		return c.String(http.StatusOK, c.Get("csrf").(string))
+	})
+
+	post := func(cookie, token string) error {
+		form := url.Values{}
+		if token != "" {
+			form.Set("_csrf", token)
+		}
+		req := httptest.NewRequest(echo.POST, "/admin/watches/1/delete", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "_csrf", Value: cookie})
+		}
+		called = false
+		return handler(e.NewContext(req, httptest.NewRecorder()))
+	}
+
+	// GET issues the token
+	req := httptest.NewRequest(echo.GET, "/admin/watches/1/delete", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, handler(e.NewContext(req, rec)))
+	assert.True(t, called)
+	token := rec.Body.String()
+	assert.NotEmpty(t, token)
+	assert.Contains(t, rec.Header().Get("Set-Cookie"), "_csrf="+token)
+
+	// No token
+	err := post(token, "")
+	if assert.IsType(t, &echo.HTTPError{}, err) {
+		assert.Equal(t, http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+	assert.False(t, called)
+
+	// Token which doesn't match the cookie
+	err = post(token, "invalid-token")
+	if assert.IsType(t, &echo.HTTPError{}, err) {
+		assert.Equal(t, http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+	assert.False(t, called)
+
+	// Token without cookie
+	err = post("", token)
+	if assert.IsType(t, &echo.HTTPError{}, err) {
+		assert.Equal(t, http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+	assert.False(t, called)
+
+	// Valid token
+	assert.NoError(t, post(token, token))
+	assert.True(t, called)
+}
+
+func TestUseTenantRequiresCSRF(t *testing.T) {
+	// GET isn't allowed not to switch the tenant by a link on another site
+	req := httptest.NewRequest(echo.GET, "/admin/tenants/use", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	for _, path := range []string{"/admin/tenants/use", "/admin/tenants/team1/use"} {
+		req := httptest.NewRequest(echo.POST, path, strings.NewReader(""))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, path)
+		assert.Empty(t, rec.Header().Get("Set-Cookie"), path)
+	}
+}
+
+func TestAPIRequiresJSON(t *testing.T) {
+	called := false
+	handler := requireJSON(func(c echo.Context) error {
+		called = true
+		return c.NoContent(http.StatusOK)
+	})
+	request := func(method, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/api/watches", strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set(echo.HeaderContentType, contentType)
+		}
+		rec := httptest.NewRecorder()
+		called = false
+		assert.NoError(t, handler(echo.New().NewContext(req, rec)))
+		return rec
+	}
+
+	// Form-encoded POST which a form on another site can send
+	form := url.Values{"seq": {"1"}, "pattern": {`\.csv\z`}, "topic": {"projects/dummy-proj-999/topics/topic1"}}
+	rec := request(echo.POST, echo.MIMEApplicationForm, form.Encode())
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+	assert.False(t, called)
+
+	for _, contentType := range []string{"", echo.MIMEMultipartForm, echo.MIMETextPlain} {
+		rec = request(echo.PUT, contentType, `{"seq": 1}`)
+		assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code, contentType)
+		assert.False(t, called, contentType)
+	}
+
+	rec = request(echo.POST, echo.MIMEApplicationJSONCharsetUTF8, `{"seq": 1}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, called)
+
+	rec = request(echo.GET, "", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, called)
+
+	// Through the router
+	req := httptest.NewRequest(echo.POST, "/admin/api/watches", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+}
+
+func TestCreateWatchReqJSON(t *testing.T) {
+	req := CreateWatchReq{}
+	body := `{"seq": 3, "pattern": "\\.csv\\z", "topic": "projects/dummy-proj-999/topics/topic1", "create_topic": true, "subscription": "sub1"}`
+	err := json.Unmarshal([]byte(body), &req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, req.Watch.Seq)
+		assert.Equal(t, `\.csv\z`, req.Watch.Pattern)
+		assert.Equal(t, "projects/dummy-proj-999/topics/topic1", req.Watch.Topic)
+		assert.Equal(t, DestinationOptions{CreateTopic: true, Subscription: "sub1"}, req.DestinationOptions)
+	}
+}
+
+func TestUpdateWatchReqJSON(t *testing.T) {
+	current := Watch{ID: "id1", Seq: 3, Pattern: `\.csv\z`, Topic: "projects/dummy-proj-999/topics/topic1", Version: 2}
+
+	// The fields not given keep the current values
+	req := UpdateWatchReq{Watch: current}
+	err := json.Unmarshal([]byte(`{"pattern": "\\.tsv\\z", "version": 1}`), &req)
+	if assert.NoError(t, err) {
+		w, err := req.watch()
+		if assert.NoError(t, err) {
+			assert.Equal(t, `\.tsv\z`, w.Pattern)
+			assert.Equal(t, 3, w.Seq)
+			// The version of the client is used to detect the conflict
+			assert.Equal(t, 1, w.Version)
+		}
+	}
+
+	// The version is required
+	req = UpdateWatchReq{Watch: current}
+	err = json.Unmarshal([]byte(`{"pattern": "\\.tsv\\z"}`), &req)
+	if assert.NoError(t, err) {
+		_, err := req.watch()
+		assert.IsType(t, &ValidationError{}, err)
+	}
+}
+
+func TestFormVersion(t *testing.T) {
+	formVersionOf := func(form url.Values) (int, error) {
+		req := httptest.NewRequest(echo.POST, "/admin/watches/1/update", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		return formVersion(echo.New().NewContext(req, httptest.NewRecorder()))
+	}
+
+	version, err := formVersionOf(url.Values{"version": {"3"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, version)
+
+	_, err = formVersionOf(url.Values{})
+	assert.IsType(t, &ValidationError{}, err)
+	_, err = formVersionOf(url.Values{"version": {"x"}})
+	assert.IsType(t, &ValidationError{}, err)
+}
+
+func TestWatchFormsDefaultButton(t *testing.T) {
+	tmpl := template.Must(template.New("admin").Funcs(templateFuncs).ParseGlob("admin/*.html"))
+	groups := []*BucketWatches{
+		{Bucket: "bucket1", Watches: Watches{{ID: "id1", Seq: 1}, {ID: "id2", Seq: 2}}},
+	}
+	pages := map[string]interface{}{
+		"index": &IndexRes{Flash: &Flash{}, Groups: groups, NewSeq: 3},
+		"edit":  &EditRes{Flash: &Flash{}, Groups: groups, Target: "id2"},
+	}
+	for name, data := range pages {
+		buf := &bytes.Buffer{}
+		err := tmpl.ExecuteTemplate(buf, name, data)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		html := buf.String()
+		end := strings.Index(html, "</form>")
+		if !assert.True(t, end >= 0, name) {
+			continue
+		}
+		form := html[:end]
+		// Enter in a field submits the first submit button owned by the form.
+		// The buttons with the form attribute are owned by the other forms.
+		owned := []string{}
+		for _, tag := range regexp.MustCompile(`<[^>]*type="submit"[^>]*>`).FindAllString(form, -1) {
+			if !strings.Contains(tag, ` form="`) {
+				owned = append(owned, tag)
+			}
+		}
+		if assert.NotEmpty(t, owned, name) {
+			assert.Regexp(t, `value="(Create|Update)"`, owned[0], name)
+		}
+		assert.NotContains(t, form, "/move_up", name)
+		assert.Contains(t, form, `form="move_up_id1"`, name)
+		assert.Contains(t, html[end:], `<form id="move_up_id1" action="/admin/watches/id1/move_up" method="POST">`, name)
+	}
+}
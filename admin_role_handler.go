@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	"golang.org/x/net/context"
+)
+
+type RolesRes struct {
+	Flash     *Flash
+	Tenant    *Tenant
+	Roles     []*Role
+	RoleNames []string
+}
+
+func (h *adminHandler) roles(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	service := &RoleService{ctx}
+	roles, err := service.All()
+	if err != nil {
+		return err
+	}
+	r := RolesRes{
+		Flash:     c.Get("flash").(*Flash),
+		Tenant:    tenantOf(ctx),
+		Roles:     roles,
+		RoleNames: ROLES,
+	}
+	return c.Render(http.StatusOK, "roles", &r)
+}
+
+// saveRole creates or updates the role of the email.
+func (h *adminHandler) saveRole(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	role := Role{}
+	c.Bind(&role)
+	service := &RoleService{ctx}
+	err := service.Save(&role)
+	if err != nil {
+		h.flash.set(c, "alert", err.Error())
+	} else {
+		h.flash.set(c, "notice", fmt.Sprintf("%v is %v now", role.Email, role.Role))
+	}
+	return c.Redirect(http.StatusFound, "/admin/roles")
+}
+
+func (h *adminHandler) deleteRoleConfirm(c echo.Context) error {
+	email := c.Param("email")
+	r := ConfirmRes{
+		Flash:   c.Get("flash").(*Flash),
+		Message: fmt.Sprintf("Are you sure to delete the role of %v?", email),
+		Action:  "/admin/roles/" + email + "/delete",
+		Back:    "/admin/roles",
+	}
+	return c.Render(http.StatusOK, "confirm", &r)
+}
+
+func (h *adminHandler) deleteRole(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	email := c.Param("email")
+	service := &RoleService{ctx}
+	err := service.Delete(email)
+	if err != nil {
+		h.flash.set(c, "alert", fmt.Sprintf("Failed to delete role of %v. error: %v", email, err))
+	} else {
+		h.flash.set(c, "notice", fmt.Sprintf("Role of %v is deleted successfully", email))
+	}
+	return c.Redirect(http.StatusFound, "/admin/roles")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/log"
+)
+
+type TenantsRes struct {
+	Flash   *Flash
+	Current *Tenant
+	Tenants []*Tenant
+}
+
+func (h *adminHandler) tenants(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	service := &TenantService{ctx}
+	tenants, err := service.All()
+	if err != nil {
+		log.Errorf(ctx, "tenants error: %v\n", err)
+		return err
+	}
+	r := TenantsRes{
+		Flash:   c.Get("flash").(*Flash),
+		Current: tenantOf(ctx),
+		Tenants: tenants,
+	}
+	return c.Render(http.StatusOK, "tenants", &r)
+}
+
+func (h *adminHandler) createTenant(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	t := Tenant{}
+	h.bindTenant(c, &t)
+	service := &TenantService{ctx}
+	_, err := service.Find(t.Name)
+	switch err.(type) {
+	case nil:
+		h.flash.set(c, "alert", fmt.Sprintf("Tenant %v already exists", t.Name))
+		return c.Redirect(http.StatusFound, "/admin/tenants")
+	case *EntityNotFound:
+	default:
+		return err
+	}
+	err = service.Save(&t)
+	if err != nil {
+		h.flash.set(c, "alert", err.Error())
+	} else {
+		h.flash.set(c, "notice", "Tenant is created successfully")
+	}
+	return c.Redirect(http.StatusFound, "/admin/tenants")
+}
+
+type TenantRes struct {
+	Flash  *Flash
+	Tenant *Tenant
+}
+
+func (h *adminHandler) editTenant(c echo.Context, t *Tenant) error {
+	r := TenantRes{
+		Flash:  c.Get("flash").(*Flash),
+		Tenant: t,
+	}
+	return c.Render(http.StatusOK, "tenant", &r)
+}
+
+func (h *adminHandler) updateTenant(c echo.Context, t *Tenant) error {
+	ctx := c.Get("aecontext").(context.Context)
+	name := t.Name
+	h.bindTenant(c, t)
+	t.Name = name
+	service := &TenantService{ctx}
+	err := service.Save(t)
+	if err != nil {
+		h.flash.set(c, "alert", err.Error())
+	} else {
+		h.flash.set(c, "notice", "Tenant is updated successfully")
+	}
+	return c.Redirect(http.StatusFound, "/admin/tenants")
+}
+
+func (h *adminHandler) deleteTenantConfirm(c echo.Context, t *Tenant) error {
+	r := ConfirmRes{
+		Flash:   c.Get("flash").(*Flash),
+		Message: fmt.Sprintf("Are you sure to delete the tenant %v? Its watches are kept.", t.Name),
+		Action:  "/admin/tenants/" + t.Name + "/delete",
+		Back:    "/admin/tenants",
+	}
+	return c.Render(http.StatusOK, "confirm", &r)
+}
+
+func (h *adminHandler) deleteTenant(c echo.Context, t *Tenant) error {
+	ctx := c.Get("aecontext").(context.Context)
+	service := &TenantService{ctx}
+	err := service.Delete(t.Name)
+	if err != nil {
+		h.flash.set(c, "alert", fmt.Sprintf("Failed to delete tenant %v. error: %v", t.Name, err))
+	} else {
+		h.flash.set(c, "notice", fmt.Sprintf("Tenant %v is deleted successfully", t.Name))
+	}
+	return c.Redirect(http.StatusFound, "/admin/tenants")
+}
+
+// useTenant switches the tenant of the admin pages. The default namespace is used without name.
+// The user must have a role in the tenant. It's POST to be protected by the CSRF token
+// because it sets the cookie.
+func (h *adminHandler) useTenant(c echo.Context) error {
+	ctx := c.Get("aecontext").(context.Context)
+	name := c.Param("name")
+	var t *Tenant
+	if name != "" {
+		var err error
+		t, err = (&TenantService{ctx}).Find(name)
+		if err != nil {
+			h.flash.set(c, "alert", fmt.Sprintf("Tenant not found: %v", name))
+			return c.Redirect(http.StatusFound, "/admin/tenants")
+		}
+	}
+	tctx, err := withTenant(ctx, t)
+	if err != nil {
+		return err
+	}
+	err = (&RoleService{tctx}).authorize(ROLE_VIEWER)
+	if err != nil {
+		return h.forbidden(c, err)
+	}
+	h.setTenantCookie(c, name)
+	return c.Redirect(http.StatusFound, "/admin/watches")
+}
+
+func (h *adminHandler) setTenantCookie(c echo.Context, name string) {
+	cookie := new(http.Cookie)
+	cookie.Path = "/admin/"
+	cookie.Name = "tenant"
+	cookie.Value = name
+	if name == "" {
+		cookie.Expires = time.Unix(0, 0)
+	}
+	c.SetCookie(cookie)
+}
+
+func (h *adminHandler) bindTenant(c echo.Context, t *Tenant) {
+	c.Bind(t)
+	t.Buckets = splitLines(c.FormValue("buckets"))
+	t.TopicProjects = splitLines(c.FormValue("topic_projects"))
+}
+
+func (h *adminHandler) withTenantName(f func(c echo.Context, t *Tenant) error) func(c echo.Context) error {
+	return h.wrap(h.requireDefault(ROLE_OWNER, func(c echo.Context) error {
+		ctx := c.Get("aecontext").(context.Context)
+		t, err := (&TenantService{ctx}).Find(c.Param("name"))
+		if err != nil {
+			switch err.(type) {
+			case *EntityNotFound:
+				h.flash.set(c, "alert", fmt.Sprintf("Tenant not found: %v", c.Param("name")))
+			default:
+				h.flash.set(c, "alert", fmt.Sprintf("Failed to find tenant %v. error: %v", c.Param("name"), err))
+			}
+			return c.Redirect(http.StatusFound, "/admin/tenants")
+		}
+		return f(c, t)
+	}))
+}
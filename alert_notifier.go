@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/mail"
+	"google.golang.org/appengine/urlfetch"
+)
+
+type (
+	// SilenceAlert is the alert of a bucket which doesn't receive notifications.
+	SilenceAlert struct {
+		Tenant         string     `json:"tenant,omitempty"`
+		Bucket         string     `json:"bucket"`
+		ExpectedWithin int        `json:"expected_within"`  // minutes
+		LastReceivedAt *time.Time `json:"last_received_at"` // nil if the bucket has never received
+		Message        string     `json:"message"`
+	}
+
+	AlertNotifier interface {
+		Alert(ctx context.Context, alert *SilenceAlert) error
+	}
+
+	// pubsubAlertNotifier publishes the alert as a JSON message to the topic.
+	pubsubAlertNotifier struct {
+		publisher Publisher
+		topic     string
+	}
+
+	// mailAlertNotifier sends the alert by App Engine mail.
+	mailAlertNotifier struct {
+		sender string
+		to     []string
+	}
+
+	// webhookAlertNotifier posts the alert as JSON to the URL.
+	webhookAlertNotifier struct {
+		url string
+	}
+)
+
+const (
+	ALERT_NOTIFIER_PUBSUB  = "pubsub"
+	ALERT_NOTIFIER_MAIL    = "mail"
+	ALERT_NOTIFIER_WEBHOOK = "webhook"
+)
+
+var ALERT_NOTIFIERS = []string{ALERT_NOTIFIER_PUBSUB, ALERT_NOTIFIER_MAIL, ALERT_NOTIFIER_WEBHOOK}
+
+func newSilenceAlert(t *Tenant, a *BucketAlert, lastReceivedAt time.Time) *SilenceAlert {
+	res := &SilenceAlert{
+		Bucket:         a.Bucket,
+		ExpectedWithin: a.ExpectedWithin,
+	}
+	if t != nil {
+		res.Tenant = t.Name
+	}
+	if lastReceivedAt.IsZero() {
+		res.Message = fmt.Sprintf("Bucket %v has received no notification", a.Bucket)
+	} else {
+		res.LastReceivedAt = &lastReceivedAt
+		res.Message = fmt.Sprintf("Bucket %v has received no notification since %v", a.Bucket, lastReceivedAt.Format(time.RFC3339))
+	}
+	res.Message += fmt.Sprintf(" while it's expected within %d minutes", a.ExpectedWithin)
+	return res
+}
+
+// newAlertNotifier returns the AlertNotifier of the Notifier of the BucketAlert.
+func newAlertNotifier(ctx context.Context, a *BucketAlert) (AlertNotifier, error) {
+	switch a.Notifier {
+	case ALERT_NOTIFIER_PUBSUB:
+		publisher, err := newPubsubPublisher(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &pubsubAlertNotifier{publisher, a.Target}, nil
+	case ALERT_NOTIFIER_MAIL:
+		return &mailAlertNotifier{alertMailSender(ctx), a.MailAddresses()}, nil
+	case ALERT_NOTIFIER_WEBHOOK:
+		return &webhookAlertNotifier{a.Target}, nil
+	default:
+		return nil, &ValidationError{fmt.Sprintf("Invalid notifier: %v", a.Notifier)}
+	}
+}
+
+// alertMailSender returns ALERT_MAIL_SENDER or the default sender of the application.
+func alertMailSender(ctx context.Context) string {
+	if sender := os.Getenv("ALERT_MAIL_SENDER"); sender != "" {
+		return sender
+	}
+	return fmt.Sprintf("noreply@%v.appspotmail.com", appengine.AppID(ctx))
+}
+
+func (n *pubsubAlertNotifier) Alert(ctx context.Context, alert *SilenceAlert) error {
+	b, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	msg := &PubsubMessage{
+		Data: base64.StdEncoding.EncodeToString(b),
+		Attributes: map[string]string{
+			"alert":  "bucket_silent",
+			"bucket": alert.Bucket,
+		},
+	}
+	_, err = n.publisher.Publish(n.topic, msg)
+	return err
+}
+
+func (n *mailAlertNotifier) Alert(ctx context.Context, alert *SilenceAlert) error {
+	msg := &mail.Message{
+		Sender:  n.sender,
+		To:      n.to,
+		Subject: fmt.Sprintf("[gcs-watcher] Bucket %v is silent", alert.Bucket),
+		Body:    alert.Message + "\n",
+	}
+	return mail.Send(ctx, msg)
+}
+
+func (n *webhookAlertNotifier) Alert(ctx context.Context, alert *SilenceAlert) error {
+	b, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	res, err := urlfetch.Client(ctx).Post(n.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Webhook %v responded %v", n.url, res.Status)
+	}
+	return nil
+}
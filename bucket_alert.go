@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// A BucketAlert expects the notifications of its bucket at least once within
+// ExpectedWithin minutes. The cron job alerts through the notifier once per
+// silence if the bucket doesn't receive any notification, for example because
+// the channel expired or the notification config was removed.
+
+type (
+	BucketAlert struct {
+		Bucket         string    `form:"bucket" json:"bucket" datastore:"-"`        // from key
+		ExpectedWithin int       `form:"expected_within" json:"expected_within"`    // minutes
+		Notifier       string    `form:"notifier" json:"notifier"`                  // one of ALERT_NOTIFIERS
+		Target         string    `form:"target" json:"target" datastore:",noindex"` // topic, email addresses separated by comma, or webhook URL
+		UpdatedAt      time.Time `form:"-" json:"updated_at"`
+		AlertedAt      time.Time `form:"-" json:"alerted_at"`
+	}
+
+	// BucketActivity is the last time when the bucket received a notification.
+	BucketActivity struct {
+		Bucket         string `datastore:"-"` // from key
+		LastReceivedAt time.Time
+	}
+
+	BucketAlertService struct {
+		ctx context.Context
+	}
+)
+
+const (
+	BUCKET_ALERT_KIND    = "BucketAlerts"
+	BUCKET_ACTIVITY_KIND = "BucketActivities"
+
+	// BucketActivity is updated at most once in this interval not to write it for every notification.
+	BUCKET_ACTIVITY_INTERVAL = time.Minute
+)
+
+func (a *BucketAlert) Validate(t *Tenant) error {
+	if !BUCKET_REGEXP.MatchString(a.Bucket) {
+		return &ValidationError{fmt.Sprintf("Invalid bucket: %v", a.Bucket)}
+	}
+	if t != nil && !t.AllowsBucket(a.Bucket) {
+		return &ValidationError{fmt.Sprintf("Bucket %v is not allowed for tenant %v", a.Bucket, t.Name)}
+	}
+	if a.ExpectedWithin < 1 {
+		return &ValidationError{fmt.Sprintf("Invalid expected_within: %v", a.ExpectedWithin)}
+	}
+	switch a.Notifier {
+	case ALERT_NOTIFIER_PUBSUB:
+		if !TOPIC_REGEXP.MatchString(a.Target) {
+			return &ValidationError{fmt.Sprintf("Invalid topic: %v", a.Target)}
+		}
+		if t != nil && !t.AllowsTopic(a.Target) {
+			return &ValidationError{fmt.Sprintf("Topic %v is not allowed for tenant %v", a.Target, t.Name)}
+		}
+	case ALERT_NOTIFIER_MAIL:
+		for _, addr := range a.MailAddresses() {
+			if !strings.Contains(addr, "@") {
+				return &ValidationError{fmt.Sprintf("Invalid email: %v", addr)}
+			}
+		}
+		if len(a.MailAddresses()) == 0 {
+			return &ValidationError{"No email address"}
+		}
+	case ALERT_NOTIFIER_WEBHOOK:
+		u, err := url.Parse(a.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &ValidationError{fmt.Sprintf("Invalid webhook URL: %v", a.Target)}
+		}
+	default:
+		return &ValidationError{fmt.Sprintf("Invalid notifier: %v", a.Notifier)}
+	}
+	return nil
+}
+
+// MailAddresses returns the addresses of Target for ALERT_NOTIFIER_MAIL.
+func (a *BucketAlert) MailAddresses() []string {
+	res := []string{}
+	for _, addr := range strings.Split(a.Target, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			res = append(res, addr)
+		}
+	}
+	return res
+}
+
+// silentSince returns the time since when the bucket is silent.
+// The settings are regarded as the start of the silence if they are updated later.
+func (a *BucketAlert) silentSince(lastReceivedAt time.Time) time.Time {
+	if a.UpdatedAt.After(lastReceivedAt) {
+		return a.UpdatedAt
+	}
+	return lastReceivedAt
+}
+
+// shouldAlert returns true if the bucket is silent longer than ExpectedWithin
+// and the silence isn't alerted yet.
+func (a *BucketAlert) shouldAlert(lastReceivedAt, now time.Time) bool {
+	since := a.silentSince(lastReceivedAt)
+	if now.Sub(since) < time.Duration(a.ExpectedWithin)*time.Minute {
+		return false
+	}
+	return !a.AlertedAt.After(since)
+}
+
+func (s *BucketAlertService) key(bucket string) *datastore.Key {
+	return datastore.NewKey(s.ctx, BUCKET_ALERT_KIND, bucket, 0, nil)
+}
+
+func (s *BucketAlertService) activityKey(bucket string) *datastore.Key {
+	return datastore.NewKey(s.ctx, BUCKET_ACTIVITY_KIND, bucket, 0, nil)
+}
+
+func (s *BucketAlertService) All() ([]*BucketAlert, error) {
+	res := []*BucketAlert{}
+	keys, err := datastore.NewQuery(BUCKET_ALERT_KIND).GetAll(s.ctx, &res)
+	if err != nil {
+		log.Errorf(s.ctx, "BucketAlertService.All [%T]%v\n", err, err)
+		return nil, err
+	}
+	for i, key := range keys {
+		res[i].Bucket = key.StringID()
+	}
+	sort.Sort(bucketAlertsByBucket(res))
+	return res, nil
+}
+
+// Save creates or updates the alert of the bucket. The silence is counted from now.
+func (s *BucketAlertService) Save(a *BucketAlert) error {
+	a.Bucket = strings.TrimSpace(a.Bucket)
+	a.Target = strings.TrimSpace(a.Target)
+	err := a.Validate(tenantOf(s.ctx))
+	if err != nil {
+		return err
+	}
+	a.UpdatedAt = time.Now()
+	a.AlertedAt = time.Time{}
+	_, err = datastore.Put(s.ctx, s.key(a.Bucket), a)
+	if err != nil {
+		log.Errorf(s.ctx, "BucketAlertService.Save(%v) [%T]%v\n", a, err, err)
+		return err
+	}
+	return nil
+}
+
+func (s *BucketAlertService) Delete(bucket string) error {
+	return datastore.Delete(s.ctx, s.key(bucket))
+}
+
+// Activities returns the activities of the buckets by bucket name.
+func (s *BucketAlertService) Activities() (map[string]*BucketActivity, error) {
+	activities := []*BucketActivity{}
+	keys, err := datastore.NewQuery(BUCKET_ACTIVITY_KIND).GetAll(s.ctx, &activities)
+	if err != nil {
+		log.Errorf(s.ctx, "BucketAlertService.Activities [%T]%v\n", err, err)
+		return nil, err
+	}
+	res := map[string]*BucketActivity{}
+	for i, key := range keys {
+		activities[i].Bucket = key.StringID()
+		res[key.StringID()] = activities[i]
+	}
+	return res, nil
+}
+
+// recordActivity records that the bucket received a notification.
+func (s *BucketAlertService) recordActivity(bucket string) {
+	if bucket == "" {
+		return
+	}
+	key := s.activityKey(bucket)
+	now := time.Now()
+	activity := BucketActivity{}
+	err := datastore.Get(s.ctx, key, &activity)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Warningf(s.ctx, "Failed to get the activity of bucket %v: %v\n", bucket, err)
+		return
+	}
+	if now.Sub(activity.LastReceivedAt) < BUCKET_ACTIVITY_INTERVAL {
+		return
+	}
+	activity.LastReceivedAt = now
+	_, err = datastore.Put(s.ctx, key, &activity)
+	if err != nil {
+		log.Warningf(s.ctx, "Failed to record the activity of bucket %v: %v\n", bucket, err)
+	}
+}
+
+// Check alerts the silent buckets by the notifiers given by notifierFor.
+// It returns the first error after checking all the alerts.
+func (s *BucketAlertService) Check(now time.Time, notifierFor func(context.Context, *BucketAlert) (AlertNotifier, error)) error {
+	alerts, err := s.All()
+	if err != nil {
+		return err
+	}
+	activities, err := s.Activities()
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, a := range alerts {
+		lastReceivedAt := time.Time{}
+		if activity, ok := activities[a.Bucket]; ok {
+			lastReceivedAt = activity.LastReceivedAt
+		}
+		if !a.shouldAlert(lastReceivedAt, now) {
+			continue
+		}
+		err := s.alert(a, lastReceivedAt, now, notifierFor)
+		alertsTotal.inc(a.Bucket, a.Notifier, outcomeOf(err))
+		if err != nil {
+			loggerOf(s.ctx).Error(s.ctx, "Failed to alert the silent bucket", "bucket", a.Bucket, "notifier", a.Notifier, "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (s *BucketAlertService) alert(a *BucketAlert, lastReceivedAt, now time.Time, notifierFor func(context.Context, *BucketAlert) (AlertNotifier, error)) error {
+	notifier, err := notifierFor(s.ctx, a)
+	if err != nil {
+		return err
+	}
+	msg := newSilenceAlert(tenantOf(s.ctx), a, lastReceivedAt)
+	err = notifier.Alert(s.ctx, msg)
+	if err != nil {
+		return err
+	}
+	loggerOf(s.ctx).Warning(s.ctx, "Alerted the silent bucket", "bucket", a.Bucket, "notifier", a.Notifier, "last_received_at", lastReceivedAt)
+	// Update only AlertedAt not to overwrite the settings updated meanwhile
+	key := s.key(a.Bucket)
+	return datastore.RunInTransaction(s.ctx, func(tc context.Context) error {
+		current := BucketAlert{}
+		err := datastore.Get(tc, key, &current)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		current.AlertedAt = now
+		_, err = datastore.Put(tc, key, &current)
+		return err
+	}, nil)
+}
+
+func outcomeOf(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+type bucketAlertsByBucket []*BucketAlert
+
+func (a bucketAlertsByBucket) Len() int {
+	return len(a)
+}
+
+func (a bucketAlertsByBucket) Less(i, j int) bool {
+	return a[i].Bucket < a[j].Bucket
+}
+
+func (a bucketAlertsByBucket) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+// checkBucketAlerts is requested by the cron job in cron.yaml.
+// It checks the alerts of the default namespace and every tenant.
+func (h *handler) checkBucketAlerts(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	tenants, err := (&TenantService{ctx}).All()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	var firstErr error
+	for _, t := range append([]*Tenant{nil}, tenants...) {
+		tctx, err := withTenant(ctx, t)
+		if err == nil {
+			if t != nil {
+				tctx = withLogger(tctx, loggerOf(tctx).With("tenant", t.Name))
+			}
+			err = (&BucketAlertService{tctx}).Check(time.Now(), newAlertNotifier)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return c.String(http.StatusInternalServerError, firstErr.Error())
+	}
+	return c.String(http.StatusOK, "OK")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+type dummyAlertNotifier struct {
+	alerts []*SilenceAlert
+}
+
+func (n *dummyAlertNotifier) Alert(ctx context.Context, alert *SilenceAlert) error {
+	n.alerts = append(n.alerts, alert)
+	return nil
+}
+
+func TestBucketAlertValidate(t *testing.T) {
+	valid := func() *BucketAlert {
+		return &BucketAlert{Bucket: "bucket1", ExpectedWithin: 60, Notifier: ALERT_NOTIFIER_PUBSUB, Target: "projects/proj1/topics/alerts"}
+	}
+	assert.NoError(t, valid().Validate(nil))
+
+	a := valid()
+	a.ExpectedWithin = 0
+	assert.Error(t, a.Validate(nil))
+
+	a = valid()
+	a.Notifier = "sms"
+	assert.Error(t, a.Validate(nil))
+
+	a = valid()
+	a.Target = "alerts"
+	assert.Error(t, a.Validate(nil))
+
+	a = valid()
+	a.Notifier, a.Target = ALERT_NOTIFIER_MAIL, "foo@example.com, bar@example.com"
+	assert.NoError(t, a.Validate(nil))
+	assert.Equal(t, []string{"foo@example.com", "bar@example.com"}, a.MailAddresses())
+	a.Target = "foo"
+	assert.Error(t, a.Validate(nil))
+	a.Target = ""
+	assert.Error(t, a.Validate(nil))
+
+	a = valid()
+	a.Notifier, a.Target = ALERT_NOTIFIER_WEBHOOK, "https://example.com/hooks/1"
+	assert.NoError(t, a.Validate(nil))
+	a.Target = "ftp://example.com/"
+	assert.Error(t, a.Validate(nil))
+
+	tenant := &Tenant{Name: "team1", Buckets: []string{"bucket1"}, TopicProjects: []string{"proj1"}}
+	assert.NoError(t, valid().Validate(tenant))
+	a = valid()
+	a.Bucket = "bucket2"
+	assert.Error(t, a.Validate(tenant))
+	a = valid()
+	a.Target = "projects/proj2/topics/alerts"
+	assert.Error(t, a.Validate(tenant))
+}
+
+func TestBucketAlertShouldAlert(t *testing.T) {
+	now := time.Date(2017, 2, 20, 12, 0, 0, 0, time.UTC)
+	a := &BucketAlert{Bucket: "bucket1", ExpectedWithin: 60, UpdatedAt: now.Add(-24 * time.Hour)}
+
+	assert.False(t, a.shouldAlert(now.Add(-59*time.Minute), now))
+	assert.True(t, a.shouldAlert(now.Add(-60*time.Minute), now))
+	// Never received since the update
+	assert.True(t, a.shouldAlert(time.Time{}, now))
+
+	// Updated recently
+	a.UpdatedAt = now.Add(-10 * time.Minute)
+	assert.False(t, a.shouldAlert(time.Time{}, now))
+	a.UpdatedAt = now.Add(-24 * time.Hour)
+
+	// Alerted already for the silence
+	a.AlertedAt = now.Add(-10 * time.Minute)
+	assert.False(t, a.shouldAlert(now.Add(-2*time.Hour), now))
+	// Received after the alert and silent again
+	assert.True(t, a.shouldAlert(now.Add(-5*time.Minute), now.Add(time.Hour)))
+}
+
+func TestNewSilenceAlert(t *testing.T) {
+	last := time.Date(2017, 2, 20, 10, 0, 0, 0, time.UTC)
+	a := &BucketAlert{Bucket: "bucket1", ExpectedWithin: 60}
+
+	alert := newSilenceAlert(&Tenant{Name: "team1"}, a, last)
+	assert.Equal(t, "team1", alert.Tenant)
+	assert.Equal(t, "bucket1", alert.Bucket)
+	assert.Equal(t, &last, alert.LastReceivedAt)
+	assert.Equal(t, "Bucket bucket1 has received no notification since 2017-02-20T10:00:00Z while it's expected within 60 minutes", alert.Message)
+
+	alert = newSilenceAlert(nil, a, time.Time{})
+	assert.Equal(t, "", alert.Tenant)
+	assert.Nil(t, alert.LastReceivedAt)
+}
+
+func TestBucketAlertServiceCheck(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, BUCKET_ALERT_KIND)
+	ClearDatastore(t, ctx, BUCKET_ACTIVITY_KIND)
+	service := &BucketAlertService{ctx}
+	for _, bucket := range []string{"bucket1", "bucket2"} {
+		assert.NoError(t, service.Save(&BucketAlert{Bucket: bucket, ExpectedWithin: 60, Notifier: ALERT_NOTIFIER_WEBHOOK, Target: "https://example.com/hooks/1"}))
+	}
+	service.recordActivity("bucket1")
+
+	retryWith(10, func() func() {
+		activities, err := service.Activities()
+		if assert.NoError(t, err) && activities["bucket1"] == nil {
+			return func() {
+				t.Fatalf("activity of bucket1 expects to be recorded but was %v\n", activities)
+			}
+		}
+		return nil
+	})
+	var alerts []*BucketAlert
+	retryWith(10, func() func() {
+		alerts, err = service.All()
+		if assert.NoError(t, err) && len(alerts) != 2 {
+			return func() {
+				t.Fatalf("alerts expects 2 but was %v\n", alerts)
+			}
+		}
+		return nil
+	})
+
+	notifier := &dummyAlertNotifier{}
+	notifierFor := func(ctx context.Context, a *BucketAlert) (AlertNotifier, error) {
+		return notifier, nil
+	}
+
+	// Not silent yet
+	assert.NoError(t, service.Check(time.Now(), notifierFor))
+	assert.Equal(t, 0, len(notifier.alerts))
+
+	// bucket2 has never received, and bucket1 received 30 minutes ago
+	_, err = datastore.Put(ctx, service.activityKey("bucket1"), &BucketActivity{LastReceivedAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.NoError(t, service.Check(time.Now().Add(90*time.Minute), notifierFor))
+	if assert.Equal(t, 1, len(notifier.alerts)) {
+		assert.Equal(t, "bucket2", notifier.alerts[0].Bucket)
+		assert.Nil(t, notifier.alerts[0].LastReceivedAt)
+	}
+
+	a := BucketAlert{}
+	assert.NoError(t, datastore.Get(ctx, service.key("bucket2"), &a))
+	assert.False(t, a.AlertedAt.IsZero())
+	assert.Equal(t, "https://example.com/hooks/1", a.Target)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Channel is the notification channel of a bucket created by
+// `gsutil notification watchbucket`. It's recorded when the sync message
+// of the channel is received.
+type Channel struct {
+	ID          string    `json:"id" datastore:"-"` // from key. X-Goog-Channel-Id
+	ResourceID  string    `json:"resource_id"`      // X-Goog-Resource-Id, used to stop the channel
+	ResourceUri string    `json:"resource_uri" datastore:",noindex"`
+	Bucket      string    `json:"bucket"`
+	Expiration  time.Time `json:"expiration"` // zero if the channel doesn't expire
+	SyncedAt    time.Time `json:"synced_at"`
+
+	SyncMessageNumber int64     `json:"sync_message_number"` // X-Goog-Message-Number of the sync message
+	GapCount          int64     `json:"gap_count"`
+	MissingCount      int64     `json:"missing_count"` // the number of the messages skipped by the gaps
+	OutOfOrderCount   int64     `json:"out_of_order_count"`
+	LastGapAt         time.Time `json:"last_gap_at"`
+}
+
+const (
+	CHANNEL_KIND = "Channels"
+
+	// Channels which expire within this duration are shown as expiring.
+	CHANNEL_EXPIRING_WITHIN = 7 * 24 * time.Hour
+)
+
+var (
+	// RESOURCE_URI_BUCKET_REGEXP extracts the bucket of the resource URI like
+	// https://www.googleapis.com/storage/v1/b/BUCKET/o?alt=json
+	// https://www.googleapis.com/storage/v1/b/BUCKET/o/OBJECT
+	RESOURCE_URI_BUCKET_REGEXP = regexp.MustCompile(`/b/([^/?]+)/o(?:[/?]|\z)`)
+)
+
+// validChannelToken returns true if X-Goog-Channel-Token is CHANNEL_TOKEN environment variable.
+// Anyone can send OCN requests, so it's false without CHANNEL_TOKEN not to record
+// the channels or track the numbers of their messages.
+func validChannelToken(header http.Header) bool {
+	token := os.Getenv("CHANNEL_TOKEN")
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(header.Get("X-Goog-Channel-Token")), []byte(token)) == 1
+}
+
+// channelFromHeader returns the Channel of the headers of a sync message.
+func channelFromHeader(header http.Header) (*Channel, error) {
+	c := &Channel{
+		ID:          header.Get("X-Goog-Channel-Id"),
+		ResourceID:  header.Get("X-Goog-Resource-Id"),
+		ResourceUri: header.Get("X-Goog-Resource-Uri"),
+	}
+	if c.ID == "" {
+		return nil, &ValidationError{"No X-Goog-Channel-Id"}
+	}
+	c.Bucket = bucketOfResourceUri(c.ResourceUri)
+	if n := header.Get("X-Goog-Message-Number"); n != "" {
+		number, err := strconv.ParseInt(n, 10, 64)
+		if err != nil {
+			return nil, &ValidationError{fmt.Sprintf("Invalid X-Goog-Message-Number: %v", n)}
+		}
+		c.SyncMessageNumber = number
+	}
+	if exp := header.Get("X-Goog-Channel-Expiration"); exp != "" {
+		t, err := http.ParseTime(exp)
+		if err != nil {
+			return nil, &ValidationError{fmt.Sprintf("Invalid X-Goog-Channel-Expiration: %v", exp)}
+		}
+		c.Expiration = t
+	}
+	return c, nil
+}
+
+func bucketOfResourceUri(uri string) string {
+	if m := RESOURCE_URI_BUCKET_REGEXP.FindStringSubmatch(uri); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// ExpiredAt returns true if the Channel is expired at the time.
+func (c *Channel) ExpiredAt(t time.Time) bool {
+	return !c.Expiration.IsZero() && !c.Expiration.After(t)
+}
+
+// Status returns "expired", "expiring" or "active" for the admin page.
+func (c *Channel) Status() string {
+	now := time.Now()
+	switch {
+	case c.ExpiredAt(now):
+		return "expired"
+	case c.ExpiredAt(now.Add(CHANNEL_EXPIRING_WITHIN)):
+		return "expiring"
+	default:
+		return "active"
+	}
+}
+
+// ExpirationValue returns Expiration for the admin page.
+func (c *Channel) ExpirationValue() string {
+	return formTime(c.Expiration)
+}
+
+type ChannelService struct {
+	ctx context.Context
+}
+
+func (s *ChannelService) key(id string) *datastore.Key {
+	return datastore.NewKey(s.ctx, CHANNEL_KIND, id, 0, nil)
+}
+
+// All returns the channels ordered by bucket and expiration.
+func (s *ChannelService) All() ([]*Channel, error) {
+	res := []*Channel{}
+	keys, err := datastore.NewQuery(CHANNEL_KIND).GetAll(s.ctx, &res)
+	if err != nil {
+		log.Errorf(s.ctx, "ChannelService.All [%T]%v\n", err, err)
+		return nil, err
+	}
+	for i, key := range keys {
+		res[i].ID = key.StringID()
+	}
+	sort.Sort(channelsByBucket(res))
+	return res, nil
+}
+
+// Sync records the Channel of a sync message and starts tracking its message numbers.
+func (s *ChannelService) Sync(c *Channel) error {
+	c.SyncedAt = time.Now()
+	_, err := datastore.Put(s.ctx, s.key(c.ID), c)
+	if err != nil {
+		log.Errorf(s.ctx, "ChannelService.Sync(%v) [%T]%v\n", c, err, err)
+		return err
+	}
+	err = s.resetMessageNumber(c.ID, c.SyncMessageNumber)
+	if err != nil {
+		log.Warningf(s.ctx, "Failed to reset the message number of channel %v: %v\n", c.ID, err)
+	}
+	return nil
+}
+
+func (s *ChannelService) Delete(id string) error {
+	return datastore.Delete(s.ctx, s.key(id))
+}
+
+type channelsByBucket []*Channel
+
+func (c channelsByBucket) Len() int {
+	return len(c)
+}
+
+func (c channelsByBucket) Less(i, j int) bool {
+	if c[i].Bucket != c[j].Bucket {
+		return c[i].Bucket < c[j].Bucket
+	}
+	return c[i].Expiration.Before(c[j].Expiration)
+}
+
+func (c channelsByBucket) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+}
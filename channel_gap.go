@@ -0,0 +1,281 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// OCN numbers the messages of a channel by X-Goog-Message-Number in ascending
+// order. The last number of each channel is kept in memcache not to write
+// Datastore for every notification, and a ChannelGap is recorded when a message
+// skips numbers. The numbers are tracked when the notifications arrive, so the
+// retries of failed notifications are ignored as the numbers received already.
+// The skipped numbers are kept with the last number, and a skipped message which
+// arrives later is recorded as out of order and cleared from its gap.
+// Nothing is detected if the number is evicted from memcache.
+
+type (
+	ChannelGap struct {
+		ChannelID      string
+		Bucket         string
+		Kind           string // GAP_KIND_GAP or GAP_KIND_OUT_OF_ORDER
+		LastNumber     int64  // the last number received before the gap
+		Number         int64
+		Missing        int64     // the number of the skipped messages not received yet for GAP_KIND_GAP
+		Late           int64     // the number of the skipped messages received later for GAP_KIND_GAP
+		LastReceivedAt time.Time // when LastNumber was received
+		DetectedAt     time.Time
+		Resync         bool // true if the resync of the bucket is requested
+	}
+
+	// messageMark is the last message of a channel in memcache.
+	messageMark struct {
+		Number     int64            `json:"number"`
+		ReceivedAt time.Time        `json:"received_at"`
+		Skipped    []skippedNumbers `json:"skipped,omitempty"`
+	}
+
+	// skippedNumbers are the numbers from From to To skipped by the gap after After.
+	skippedNumbers struct {
+		From  int64 `json:"from"`
+		To    int64 `json:"to"`
+		After int64 `json:"after"` // LastNumber of the ChannelGap
+	}
+)
+
+const (
+	CHANNEL_GAP_KIND = "ChannelGaps"
+
+	GAP_KIND_GAP          = "gap"
+	GAP_KIND_OUT_OF_ORDER = "out_of_order"
+
+	// The admin page shows this number of the latest gaps.
+	CHANNEL_GAPS_LIMIT = 100
+
+	MESSAGE_MARK_CAS_RETRIES = 3
+
+	// The skipped numbers of this number of the latest gaps are kept.
+	MESSAGE_MARK_SKIPPED_LIMIT = 20
+)
+
+// track updates the mark by the number received and returns the kind of the gap
+// and the last number before the gap. It returns "" if the number is the next
+// of the last one or a retry of a number received already.
+func (m *messageMark) track(number int64, now time.Time) (string, int64) {
+	switch {
+	case m.Number == 0 || number == m.Number+1:
+		m.Number, m.ReceivedAt = number, now
+		return "", 0
+	case number > m.Number+1:
+		after := m.Number
+		m.Skipped = append(m.Skipped, skippedNumbers{From: after + 1, To: number - 1, After: after})
+		if len(m.Skipped) > MESSAGE_MARK_SKIPPED_LIMIT {
+			m.Skipped = m.Skipped[len(m.Skipped)-MESSAGE_MARK_SKIPPED_LIMIT:]
+		}
+		m.Number, m.ReceivedAt = number, now
+		return GAP_KIND_GAP, after
+	}
+	for i, r := range m.Skipped {
+		if number < r.From || r.To < number {
+			continue
+		}
+		rest := []skippedNumbers{}
+		if r.From < number {
+			rest = append(rest, skippedNumbers{From: r.From, To: number - 1, After: r.After})
+		}
+		if number < r.To {
+			rest = append(rest, skippedNumbers{From: number + 1, To: r.To, After: r.After})
+		}
+		m.Skipped = append(m.Skipped[:i], append(rest, m.Skipped[i+1:]...)...)
+		return GAP_KIND_OUT_OF_ORDER, r.After
+	}
+	return "", 0
+}
+
+func messageMarkKey(channelID string) string {
+	return "channel_message_mark:" + channelID
+}
+
+// resetMessageNumber sets the number of the sync message as the last number of the channel.
+func (s *ChannelService) resetMessageNumber(channelID string, number int64) error {
+	return memcache.JSON.Set(s.ctx, &memcache.Item{
+		Key:    messageMarkKey(channelID),
+		Object: &messageMark{Number: number, ReceivedAt: time.Now()},
+	})
+}
+
+// trackMessage tracks the number of the channel and returns the last mark
+// before it, the kind of the gap and the last number before the gap.
+// It returns nil for the first message.
+func (s *ChannelService) trackMessage(channelID string, number int64, now time.Time) (*messageMark, string, int64, error) {
+	key := messageMarkKey(channelID)
+	var err error
+	for i := 0; i < MESSAGE_MARK_CAS_RETRIES; i++ {
+		mark := messageMark{}
+		var item *memcache.Item
+		item, err = memcache.JSON.Get(s.ctx, key, &mark)
+		if err == memcache.ErrCacheMiss {
+			err = memcache.JSON.Add(s.ctx, &memcache.Item{Key: key, Object: &messageMark{Number: number, ReceivedAt: now}})
+			if err == memcache.ErrNotStored {
+				continue
+			}
+			return nil, "", 0, err
+		}
+		if err != nil {
+			return nil, "", 0, err
+		}
+		last := mark
+		kind, after := mark.track(number, now)
+		if kind == "" && mark.Number == last.Number {
+			// A retry of the number received already
+			return &last, "", 0, nil
+		}
+		item.Object = &mark
+		err = memcache.JSON.CompareAndSwap(s.ctx, item)
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			continue
+		}
+		return &last, kind, after, err
+	}
+	return nil, "", 0, err
+}
+
+// CheckMessage tracks X-Goog-Message-Number of the notification and returns
+// the ChannelGap if the number skips numbers or is one of the skipped numbers.
+func (s *ChannelService) CheckMessage(header http.Header) (*ChannelGap, error) {
+	id := header.Get("X-Goog-Channel-Id")
+	number, err := strconv.ParseInt(header.Get("X-Goog-Message-Number"), 10, 64)
+	if id == "" || err != nil {
+		return nil, nil
+	}
+	now := time.Now()
+	last, kind, after, err := s.trackMessage(id, number, now)
+	if err != nil || last == nil || kind == "" {
+		return nil, err
+	}
+	gap := &ChannelGap{
+		ChannelID:  id,
+		Bucket:     bucketOfResourceUri(header.Get("X-Goog-Resource-Uri")),
+		Kind:       kind,
+		LastNumber: after,
+		Number:     number,
+		DetectedAt: now,
+	}
+	if kind == GAP_KIND_GAP {
+		gap.Missing = number - after - 1
+		gap.LastReceivedAt = last.ReceivedAt
+	}
+	return gap, nil
+}
+
+// gapKey returns the key of the ChannelGap of GAP_KIND_GAP after the last number.
+func (s *ChannelService) gapKey(channelID string, lastNumber int64) *datastore.Key {
+	return datastore.NewKey(s.ctx, CHANNEL_GAP_KIND, channelID+":"+strconv.FormatInt(lastNumber, 10), 0, nil)
+}
+
+// RecordGap stores the ChannelGap and counts it on the Channel if the Channel is recorded.
+// The ChannelGap of GAP_KIND_OUT_OF_ORDER clears the number from the gap which skipped it.
+func (s *ChannelService) RecordGap(gap *ChannelGap) error {
+	key := datastore.NewIncompleteKey(s.ctx, CHANNEL_GAP_KIND, nil)
+	if gap.Kind == GAP_KIND_GAP {
+		key = s.gapKey(gap.ChannelID, gap.LastNumber)
+	}
+	_, err := datastore.Put(s.ctx, key, gap)
+	if err != nil {
+		log.Errorf(s.ctx, "ChannelService.RecordGap(%v) [%T]%v\n", gap, err, err)
+		return err
+	}
+	channelKey := s.key(gap.ChannelID)
+	return datastore.RunInTransaction(s.ctx, func(tc context.Context) error {
+		if gap.Kind == GAP_KIND_OUT_OF_ORDER {
+			skipped := ChannelGap{}
+			gapKey := s.gapKey(gap.ChannelID, gap.LastNumber)
+			err := datastore.Get(tc, gapKey, &skipped)
+			switch {
+			case err == nil && skipped.Missing > 0:
+				skipped.Missing--
+				skipped.Late++
+				_, err = datastore.Put(tc, gapKey, &skipped)
+				if err != nil {
+					return err
+				}
+			case err != nil && err != datastore.ErrNoSuchEntity:
+				return err
+			}
+		}
+		c := Channel{}
+		err := datastore.Get(tc, channelKey, &c)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch gap.Kind {
+		case GAP_KIND_GAP:
+			c.GapCount++
+			c.MissingCount += gap.Missing
+		case GAP_KIND_OUT_OF_ORDER:
+			c.OutOfOrderCount++
+			if c.MissingCount > 0 {
+				c.MissingCount--
+			}
+		}
+		c.LastGapAt = gap.DetectedAt
+		_, err = datastore.Put(tc, channelKey, &c)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// Gaps returns the latest gaps of all the channels.
+func (s *ChannelService) Gaps() ([]*ChannelGap, error) {
+	res := []*ChannelGap{}
+	q := datastore.NewQuery(CHANNEL_GAP_KIND).Order("-DetectedAt").Limit(CHANNEL_GAPS_LIMIT)
+	_, err := q.GetAll(s.ctx, &res)
+	if err != nil {
+		log.Errorf(s.ctx, "ChannelService.Gaps [%T]%v\n", err, err)
+		return nil, err
+	}
+	return res, nil
+}
+
+// checkMessageNumber records the gap of the message number of the notification,
+// and requests the resync of the bucket if RESYNC_ON_GAP is "true".
+// It's called when the notification arrives, so the retries of failed
+// notifications are ignored as the numbers received already.
+func checkMessageNumber(ctx context.Context, header http.Header) {
+	logger := loggerOf(ctx)
+	service := &ChannelService{ctx}
+	gap, err := service.CheckMessage(header)
+	if err != nil {
+		logger.Warning(ctx, "Failed to track the message number", "error", err)
+		return
+	}
+	if gap == nil {
+		return
+	}
+	label := bucketLabel(ctx, gap.Bucket)
+	messageGapsTotal.inc(label, gap.Kind)
+	if gap.Missing > 0 {
+		missedMessagesTotal.add(float64(gap.Missing), label)
+	}
+	logger.Warning(ctx, "Message number gap detected", "kind", gap.Kind, "last_number", gap.LastNumber, "number", gap.Number, "missing", gap.Missing)
+	if gap.Kind == GAP_KIND_GAP && gap.Bucket != "" && resyncOnGap() {
+		keys, err := startResync(ctx, gap.Bucket, gap.LastReceivedAt.Add(-RESYNC_MARGIN))
+		if err != nil {
+			logger.Error(ctx, "Failed to request the resync", "error", err)
+		}
+		gap.Resync = len(keys) > 0
+	}
+	err = service.RecordGap(gap)
+	if err != nil {
+		logger.Warning(ctx, "Failed to record the gap", "error", err)
+	}
+}
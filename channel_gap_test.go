@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	storage "google.golang.org/api/storage/v1"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestMessageMarkTrack(t *testing.T) {
+	now := time.Date(2017, 2, 20, 10, 0, 0, 0, time.UTC)
+	type result struct {
+		kind  string
+		after int64
+	}
+	track := func(m *messageMark, number int64) result {
+		kind, after := m.track(number, now)
+		return result{kind, after}
+	}
+
+	m := &messageMark{}
+	assert.Equal(t, result{"", 0}, track(m, 5))
+	assert.Equal(t, result{"", 0}, track(m, 6))
+	assert.Equal(t, int64(6), m.Number)
+
+	// A failed notification is retried after the next one succeeded
+	assert.Equal(t, result{"", 0}, track(m, 7))
+	assert.Equal(t, result{"", 0}, track(m, 6))
+	assert.Equal(t, int64(7), m.Number)
+
+	// 8 and 9 are skipped
+	assert.Equal(t, result{GAP_KIND_GAP, 7}, track(m, 10))
+	assert.Equal(t, []skippedNumbers{{From: 8, To: 9, After: 7}}, m.Skipped)
+	// 9 arrives later
+	assert.Equal(t, result{GAP_KIND_OUT_OF_ORDER, 7}, track(m, 9))
+	assert.Equal(t, []skippedNumbers{{From: 8, To: 8, After: 7}}, m.Skipped)
+	// The retry of 9 isn't late again
+	assert.Equal(t, result{"", 0}, track(m, 9))
+	assert.Equal(t, int64(10), m.Number)
+
+	// 11 to 13 are skipped and 12 arrives later
+	assert.Equal(t, result{GAP_KIND_GAP, 10}, track(m, 14))
+	assert.Equal(t, result{GAP_KIND_OUT_OF_ORDER, 10}, track(m, 12))
+	assert.Equal(t, []skippedNumbers{{From: 8, To: 8, After: 7}, {From: 11, To: 11, After: 10}, {From: 13, To: 13, After: 10}}, m.Skipped)
+	assert.Equal(t, result{GAP_KIND_OUT_OF_ORDER, 7}, track(m, 8))
+	assert.Equal(t, []skippedNumbers{{From: 11, To: 11, After: 10}, {From: 13, To: 13, After: 10}}, m.Skipped)
+
+	// Only the latest gaps are kept
+	m = &messageMark{Number: 1}
+	for i := int64(0); i < MESSAGE_MARK_SKIPPED_LIMIT+1; i++ {
+		track(m, m.Number+2)
+	}
+	assert.Equal(t, MESSAGE_MARK_SKIPPED_LIMIT, len(m.Skipped))
+	assert.Equal(t, int64(4), m.Skipped[0].From)
+}
+
+func TestUpdatedSince(t *testing.T) {
+	since := time.Date(2017, 2, 20, 10, 0, 0, 0, time.UTC)
+	assert.True(t, updatedSince(&storage.Object{Updated: "2017-02-20T10:00:00.000Z"}, since))
+	assert.True(t, updatedSince(&storage.Object{Updated: "2017-02-20T11:00:00.000Z"}, since))
+	assert.False(t, updatedSince(&storage.Object{Updated: "2017-02-20T09:59:59.999Z"}, since))
+	// Unknown updated time
+	assert.True(t, updatedSince(&storage.Object{}, since))
+}
+
+func TestChannelServiceCheckMessage(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	service := &ChannelService{ctx}
+	assert.NoError(t, service.Sync(&Channel{ID: "channel1", Bucket: "bucket1", SyncMessageNumber: 1}))
+
+	header := func(number string) http.Header {
+		h := http.Header{}
+		h.Set("X-Goog-Channel-Id", "channel1")
+		h.Set("X-Goog-Resource-Uri", "https://www.googleapis.com/storage/v1/b/bucket1/o/path%2Fto%2Ffile")
+		h.Set("X-Goog-Message-Number", number)
+		return h
+	}
+
+	gap, err := service.CheckMessage(header("2"))
+	assert.NoError(t, err)
+	assert.Nil(t, gap)
+
+	gap, err = service.CheckMessage(header("5"))
+	assert.NoError(t, err)
+	if assert.NotNil(t, gap) {
+		assert.Equal(t, GAP_KIND_GAP, gap.Kind)
+		assert.Equal(t, "bucket1", gap.Bucket)
+		assert.Equal(t, int64(2), gap.LastNumber)
+		assert.Equal(t, int64(2), gap.Missing)
+		assert.False(t, gap.LastReceivedAt.IsZero())
+		assert.NoError(t, service.RecordGap(gap))
+	}
+
+	gap, err = service.CheckMessage(header("4"))
+	assert.NoError(t, err)
+	if assert.NotNil(t, gap) {
+		assert.Equal(t, GAP_KIND_OUT_OF_ORDER, gap.Kind)
+		assert.Equal(t, int64(2), gap.LastNumber)
+		assert.Equal(t, int64(0), gap.Missing)
+		assert.NoError(t, service.RecordGap(gap))
+	}
+	// The late message is cleared from the gap
+	skipped := ChannelGap{}
+	assert.NoError(t, datastore.Get(ctx, service.gapKey("channel1", 2), &skipped))
+	assert.Equal(t, int64(1), skipped.Missing)
+	assert.Equal(t, int64(1), skipped.Late)
+
+	// The last number is kept
+	gap, err = service.CheckMessage(header("6"))
+	assert.NoError(t, err)
+	assert.Nil(t, gap)
+
+	// 7 fails and is retried after 8 succeeded
+	for _, number := range []string{"7", "8", "7"} {
+		gap, err = service.CheckMessage(header(number))
+		assert.NoError(t, err)
+		assert.Nil(t, gap, number)
+	}
+
+	// Without message number
+	gap, err = service.CheckMessage(header(""))
+	assert.NoError(t, err)
+	assert.Nil(t, gap)
+
+	var channels []*Channel
+	retryWith(10, func() func() {
+		channels, err = service.All()
+		if assert.NoError(t, err) && (len(channels) != 1 || channels[0].GapCount != 1) {
+			return func() {
+				t.Fatalf("channel1 expects a gap but was %v\n", channels)
+			}
+		}
+		return nil
+	})
+	assert.Equal(t, int64(1), channels[0].MissingCount)
+	assert.Equal(t, int64(1), channels[0].OutOfOrderCount)
+	assert.False(t, channels[0].LastGapAt.IsZero())
+}
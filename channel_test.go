@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/aetest"
+)
+
+func TestChannelFromHeader(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Goog-Channel-Id", "channel1")
+	header.Set("X-Goog-Resource-Id", "resource1")
+	header.Set("X-Goog-Resource-Uri", "https://www.googleapis.com/storage/v1/b/bucket1/o?alt=json")
+	header.Set("X-Goog-Channel-Expiration", "Tue, 19 Nov 2013 01:13:52 GMT")
+	header.Set("X-Goog-Message-Number", "1")
+
+	c, err := channelFromHeader(header)
+	assert.NoError(t, err)
+	assert.Equal(t, "channel1", c.ID)
+	assert.Equal(t, "resource1", c.ResourceID)
+	assert.Equal(t, "bucket1", c.Bucket)
+	assert.Equal(t, int64(1), c.SyncMessageNumber)
+	assert.Equal(t, time.Date(2013, 11, 19, 1, 13, 52, 0, time.UTC), c.Expiration)
+	assert.True(t, c.ExpiredAt(time.Date(2013, 11, 19, 1, 13, 52, 0, time.UTC)))
+	assert.False(t, c.ExpiredAt(time.Date(2013, 11, 19, 1, 13, 51, 0, time.UTC)))
+	assert.Equal(t, "expired", c.Status())
+
+	// Without expiration
+	header.Del("X-Goog-Channel-Expiration")
+	c, err = channelFromHeader(header)
+	assert.NoError(t, err)
+	assert.True(t, c.Expiration.IsZero())
+	assert.Equal(t, "active", c.Status())
+
+	header.Set("X-Goog-Message-Number", "one")
+	_, err = channelFromHeader(header)
+	assert.IsType(t, &ValidationError{}, err)
+	header.Set("X-Goog-Message-Number", "1")
+
+	header.Set("X-Goog-Channel-Expiration", "tomorrow")
+	_, err = channelFromHeader(header)
+	assert.IsType(t, &ValidationError{}, err)
+
+	_, err = channelFromHeader(http.Header{})
+	assert.IsType(t, &ValidationError{}, err)
+}
+
+func TestValidChannelToken(t *testing.T) {
+	defer os.Setenv("CHANNEL_TOKEN", os.Getenv("CHANNEL_TOKEN"))
+	header := http.Header{}
+	header.Set("X-Goog-Channel-Token", "token1")
+
+	// Nothing is valid without CHANNEL_TOKEN
+	os.Setenv("CHANNEL_TOKEN", "")
+	assert.False(t, validChannelToken(header))
+	assert.False(t, validChannelToken(http.Header{}))
+
+	os.Setenv("CHANNEL_TOKEN", "token1")
+	assert.True(t, validChannelToken(header))
+	assert.False(t, validChannelToken(http.Header{}))
+	header.Set("X-Goog-Channel-Token", "token2")
+	assert.False(t, validChannelToken(header))
+}
+
+func TestBucketOfResourceUri(t *testing.T) {
+	assert.Equal(t, "bucket1", bucketOfResourceUri("https://www.googleapis.com/storage/v1/b/bucket1/o?alt=json"))
+	assert.Equal(t, "bucket1", bucketOfResourceUri("https://www.googleapis.com/storage/v1/b/bucket1/o/path%2Fto%2Ffile"))
+	assert.Equal(t, "bucket1", bucketOfResourceUri("https://www.googleapis.com/storage/v1/b/bucket1/o"))
+	assert.Equal(t, "", bucketOfResourceUri("https://www.googleapis.com/storage/v1/b/bucket1/other"))
+}
+
+func TestChannelServiceSync(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, CHANNEL_KIND)
+	service := &ChannelService{ctx}
+	expiration := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	assert.NoError(t, service.Sync(&Channel{ID: "channel2", Bucket: "bucket2"}))
+	assert.NoError(t, service.Sync(&Channel{ID: "channel1", Bucket: "bucket1", Expiration: expiration}))
+
+	var channels []*Channel
+	retryWith(10, func() func() {
+		channels, err = service.All()
+		if assert.NoError(t, err) && len(channels) != 2 {
+			return func() {
+				t.Fatalf("channels expects 2 but was %v\n", channels)
+			}
+		}
+		return nil
+	})
+	assert.Equal(t, "channel1", channels[0].ID)
+	assert.Equal(t, "expiring", channels[0].Status())
+	assert.True(t, expiration.Equal(channels[0].Expiration))
+	assert.False(t, channels[0].SyncedAt.IsZero())
+	assert.Equal(t, "channel2", channels[1].ID)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// A Watch with DebounceSeconds doesn't publish the message of an event soon.
+// The events of the same object are collapsed into a PendingEvent, which keeps
+// the latest version of the object, and a task publishes it after no event
+// comes for DebounceSeconds. The task is added with the ETA in the transaction
+// of the PendingEvent, so the event isn't lost by restarting instances.
+//
+// The publishing is delayed at most DEBOUNCE_MAX_WINDOWS times DebounceSeconds
+// not to wait forever for an object which is updated continuously.
+//
+// A PendingEvent which failed to publish is put back to publish it again after
+// the window. It's dropped after DEBOUNCE_MAX_ATTEMPTS failures not to retry
+// forever, e.g. for a deleted topic.
+
+type (
+	PendingEvent struct {
+		WatchID        string
+		Url            string `datastore:",noindex"`
+		State          string
+		Resource       string `datastore:",noindex"` // JSON of the object resource
+		Captures       string `datastore:",noindex"` // JSON of the named capture groups
+		Stale          bool
+		Generation     int64
+		Metageneration int64
+		Window         int // DebounceSeconds of the Watch
+		Count          int // the number of the collapsed events
+		Attempts       int // the number of the failed attempts to publish
+		FirstAt        time.Time
+		LastAt         time.Time
+		DueAt          time.Time
+	}
+
+	DebounceService struct {
+		ctx context.Context
+	}
+)
+
+const (
+	PENDING_EVENT_KIND = "PendingEvents"
+	DEBOUNCE_PATH      = "/tasks/debounce"
+
+	MAX_DEBOUNCE_SECONDS  = 3600
+	DEBOUNCE_MAX_WINDOWS  = 5
+	DEBOUNCE_MAX_ATTEMPTS = 5
+)
+
+// debounceDueAt returns when the event should be published.
+func debounceDueAt(firstAt, lastAt time.Time, window int) time.Time {
+	w := time.Duration(window) * time.Second
+	due := lastAt.Add(w)
+	if max := firstAt.Add(w * DEBOUNCE_MAX_WINDOWS); due.After(max) {
+		return max
+	}
+	return due
+}
+
+// newPendingEvent returns the PendingEvent of the notification.
+func newPendingEvent(n *Notification) (*PendingEvent, error) {
+	resource, err := json.Marshal(n.Resource)
+	if err != nil {
+		return nil, err
+	}
+	captures, err := json.Marshal(n.Captures)
+	if err != nil {
+		return nil, err
+	}
+	e := &PendingEvent{
+		WatchID:  n.Watch.ID,
+		Url:      n.Url,
+		State:    n.State,
+		Resource: string(resource),
+		Captures: string(captures),
+		Stale:    n.Stale,
+		Window:   n.Watch.DebounceSeconds,
+		Count:    1,
+	}
+	// The events without version are collapsed in the order of arrival
+	if v, err := objectVersionOf(n.Url, n.State, n.Resource); err == nil {
+		e.Generation, e.Metageneration = v.Generation, v.Metageneration
+	}
+	return e, nil
+}
+
+func (e *PendingEvent) version() *ObjectState {
+	return &ObjectState{Url: e.Url, Generation: e.Generation, Metageneration: e.Metageneration, State: e.State}
+}
+
+// merge collapses the older event into e. e keeps the latest version of the object.
+func (e *PendingEvent) merge(older *PendingEvent) {
+	if e.version().Before(older.version()) {
+		e.State, e.Resource, e.Captures, e.Stale = older.State, older.Resource, older.Captures, older.Stale
+		e.Generation, e.Metageneration = older.Generation, older.Metageneration
+	}
+	e.Count += older.Count
+	if older.Attempts > e.Attempts {
+		e.Attempts = older.Attempts
+	}
+	if !older.FirstAt.IsZero() && older.FirstAt.Before(e.FirstAt) {
+		e.FirstAt = older.FirstAt
+	}
+}
+
+// retry counts the failed attempt and returns true if it should be published again.
+func (e *PendingEvent) retry() bool {
+	e.Attempts++
+	return e.Attempts < DEBOUNCE_MAX_ATTEMPTS
+}
+
+// notification returns the Notification to publish with the current Watch.
+func (e *PendingEvent) notification(w *Watch) (*Notification, error) {
+	n := &Notification{
+		Topic: w.Topic,
+		Url:   e.Url,
+		State: e.State,
+		Stale: e.Stale,
+		Watch: w,
+	}
+	err := json.Unmarshal([]byte(e.Resource), &n.Resource)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(e.Captures), &n.Captures)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// pendingEventID returns the key name of the PendingEvent of the object for the Watch.
+func pendingEventID(watchID, url string) string {
+	sum := sha256.Sum256([]byte(watchID + "\n" + url))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *DebounceService) key(id string) *datastore.Key {
+	return datastore.NewKey(s.ctx, PENDING_EVENT_KIND, id, 0, nil)
+}
+
+// Add delays the notification by DebounceSeconds of its Watch.
+func (s *DebounceService) Add(n *Notification) error {
+	e, err := newPendingEvent(n)
+	if err != nil {
+		return err
+	}
+	return s.put(e, time.Now())
+}
+
+// put collapses e into the PendingEvent of the object, and adds the task
+// to publish it if it's new.
+func (s *DebounceService) put(e *PendingEvent, now time.Time) error {
+	id := pendingEventID(e.WatchID, e.Url)
+	key := s.key(id)
+	err := datastore.RunInTransaction(s.ctx, func(tc context.Context) error {
+		pending := *e
+		pending.LastAt = now
+		if pending.FirstAt.IsZero() {
+			pending.FirstAt = now
+		}
+		current := PendingEvent{}
+		err := datastore.Get(tc, key, &current)
+		switch {
+		case err == datastore.ErrNoSuchEntity:
+			pending.DueAt = debounceDueAt(pending.FirstAt, now, pending.Window)
+			_, err = datastore.Put(tc, key, &pending)
+			if err != nil {
+				return err
+			}
+			return s.enqueue(tc, id, pending.DueAt)
+		case err != nil:
+			return err
+		}
+		// The task of the current one publishes it
+		pending.merge(&current)
+		pending.DueAt = debounceDueAt(pending.FirstAt, now, pending.Window)
+		_, err = datastore.Put(tc, key, &pending)
+		return err
+	}, nil)
+	if err != nil {
+		log.Errorf(s.ctx, "DebounceService.put(%v) [%T]%v\n", e, err, err)
+		return err
+	}
+	return nil
+}
+
+// enqueue adds the task to publish the PendingEvent at eta.
+func (s *DebounceService) enqueue(ctx context.Context, id string, eta time.Time) error {
+	params := url.Values{"id": {id}}
+	if t := tenantOf(s.ctx); t != nil {
+		params.Set("tenant", t.Name)
+	}
+	task := taskqueue.NewPOSTTask(DEBOUNCE_PATH, params)
+	task.ETA = eta
+	_, err := taskqueue.Add(ctx, task, "")
+	return err
+}
+
+// take deletes and returns the PendingEvent if it's due. If it's not due
+// because of the later events, the task is added again for its DueAt.
+// It returns nil if the PendingEvent isn't due or doesn't exist.
+func (s *DebounceService) take(id string, now time.Time) (*PendingEvent, error) {
+	key := s.key(id)
+	var res *PendingEvent
+	err := datastore.RunInTransaction(s.ctx, func(tc context.Context) error {
+		res = nil
+		pending := PendingEvent{}
+		err := datastore.Get(tc, key, &pending)
+		switch {
+		case err == datastore.ErrNoSuchEntity:
+			return nil
+		case err != nil:
+			return err
+		}
+		if now.Before(pending.DueAt) {
+			return s.enqueue(tc, id, pending.DueAt)
+		}
+		res = &pending
+		return datastore.Delete(tc, key)
+	}, nil)
+	if err != nil {
+		log.Errorf(s.ctx, "DebounceService.take(%v) [%T]%v\n", id, err, err)
+		return nil, err
+	}
+	return res, nil
+}
+
+// publish notifies the PendingEvent with the current Watch.
+// The event is dropped if the Watch is deleted. The ObjectState is
+// advanced after it's published if the Watch checks stale events.
+func (s *DebounceService) publish(e *PendingEvent, notifier Notifier) error {
+	logger := loggerOf(s.ctx)
+	service := &WatchService{s.ctx}
+	w, err := service.Find(e.WatchID)
+	if err != nil {
+		if _, ok := err.(*EntityNotFound); ok {
+			logger.Warning(s.ctx, "Watch of the pending event is not found")
+			return nil
+		}
+		return err
+	}
+	n, err := e.notification(w)
+	if err != nil {
+		return err
+	}
+	err = notify(s.ctx, notifier, n.State, n)
+	service.recordMatch(w, n.Url, err)
+	if err != nil {
+		return err
+	}
+	if w.checksStale() {
+		advanceObjectState(s.ctx, w, e.version())
+	}
+	return nil
+}
+
+// publishPending is requested by the task added by DebounceService.
+// The event is put back to publish it again if it fails to publish,
+// and dropped if it fails DEBOUNCE_MAX_ATTEMPTS times.
+func (h *handler) publishPending(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	id := c.FormValue("id")
+	logger := newLogger().With("pending_event_id", id)
+	if name := c.FormValue("tenant"); name != "" {
+		logger = logger.With("tenant", name)
+	}
+	ctx = withLogger(ctx, logger)
+	tctx, err := withTenantNamed(ctx, c.FormValue("tenant"))
+	if err != nil {
+		logger.Error(ctx, "Failed to find tenant", "error", err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	ctx = tctx
+
+	service := &DebounceService{ctx}
+	e, err := service.take(id, time.Now())
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	if e == nil {
+		return c.String(http.StatusOK, "Not due")
+	}
+	logger = logger.With("watch_id", e.WatchID, "url", e.Url)
+	ctx = withLogger(ctx, logger)
+	service = &DebounceService{ctx}
+
+	notifier, err := NewPubsubNotifier(ctx)
+	if err == nil {
+		err = service.publish(e, notifier)
+	}
+	bucket := bucketLabel(ctx, bucketOf(e.Url))
+	if err != nil {
+		if !e.retry() {
+			logger.Error(ctx, "Dropped the pending event which failed to publish", "error", err, "attempts", e.Attempts)
+			eventsTotal.inc(bucket, e.State, "dropped")
+			return c.String(http.StatusOK, "Dropped")
+		}
+		logger.Error(ctx, "Failed to publish the pending event", "error", err, "attempts", e.Attempts)
+		eventsTotal.inc(bucket, e.State, "error")
+		// Publish it again after the window
+		e.FirstAt = time.Time{}
+		perr := service.put(e, time.Now())
+		if perr != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("%v and %v", err, perr))
+		}
+		return c.String(http.StatusOK, "Retry later")
+	}
+	eventsTotal.inc(bucket, e.State, "notified")
+	logger.Info(ctx, "Published the pending event", "collapsed", e.Count, "delay_ms", latencyMillis(e.FirstAt))
+	return c.String(http.StatusOK, "OK")
+}
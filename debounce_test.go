@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/aetest"
+)
+
+func TestDebounceDueAt(t *testing.T) {
+	first := time.Date(2017, 2, 20, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, first.Add(10*time.Second), debounceDueAt(first, first, 10))
+	assert.Equal(t, first.Add(35*time.Second), debounceDueAt(first, first.Add(25*time.Second), 10))
+	// At most DEBOUNCE_MAX_WINDOWS windows
+	assert.Equal(t, first.Add(50*time.Second), debounceDueAt(first, first.Add(45*time.Second), 10))
+}
+
+func TestPendingEventMerge(t *testing.T) {
+	first := time.Date(2017, 2, 20, 10, 0, 0, 0, time.UTC)
+	current := &PendingEvent{State: "exists", Resource: `{"generation":"3"}`, Generation: 3, Metageneration: 1, Count: 2, FirstAt: first}
+
+	// An older event comes late
+	e := &PendingEvent{State: "exists", Resource: `{"generation":"2"}`, Generation: 2, Metageneration: 1, Count: 1, FirstAt: first.Add(time.Second)}
+	e.merge(current)
+	assert.Equal(t, int64(3), e.Generation)
+	assert.Equal(t, `{"generation":"3"}`, e.Resource)
+	assert.Equal(t, 3, e.Count)
+	assert.Equal(t, first, e.FirstAt)
+
+	// A newer event
+	e = &PendingEvent{State: "exists", Resource: `{"generation":"3","metageneration":"2"}`, Generation: 3, Metageneration: 2, Count: 1, FirstAt: first.Add(time.Second)}
+	e.merge(current)
+	assert.Equal(t, int64(2), e.Metageneration)
+	assert.Equal(t, `{"generation":"3","metageneration":"2"}`, e.Resource)
+}
+
+func TestPendingEventRetry(t *testing.T) {
+	e := &PendingEvent{}
+	for i := 1; i < DEBOUNCE_MAX_ATTEMPTS; i++ {
+		assert.True(t, e.retry())
+		assert.Equal(t, i, e.Attempts)
+	}
+	assert.False(t, e.retry())
+
+	// The attempts are kept when a new event is collapsed into the failed one
+	e = &PendingEvent{Generation: 2, Attempts: 3}
+	newer := &PendingEvent{Generation: 3}
+	newer.merge(e)
+	assert.Equal(t, 3, newer.Attempts)
+}
+
+func TestDebounceService(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, WATCH_KIND)
+	ClearDatastore(t, ctx, PENDING_EVENT_KIND)
+	w := &Watch{Seq: 1, Pattern: `\.csv\z`, Topic: "projects/dummy-proj-999/topics/topic1", DebounceSeconds: 10}
+	assert.NoError(t, (&WatchService{ctx}).Create(w))
+
+	url := "gs://bucket1/path/to/file.csv"
+	notification := func(generation string) *Notification {
+		return &Notification{
+			Topic:    w.Topic,
+			Url:      url,
+			State:    "exists",
+			Resource: map[string]interface{}{"bucket": "bucket1", "name": "path/to/file.csv", "generation": generation, "metageneration": "1"},
+			Captures: map[string]string{},
+			Watch:    w,
+		}
+	}
+
+	service := &DebounceService{ctx}
+	assert.NoError(t, service.Add(notification("2")))
+	assert.NoError(t, service.Add(notification("3")))
+	assert.NoError(t, service.Add(notification("1")))
+
+	id := pendingEventID(w.ID, url)
+	// Not due yet
+	e, err := service.take(id, time.Now())
+	assert.NoError(t, err)
+	assert.Nil(t, e)
+
+	e, err = service.take(id, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	if assert.NotNil(t, e) {
+		assert.Equal(t, 3, e.Count)
+		assert.Equal(t, int64(3), e.Generation)
+
+		publisher := &dummyPublisher{[]*PubsubMessage{}}
+		assert.NoError(t, service.publish(e, &PubsubNotifier{publisher: publisher}))
+		if assert.Equal(t, 1, len(publisher.messages)) {
+			assert.Equal(t, url, publisher.messages[0].Attributes["download_files"])
+		}
+	}
+
+	// Taken already
+	e, err = service.take(id, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Nil(t, e)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+type (
+	// DryRunRequest is a sample notification to test the watches with.
+	// Either Url or Body (the OCN request body) must be given.
+	DryRunRequest struct {
+		Url   string `form:"url" json:"url"`
+		Body  string `form:"body" json:"body"`
+		State string `form:"state" json:"state"`
+	}
+
+	DryRunResult struct {
+		Url         string           `json:"url"`
+		State       string           `json:"state"`
+		Evaluations []*DryRunWatch   `json:"evaluations"`
+		Notifier    string           `json:"notifier,omitempty"`
+		Topic       string           `json:"topic,omitempty"`
+		Messages    []*DryRunMessage `json:"messages"`
+	}
+
+	DryRunWatch struct {
+		ID          string `json:"id"`
+		Seq         int    `json:"seq"`
+		Bucket      string `json:"bucket"`
+		PatternType string `json:"pattern_type"`
+		Pattern     string `json:"pattern"`
+		Topic       string `json:"topic"`
+		Active      bool   `json:"active"`
+		Matched     bool   `json:"matched"`
+		Selected    bool   `json:"selected"`
+	}
+
+	DryRunMessage struct {
+		Topic   string         `json:"topic"`
+		Message *PubsubMessage `json:"message"`
+	}
+
+	// recordingPublisher records messages instead of publishing them.
+	recordingPublisher struct {
+		messages []*DryRunMessage
+	}
+)
+
+func (rp *recordingPublisher) Publish(topic string, msg *PubsubMessage) (*pubsub.PublishResponse, error) {
+	rp.messages = append(rp.messages, &DryRunMessage{Topic: topic, Message: msg})
+	return &pubsub.PublishResponse{}, nil
+}
+
+// resource returns the object resource and its URL of the request.
+// If only Url is given, the resource has only bucket and name.
+func (req *DryRunRequest) resource() (map[string]interface{}, string, error) {
+	if req.Body == "" {
+		if req.Url == "" {
+			return nil, "", &ValidationError{"url or body is required"}
+		}
+		obj := map[string]interface{}{}
+		if strings.HasPrefix(req.Url, "gs://") {
+			parts := strings.SplitN(req.Url[len("gs://"):], "/", 2)
+			obj["bucket"] = parts[0]
+			if len(parts) > 1 {
+				obj["name"] = parts[1]
+			}
+		}
+		return obj, req.Url, nil
+	}
+	var obj map[string]interface{}
+	err := json.Unmarshal([]byte(req.Body), &obj)
+	if err != nil {
+		return nil, "", &ValidationError{fmt.Sprintf("Invalid body: %v", err)}
+	}
+	url, err := objectUrl(obj)
+	if err != nil {
+		return nil, "", &ValidationError{err.Error()}
+	}
+	return obj, url, nil
+}
+
+func (req *DryRunRequest) state() string {
+	if req.State == "" {
+		return "exists"
+	}
+	return req.State
+}
+
+// dryRun evaluates every Watch against the request and builds the messages
+// which would be published without publishing them.
+func (s *WatchService) dryRun(req *DryRunRequest) (*DryRunResult, error) {
+	watches, err := s.All()
+	if err != nil {
+		return nil, err
+	}
+	return s.dryRunWith(watches, req)
+}
+
+// preview builds the message of the Watch, which may not be saved yet, for the request.
+// The Watch is regarded as active regardless of its schedule.
+func (s *WatchService) preview(w *Watch, req *DryRunRequest) (*DryRunResult, error) {
+	err := w.Validate()
+	if err != nil {
+		return nil, err
+	}
+	active := *w
+	active.Disabled = false
+	active.ActiveFrom = time.Time{}
+	active.ActiveUntil = time.Time{}
+	return s.dryRunWith(Watches{&active}, req)
+}
+
+func (s *WatchService) dryRunWith(watches Watches, req *DryRunRequest) (*DryRunResult, error) {
+	obj, url, err := req.resource()
+	if err != nil {
+		return nil, err
+	}
+	state := req.state()
+
+	m, err := NewMatcher(watches)
+	if err != nil {
+		return nil, err
+	}
+	evaluations := m.evaluate(url, false)
+
+	res := &DryRunResult{
+		Url:         url,
+		State:       state,
+		Evaluations: []*DryRunWatch{},
+		Messages:    []*DryRunMessage{},
+	}
+	var selected *Evaluation
+	for _, ev := range evaluations {
+		res.Evaluations = append(res.Evaluations, &DryRunWatch{
+			ID:          ev.Watch.ID,
+			Seq:         ev.Watch.Seq,
+			Bucket:      ev.Watch.Bucket,
+			PatternType: ev.Watch.PatternTypeName(),
+			Pattern:     ev.Watch.Pattern,
+			Topic:       ev.Watch.Topic,
+			Active:      !ev.Inactive,
+			Matched:     ev.Matched,
+			Selected:    ev.Selected,
+		})
+		if ev.Selected {
+			selected = ev
+		}
+	}
+	if selected == nil {
+		return res, nil
+	}
+	res.Topic = selected.Watch.Topic
+
+	switch state {
+	case "exists":
+		res.Notifier = "Updated"
+	case "not_exists":
+		res.Notifier = "Deleted"
+	}
+	publisher := &recordingPublisher{}
+	err = notify(s.ctx, &PubsubNotifier{publisher: publisher}, state, selected.notification(url, state, obj))
+	if err != nil {
+		return nil, &ValidationError{err.Error()}
+	}
+	res.Messages = append(res.Messages, publisher.messages...)
+	return res, nil
+}
+
+// DecodedData returns the data of the message as a string.
+func (m *DryRunMessage) DecodedData() string {
+	b, err := base64.StdEncoding.DecodeString(m.Message.Data)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+// MessageJSON returns the message as it would be sent to Pub/Sub.
+func (m *DryRunMessage) MessageJSON() string {
+	b, err := json.MarshalIndent(m.Message, "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/appengine/aetest"
+)
+
+func TestWatchServiceDryRun(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	topic1 := "projects/dummy-proj-999/topics/topic1"
+	topic2 := "projects/dummy-proj-999/topics/topic2"
+
+	ClearDatastore(t, ctx, WATCH_KIND)
+	service := &WatchService{ctx}
+	watches := []*Watch{
+		&Watch{Seq: 1, Pattern: `\Ags://bucket1/dir1/`, Topic: topic1},
+		&Watch{Seq: 2, Pattern: `\.csv\z`, Topic: topic2},
+	}
+	for _, watch := range watches {
+		err = service.Create(watch)
+		assert.NoError(t, err)
+	}
+
+	retryWith(10, func() func() {
+		r, err := service.All()
+		if assert.NoError(t, err) && len(r) != len(watches) {
+			return func() {
+				t.Fatalf("len(watches) expects %v but was %v\n", len(watches), len(r))
+			}
+		}
+		return nil
+	})
+
+	// Both watches match but the first one is selected
+	url := "gs://bucket1/dir1/file.csv"
+	res, err := service.dryRun(&DryRunRequest{Url: url})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "exists", res.State)
+		if assert.Equal(t, 2, len(res.Evaluations)) {
+			assert.True(t, res.Evaluations[0].Matched)
+			assert.True(t, res.Evaluations[0].Selected)
+			assert.True(t, res.Evaluations[1].Matched)
+			assert.False(t, res.Evaluations[1].Selected)
+		}
+		assert.Equal(t, "Updated", res.Notifier)
+		assert.Equal(t, topic1, res.Topic)
+		if assert.Equal(t, 1, len(res.Messages)) {
+			assert.Equal(t, topic1, res.Messages[0].Topic)
+			assert.Equal(t, map[string]string{"download_files": url}, res.Messages[0].Message.Attributes)
+		}
+	}
+
+	// OCN request body with not_exists publishes nothing
+	body, err := json.Marshal(BuildData("bucket2", "dir2/file.csv"))
+	assert.NoError(t, err)
+	res, err = service.dryRun(&DryRunRequest{Body: string(body), State: "not_exists"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "gs://bucket2/dir2/file.csv", res.Url)
+		assert.False(t, res.Evaluations[0].Matched)
+		assert.True(t, res.Evaluations[1].Selected)
+		assert.Equal(t, "Deleted", res.Notifier)
+		assert.Equal(t, 0, len(res.Messages))
+	}
+
+	// No match
+	res, err = service.dryRun(&DryRunRequest{Url: "gs://bucket3/file.txt"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", res.Topic)
+		assert.Equal(t, 0, len(res.Messages))
+	}
+
+	// Invalid requests
+	_, err = service.dryRun(&DryRunRequest{})
+	assert.Error(t, err)
+	_, err = service.dryRun(&DryRunRequest{Body: `{"bucket": 1}`})
+	if assert.Error(t, err) {
+		assert.Regexp(t, "bucket must be a string", err.Error())
+	}
+	_, err = service.dryRun(&DryRunRequest{Url: url, State: "unknown"})
+	if assert.Error(t, err) {
+		assert.Regexp(t, "Unknown state", err.Error())
+	}
+
+	// Preview of a Watch which is not saved
+	w := &Watch{
+		Pattern:            `\Ags://bucket1/(?P<dir>[^/]+)/`,
+		Topic:              topic2,
+		AttributesTemplate: "dir={{.Captures.dir}}",
+		DataTemplate:       "{{.Resource.name}}",
+	}
+	res, err = service.preview(w, &DryRunRequest{Url: url})
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(res.Messages)) {
+		assert.Equal(t, map[string]string{"dir": "dir1"}, res.Messages[0].Message.Attributes)
+		assert.Equal(t, "dir1/file.csv", res.Messages[0].DecodedData())
+	}
+	w.DataTemplate = "{{.Unknown}}"
+	_, err = service.preview(w, &DryRunRequest{Url: url})
+	if assert.Error(t, err) {
+		assert.Regexp(t, "Invalid data template", err.Error())
+	}
+}
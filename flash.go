@@ -1,66 +1,228 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/labstack/echo"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
 )
 
+// Flash messages are stored in a cookie as base64 encoded JSON with its HMAC-SHA256 signature.
+// The cookie value is in the form of `<payload>.<signature>`.
+// A cookie with an invalid signature is ignored.
+// The key is FLASH_SECRET environment variable or a random key stored in
+// Datastore so that all the instances share it.
+
 type (
 	FlashHandler struct {
 		path   string
 		expire time.Duration
+		secret []byte // loaded by the first request if it's nil
+		mu     sync.Mutex
+	}
+
+	// Secret is a random key shared by the instances.
+	Secret struct {
+		Value []byte `datastore:",noindex"`
+	}
+
+	FlashMessage struct {
+		Level string `json:"level"` // "alert", "warning" or "notice"
+		Text  string `json:"text"`
 	}
 
 	Flash struct {
-		Alert  string
-		Notice string
+		Messages []*FlashMessage
 	}
 )
 
-func (fh *FlashHandler) set(c echo.Context, name, value string) {
-	fh.setWithExpire(c, name, value, time.Now().Add(fh.expire))
+const (
+	FLASH_COOKIE = "flash"
+
+	// Browsers ignore cookies larger than 4096 bytes
+	FLASH_MAX_COOKIE_SIZE = 4000
+	FLASH_MAX_TEXT_SIZE   = 1000
+
+	SECRET_KIND       = "Secrets"
+	FLASH_SECRET_NAME = "flash"
+	SECRET_SIZE       = 32
+)
+
+// flashSecret returns FLASH_SECRET environment variable or nil to use the key in Datastore.
+func flashSecret() []byte {
+	if s := os.Getenv("FLASH_SECRET"); s != "" {
+		return []byte(s)
+	}
+	return nil
+}
+
+// loadSecret returns the secret of the name in the default namespace.
+// It's created with random bytes if it doesn't exist yet.
+func loadSecret(ctx context.Context, name string) ([]byte, error) {
+	ctx, err := appengine.Namespace(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	key := datastore.NewKey(ctx, SECRET_KIND, name, 0, nil)
+	secret := Secret{}
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		err := datastore.Get(tc, key, &secret)
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		secret.Value = make([]byte, SECRET_SIZE)
+		_, err = rand.Read(secret.Value)
+		if err != nil {
+			return err
+		}
+		_, err = datastore.Put(tc, key, &secret)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return secret.Value, nil
+}
+
+// key returns the secret to sign the flash messages. It loads the secret from
+// Datastore if it's not given.
+func (fh *FlashHandler) key(c echo.Context) ([]byte, error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	if fh.secret == nil {
+		ctx := appengine.NewContext(c.Request())
+		secret, err := loadSecret(ctx, FLASH_SECRET_NAME)
+		if err != nil {
+			log.Errorf(ctx, "Failed to load the flash secret: %v\n", err)
+			return nil, err
+		}
+		fh.secret = secret
+	}
+	return fh.secret, nil
+}
+
+func (f *Flash) Add(level, text string) {
+	f.Messages = append(f.Messages, &FlashMessage{Level: level, Text: text})
+}
+
+// set adds the message to the flash of the next request.
+// The messages set in the same request are kept together.
+func (fh *FlashHandler) set(c echo.Context, level, text string) {
+	next, ok := c.Get("next_flash").(*Flash)
+	if !ok {
+		next = &Flash{}
+		c.Set("next_flash", next)
+	}
+	next.Add(level, truncateText(text, FLASH_MAX_TEXT_SIZE))
+	value, err := fh.encode(next)
+	for err == nil && len(value) > FLASH_MAX_COOKIE_SIZE && len(next.Messages) > 1 {
+		next.Messages = next.Messages[1:]
+		value, err = fh.encode(next)
+	}
+	if err != nil {
+		return
+	}
+	fh.setWithExpire(c, value, time.Now().Add(fh.expire))
 }
 
-func (fh *FlashHandler) setWithExpire(c echo.Context, name, value string, expire time.Time) {
+func (fh *FlashHandler) setWithExpire(c echo.Context, value string, expire time.Time) {
 	cookie := new(http.Cookie)
-	cookie.Path = "/admin/"
-	cookie.Name = name
+	cookie.Path = fh.path
+	cookie.Name = FLASH_COOKIE
 	cookie.Value = value
 	cookie.Expires = expire
+	cookie.HttpOnly = true
 	c.SetCookie(cookie)
 }
 
 func (fh *FlashHandler) load(c echo.Context) *Flash {
-	f := Flash{}
-	cookie, err := c.Cookie("alert")
-	if err == nil {
-		f.Alert = cookie.Value
+	cookie, err := c.Cookie(FLASH_COOKIE)
+	if err != nil {
+		return &Flash{}
 	}
-	cookie, err = c.Cookie("notice")
-	if err == nil {
-		f.Notice = cookie.Value
+	f, err := fh.decode(cookie.Value)
+	if err != nil {
+		return &Flash{}
 	}
-	return &f
+	return f
 }
 
 func (fh *FlashHandler) clear(c echo.Context) {
-	_, err := c.Cookie("alert")
+	_, err := c.Cookie(FLASH_COOKIE)
 	if err == nil {
-		fh.setWithExpire(c, "alert", "", time.Now().AddDate(0, 0, 1))
-	}
-	_, err = c.Cookie("notice")
-	if err == nil {
-		fh.setWithExpire(c, "notice", "", time.Now().AddDate(0, 0, 1))
+		fh.setWithExpire(c, "", time.Unix(0, 0))
 	}
 }
 
 func (fh *FlashHandler) with(impl func(c echo.Context) error) func(c echo.Context) error {
 	return func(c echo.Context) error {
+		// Fails without the key not to sign the messages with a key of the instance
+		_, err := fh.key(c)
+		if err != nil {
+			return err
+		}
 		f := fh.load(c)
 		c.Set("flash", f)
 		fh.clear(c)
 		return impl(c)
 	}
 }
+
+func (fh *FlashHandler) sign(payload string) string {
+	fh.mu.Lock()
+	secret := fh.secret
+	fh.mu.Unlock()
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (fh *FlashHandler) encode(f *Flash) (string, error) {
+	b, err := json.Marshal(f.Messages)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + fh.sign(payload), nil
+}
+
+func (fh *FlashHandler) decode(value string) (*Flash, error) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(fh.sign(parts[0]))) {
+		return nil, &ValidationError{"Invalid flash signature"}
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	f := Flash{}
+	err = json.Unmarshal(b, &f.Messages)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// truncateText truncates s to max bytes without breaking UTF-8 characters.
+func truncateText(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	i := max
+	for i > 0 && (s[i]&0xC0) == 0x80 {
+		i--
+	}
+	return s[:i] + "..."
+}
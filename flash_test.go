@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+)
+
+func TestFlashHandlerRoundTrip(t *testing.T) {
+	fh := &FlashHandler{path: "/admin/", expire: 10 * time.Minute, secret: []byte("secret1")}
+	e := echo.New()
+
+	// roundTrip sets the messages in a request and loads them in the next request
+	roundTrip := func(fh2 *FlashHandler, modify func(string) string, set func(c echo.Context)) *Flash {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(echo.POST, "/admin/watches", nil), rec)
+		set(c)
+		cookies := (&http.Response{Header: rec.Header()}).Cookies()
+		if !assert.NotEmpty(t, cookies) {
+			return nil
+		}
+		cookie := cookies[len(cookies)-1]
+		assert.Equal(t, FLASH_COOKIE, cookie.Name)
+		assert.True(t, cookie.HttpOnly)
+		if modify != nil {
+			cookie.Value = modify(cookie.Value)
+		}
+
+		req := httptest.NewRequest(echo.GET, "/admin/watches", nil)
+		req.AddCookie(cookie)
+		var loaded *Flash
+		fh2.with(func(c echo.Context) error {
+			loaded = c.Get("flash").(*Flash)
+			return nil
+		})(e.NewContext(req, httptest.NewRecorder()))
+		return loaded
+	}
+
+	// Multiple messages with levels including non-ASCII text
+	f := roundTrip(fh, nil, func(c echo.Context) {
+		fh.set(c, "alert", "Invalid pattern: \"[\"; missing closing ]")
+		fh.set(c, "notice", "ウォッチを更新しました")
+		fh.set(c, "warning", "line1\nline2")
+	})
+	assert.Equal(t, []*FlashMessage{
+		{Level: "alert", Text: "Invalid pattern: \"[\"; missing closing ]"},
+		{Level: "notice", Text: "ウォッチを更新しました"},
+		{Level: "warning", Text: "line1\nline2"},
+	}, f.Messages)
+
+	// Long messages are truncated to fit in the cookie
+	f = roundTrip(fh, nil, func(c echo.Context) {
+		for i := 0; i < 10; i++ {
+			fh.set(c, "alert", strings.Repeat("あ", 1000))
+		}
+	})
+	if assert.NotEmpty(t, f.Messages) {
+		last := f.Messages[len(f.Messages)-1].Text
+		assert.True(t, strings.HasSuffix(last, "..."))
+		assert.True(t, len(last) <= FLASH_MAX_TEXT_SIZE+len("..."))
+	}
+
+	// Tampered cookie is ignored
+	f = roundTrip(fh, func(v string) string {
+		parts := strings.SplitN(v, ".", 2)
+		payload, _ := fh.encode(&Flash{Messages: []*FlashMessage{{Level: "notice", Text: "spoofed"}}})
+		return strings.SplitN(payload, ".", 2)[0] + "." + parts[1]
+	}, func(c echo.Context) {
+		fh.set(c, "alert", "original")
+	})
+	assert.Empty(t, f.Messages)
+
+	// Cookie signed with another secret is ignored
+	other := &FlashHandler{path: "/admin/", expire: 10 * time.Minute, secret: []byte("secret2")}
+	f = roundTrip(other, nil, func(c echo.Context) {
+		fh.set(c, "alert", "original")
+	})
+	assert.Empty(t, f.Messages)
+
+	// Plain value is ignored
+	f = roundTrip(fh, func(v string) string { return "plain" }, func(c echo.Context) {
+		fh.set(c, "alert", "original")
+	})
+	assert.Empty(t, f.Messages)
+}
+
+func TestTruncateText(t *testing.T) {
+	assert.Equal(t, "abc", truncateText("abc", 3))
+	assert.Equal(t, "ab...", truncateText("abc", 2))
+	// "あ" is 3 bytes in UTF-8
+	assert.Equal(t, "あ...", truncateText("あい", 4))
+}
+
+func TestLoadSecret(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	secret1, err := loadSecret(ctx, FLASH_SECRET_NAME)
+	assert.NoError(t, err)
+	assert.Equal(t, SECRET_SIZE, len(secret1))
+
+	// The same key is shared in any namespace
+	nsCtx, err := appengine.Namespace(ctx, "team1")
+	assert.NoError(t, err)
+	secret2, err := loadSecret(nsCtx, FLASH_SECRET_NAME)
+	assert.NoError(t, err)
+	assert.Equal(t, secret1, secret2)
+
+	other, err := loadSecret(ctx, "other")
+	assert.NoError(t, err)
+	assert.NotEqual(t, secret1, other)
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/labstack/echo"
 	// "github.com/labstack/echo/middleware"
 
-	// "golang.org/x/net/context"
+	"golang.org/x/net/context"
 
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/log"
@@ -21,6 +23,15 @@ func init() {
 	h := &handler{&DefaultProcessor{}}
 	e.GET("/", h.get)
 	e.POST("/", h.post)
+	e.POST("/tenants/:tenant", h.post)
+	e.GET("/metrics", h.metrics)
+	e.GET("/healthz", h.healthz)
+	e.GET("/readyz", h.readyz)
+	e.GET("/cron/bucket_alerts", h.checkBucketAlerts)
+	e.GET("/cron/object_states", h.cleanupObjectStates)
+	e.GET("/cron/watch_stats", h.flushWatchStats)
+	e.POST(RESYNC_PATH, h.resync)
+	e.POST(DEBOUNCE_PATH, h.publishPending)
 }
 
 type handler struct {
@@ -42,22 +53,105 @@ func (h *handler) get(c echo.Context) error {
 }
 
 func (h *handler) post(c echo.Context) error {
+	start := time.Now()
 	req := c.Request()
-	ctx := appengine.NewContext(req)
-	log.Infof(ctx, "Processing OCN POST request\nHeader: %v\n", req.Header)
+	logger := requestLogger(req)
+	ctx := withTracer(appengine.NewContext(req), defaultTracer)
+	ctx = withRemoteParent(ctx, req.Header.Get(TRACEPARENT), req.Header.Get("X-Cloud-Trace-Context"))
+	ctx, span := startSpan(ctx, "ocn.request")
+	defer span.Finish()
+	if span != nil {
+		logger = logger.With("trace_id", span.TraceID)
+	}
+	ctx = withLogger(ctx, logger)
 	resource_state := req.Header.Get("X-Goog-Resource-State")
+	span.SetAttribute("resource_state", resource_state)
+	if name := c.Param("tenant"); name != "" {
+		logger = logger.With("tenant", name)
+		ctx = withLogger(ctx, logger)
+		t, err := (&TenantService{ctx}).Find(name)
+		if err != nil {
+			logger.Error(ctx, "Failed to find tenant", "error", err)
+			if _, ok := err.(*EntityNotFound); ok {
+				finishRequest(ctx, start, resource_state, "tenant_not_found")
+				return c.String(http.StatusNotFound, "Tenant not found")
+			}
+			finishRequest(ctx, start, resource_state, "error")
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		ctx, err = withTenant(ctx, t)
+		if err != nil {
+			finishRequest(ctx, start, resource_state, "error")
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+	}
+	logger.Debug(ctx, "Processing OCN POST request", "resource_uri", req.Header.Get("X-Goog-Resource-Uri"))
 	if resource_state == "" {
-		log.Infof(ctx, "Unknown message received.\n")
+		logger.Info(ctx, "Unknown message received")
+		finishRequest(ctx, start, resource_state, "unknown")
 	} else if resource_state == "sync" {
-		log.Infof(ctx, "Sync message received.\n")
+		logger.Info(ctx, "Sync message received", "resource_id", req.Header.Get("X-Goog-Resource-Id"), "expiration", req.Header.Get("X-Goog-Channel-Expiration"))
+		if !validChannelToken(req.Header) {
+			logger.Warning(ctx, "Channel is not recorded without the valid channel token")
+			finishRequest(ctx, start, resource_state, "unverified")
+			return c.String(http.StatusOK, "OK")
+		}
+		ch, err := channelFromHeader(req.Header)
+		if err == nil {
+			err = (&ChannelService{ctx}).Sync(ch)
+		}
+		if err != nil {
+			logger.Error(ctx, "Failed to record the channel", "error", err)
+			finishRequest(ctx, start, resource_state, "error")
+			if _, ok := err.(*ValidationError); ok {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		finishRequest(ctx, start, resource_state, "sync")
 	} else {
+		if validChannelToken(req.Header) {
+			checkMessageNumber(ctx, req.Header)
+		}
 		st := req.Header.Get("X-Goog-Resource-State")
 		err := h.processor.Run(ctx, st, req.Body)
+		span.SetError(err)
 		if err != nil {
 			msg := fmt.Sprintf("%v", err)
-			log.Errorf(ctx, "Returning 500 error: %v", msg)
+			logger.Error(ctx, "Returning 500 error", "error", msg)
+			finishRequest(ctx, start, resource_state, "error")
 			return c.String(http.StatusInternalServerError, msg)
 		}
+		finishRequest(ctx, start, resource_state, "ok")
 	}
 	return c.String(http.StatusOK, "OK")
 }
+
+// finishRequest logs and records the metrics of the request.
+func finishRequest(ctx context.Context, start time.Time, state, outcome string) {
+	requestsTotal.inc(state, outcome)
+	requestDuration.since(start, state, outcome)
+	spanOf(ctx).SetAttribute("outcome", outcome)
+	loggerOf(ctx).Info(ctx, "OCN request processed", "outcome", outcome, "latency_ms", latencyMillis(start))
+}
+
+// latencyMillis returns the milliseconds elapsed from start.
+func latencyMillis(start time.Time) float64 {
+	return float64(time.Since(start)) / float64(time.Millisecond)
+}
+
+// metrics responds the metrics of the instance in the Prometheus text format.
+// It requires `Authorization: Bearer <METRICS_TOKEN>`. The labels have the names
+// of buckets, topics and watches, so it's not found without METRICS_TOKEN.
+func (h *handler) metrics(c echo.Context) error {
+	token := os.Getenv("METRICS_TOKEN")
+	if token == "" {
+		return c.String(http.StatusNotFound, "Not found")
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Request().Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+		return c.String(http.StatusUnauthorized, "Unauthorized")
+	}
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4")
+	c.Response().WriteHeader(http.StatusOK)
+	return metrics.write(c.Response())
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// The liveness and readiness endpoints for uptime checks.
+// /healthz responds OK if the instance can serve requests, and /readyz
+// responds the result of each check of the dependencies.
+
+type (
+	HealthCheck struct {
+		Name  string
+		Check func(ctx context.Context) error
+	}
+
+	HealthCheckRes struct {
+		Name      string  `json:"name"`
+		Status    string  `json:"status"`
+		Error     string  `json:"error,omitempty"`
+		LatencyMs float64 `json:"latency_ms"`
+	}
+
+	HealthRes struct {
+		Status string            `json:"status"`
+		Checks []*HealthCheckRes `json:"checks,omitempty"`
+	}
+)
+
+const (
+	HEALTH_OK          = "ok"
+	HEALTH_UNAVAILABLE = "unavailable"
+
+	HEALTH_CHECK_TIMEOUT = 10 * time.Second
+)
+
+// READINESS_CHECKS are the checks of /readyz.
+var READINESS_CHECKS = []*HealthCheck{
+	{"datastore", checkDatastore},
+	{"pubsub", checkPubsub},
+	{"rules", checkRules},
+}
+
+// checkDatastore queries WATCH_KIND.
+func checkDatastore(ctx context.Context) error {
+	_, err := datastore.NewQuery(WATCH_KIND).KeysOnly().Limit(1).GetAll(ctx, nil)
+	return err
+}
+
+// checkPubsub creates the Pub/Sub client.
+func checkPubsub(ctx context.Context) error {
+	_, err := newPubsubService(ctx)
+	return err
+}
+
+// checkRules compiles the watches of the default namespace.
+func checkRules(ctx context.Context) error {
+	watches, err := (&WatchService{ctx}).All()
+	if err != nil {
+		return err
+	}
+	_, err = NewMatcher(watches)
+	return err
+}
+
+// runHealthChecks runs the checks in order. The status is HEALTH_UNAVAILABLE if any check fails.
+func runHealthChecks(ctx context.Context, checks []*HealthCheck) *HealthRes {
+	res := &HealthRes{Status: HEALTH_OK, Checks: []*HealthCheckRes{}}
+	for _, check := range checks {
+		start := time.Now()
+		cctx, cancel := context.WithTimeout(ctx, HEALTH_CHECK_TIMEOUT)
+		err := check.Check(cctx)
+		cancel()
+		r := &HealthCheckRes{Name: check.Name, Status: HEALTH_OK, LatencyMs: latencyMillis(start)}
+		if err != nil {
+			r.Status = HEALTH_UNAVAILABLE
+			r.Error = err.Error()
+			res.Status = HEALTH_UNAVAILABLE
+		}
+		res.Checks = append(res.Checks, r)
+	}
+	return res
+}
+
+func (h *handler) healthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, &HealthRes{Status: HEALTH_OK})
+}
+
+func (h *handler) readyz(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	res := runHealthChecks(ctx, READINESS_CHECKS)
+	if res.Status != HEALTH_OK {
+		for _, r := range res.Checks {
+			if r.Error != "" {
+				loggerOf(ctx).Warning(ctx, "Readiness check failed", "check", r.Name, "error", r.Error)
+			}
+		}
+		return c.JSON(http.StatusServiceUnavailable, res)
+	}
+	return c.JSON(http.StatusOK, res)
+}
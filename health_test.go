@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestRunHealthChecks(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	ng := func(ctx context.Context) error { return errors.New("unreachable") }
+
+	res := runHealthChecks(context.Background(), []*HealthCheck{{"a", ok}, {"b", ok}})
+	assert.Equal(t, HEALTH_OK, res.Status)
+	assert.Equal(t, 2, len(res.Checks))
+
+	res = runHealthChecks(context.Background(), []*HealthCheck{{"a", ok}, {"b", ng}})
+	assert.Equal(t, HEALTH_UNAVAILABLE, res.Status)
+	if assert.Equal(t, 2, len(res.Checks)) {
+		assert.Equal(t, HEALTH_OK, res.Checks[0].Status)
+		assert.Equal(t, "", res.Checks[0].Error)
+		assert.Equal(t, HEALTH_UNAVAILABLE, res.Checks[1].Status)
+		assert.Equal(t, "unreachable", res.Checks[1].Error)
+	}
+}
+
+func TestHandlerHealthz(t *testing.T) {
+	h := &handler{}
+	req := httptest.NewRequest(echo.GET, "/healthz", nil)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, h.healthz(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, rec.Body.String())
+}
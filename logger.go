@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/log"
+)
+
+// Logger writes a log entry as a JSON object with the message and the fields.
+// A Logger is immutable. With returns a new Logger with more fields.
+//
+//	logger := loggerOf(ctx).With("bucket", bucket, "object", name)
+//	logger.Info(ctx, "Object changed", "generation", generation)
+type Logger struct {
+	fields map[string]interface{}
+}
+
+type loggerKey struct{}
+
+const CORRELATION_ID_FIELD = "correlation_id"
+
+func newLogger() *Logger {
+	return &Logger{fields: map[string]interface{}{}}
+}
+
+// With returns a Logger with the fields given as key and value pairs.
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	fields := map[string]interface{}{}
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	addFields(fields, keyValues)
+	return &Logger{fields: fields}
+}
+
+func addFields(fields map[string]interface{}, keyValues []interface{}) {
+	for i := 0; i < len(keyValues); i += 2 {
+		key := fmt.Sprintf("%v", keyValues[i])
+		if i+1 >= len(keyValues) {
+			fields[key] = nil
+			break
+		}
+		v := keyValues[i+1]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		fields[key] = v
+	}
+}
+
+// line returns the JSON of the entry.
+func (l *Logger) line(msg string, keyValues []interface{}) string {
+	fields := map[string]interface{}{}
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	addFields(fields, keyValues)
+	fields["message"] = msg
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Sprintf(`{"message": %q, "log_error": %q}`, msg, err.Error())
+	}
+	return string(b)
+}
+
+func (l *Logger) Debug(ctx context.Context, msg string, keyValues ...interface{}) {
+	log.Debugf(ctx, "%s", l.line(msg, keyValues))
+}
+
+func (l *Logger) Info(ctx context.Context, msg string, keyValues ...interface{}) {
+	log.Infof(ctx, "%s", l.line(msg, keyValues))
+}
+
+func (l *Logger) Warning(ctx context.Context, msg string, keyValues ...interface{}) {
+	log.Warningf(ctx, "%s", l.line(msg, keyValues))
+}
+
+func (l *Logger) Error(ctx context.Context, msg string, keyValues ...interface{}) {
+	log.Errorf(ctx, "%s", l.line(msg, keyValues))
+}
+
+// withLogger returns the context which carries the Logger.
+func withLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// loggerOf returns the Logger of the context or a Logger without fields.
+func loggerOf(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return newLogger()
+}
+
+// requestLogger returns the Logger with the correlation ID and the OCN headers of the request.
+// The correlation ID is the trace ID of X-Cloud-Trace-Context or a random ID.
+func requestLogger(req *http.Request) *Logger {
+	id := strings.SplitN(req.Header.Get("X-Cloud-Trace-Context"), "/", 2)[0]
+	if id == "" {
+		id = newCorrelationID()
+	}
+	return newLogger().With(
+		CORRELATION_ID_FIELD, id,
+		"channel_id", req.Header.Get("X-Goog-Channel-Id"),
+		"message_number", req.Header.Get("X-Goog-Message-Number"),
+		"resource_state", req.Header.Get("X-Goog-Resource-State"),
+	)
+}
+
+func newCorrelationID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestLoggerLine(t *testing.T) {
+	parse := func(line string) map[string]interface{} {
+		res := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &res))
+		return res
+	}
+
+	l := newLogger().With("bucket", "bucket1", "object", "dir/file.csv")
+	assert.Equal(t, map[string]interface{}{
+		"message":    "Published",
+		"bucket":     "bucket1",
+		"object":     "dir/file.csv",
+		"latency_ms": 1.5,
+		"error":      "failed",
+	}, parse(l.line("Published", []interface{}{"latency_ms", 1.5, "error", errors.New("failed")})))
+
+	// With doesn't change the original Logger
+	l2 := l.With("watch_id", "watch1", "bucket", "bucket2")
+	assert.Equal(t, "bucket1", parse(l.line("m", nil))["bucket"])
+	assert.Nil(t, parse(l.line("m", nil))["watch_id"])
+	assert.Equal(t, "bucket2", parse(l2.line("m", nil))["bucket"])
+	assert.Equal(t, "watch1", parse(l2.line("m", nil))["watch_id"])
+
+	// Odd number of key values
+	fields := parse(newLogger().line("m", []interface{}{"key"}))
+	v, ok := fields["key"]
+	assert.True(t, ok)
+	assert.Nil(t, v)
+}
+
+func TestLoggerContext(t *testing.T) {
+	ctx := context.Background()
+	assert.NotNil(t, loggerOf(ctx))
+
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("X-Goog-Channel-Id", "channel1")
+	req.Header.Set("X-Goog-Message-Number", "3")
+	req.Header.Set("X-Goog-Resource-State", "exists")
+	req.Header.Set("X-Cloud-Trace-Context", "105445aa7843bc8bf206b120001000/0;o=1")
+	l := requestLogger(req)
+	ctx = withLogger(ctx, l)
+	assert.Equal(t, l, loggerOf(ctx))
+	assert.Equal(t, map[string]interface{}{
+		CORRELATION_ID_FIELD: "105445aa7843bc8bf206b120001000",
+		"channel_id":         "channel1",
+		"message_number":     "3",
+		"resource_state":     "exists",
+	}, l.fields)
+
+	// Random correlation ID without X-Cloud-Trace-Context
+	id1 := requestLogger(httptest.NewRequest("POST", "/", nil)).fields[CORRELATION_ID_FIELD]
+	id2 := requestLogger(httptest.NewRequest("POST", "/", nil)).fields[CORRELATION_ID_FIELD]
+	assert.Len(t, id1, 32)
+	assert.NotEqual(t, id1, id2)
+}
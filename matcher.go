@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type (
+	// Evaluation is the result of matching a Watch against an URL.
+	Evaluation struct {
+		Watch    *Watch
+		Inactive bool // disabled or out of its schedule, so it's not evaluated
+		Matched  bool
+		Selected bool              // the first matched Watch, which topicFor returns
+		Captures map[string]string // named capture groups if Matched
+	}
+
+	// Matcher holds the compiled patterns of watches sorted by Seq.
+	// The watches are indexed by their bucket so that only the watches
+	// for the bucket of the URL and the ones without bucket are evaluated.
+	Matcher struct {
+		now      time.Time // to check the schedule of watches
+		global   []*compiledWatch
+		buckets  map[string][]*compiledWatch
+		prefixes *prefixTrie
+	}
+
+	compiledWatch struct {
+		index int // in Seq order
+		watch *Watch
+		match matchFunc // nil for prefix watches, which are looked up in the trie
+	}
+
+	// matchFunc returns whether the url matches and the named capture groups.
+	matchFunc func(url string) (bool, map[string]string)
+)
+
+func NewMatcher(watches Watches) (*Matcher, error) {
+	m := &Matcher{
+		now:      time.Now(),
+		buckets:  map[string][]*compiledWatch{},
+		prefixes: newPrefixTrie(),
+	}
+	for i, w := range watches {
+		cw := &compiledWatch{index: i, watch: w}
+		if w.PatternType == PATTERN_PREFIX {
+			m.prefixes.add(w.Pattern, i)
+		} else {
+			match, err := w.compile()
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pattern: %v of %v cause of %v", w.Pattern, w.ID, err)
+			}
+			cw.match = match
+		}
+		if w.Bucket == "" {
+			m.global = append(m.global, cw)
+		} else {
+			m.buckets[w.Bucket] = append(m.buckets[w.Bucket], cw)
+		}
+	}
+	return m, nil
+}
+
+// at returns a copy of the Matcher which checks the schedule of watches at now.
+// The compiled patterns are shared, so a cached Matcher is never modified.
+func (m *Matcher) at(now time.Time) *Matcher {
+	res := *m
+	res.now = now
+	return &res
+}
+
+// hasBucket returns true if a Watch has the bucket.
+func (m *Matcher) hasBucket(bucket string) bool {
+	return len(m.buckets[bucket]) > 0
+}
+
+// candidates returns the watches for the bucket and the ones without bucket in Seq order.
+func (m *Matcher) candidates(bucket string) []*compiledWatch {
+	scoped := m.buckets[bucket]
+	res := make([]*compiledWatch, 0, len(m.global)+len(scoped))
+	i, j := 0, 0
+	for i < len(m.global) || j < len(scoped) {
+		if j >= len(scoped) || (i < len(m.global) && m.global[i].index < scoped[j].index) {
+			res = append(res, m.global[i])
+			i++
+		} else {
+			res = append(res, scoped[j])
+			j++
+		}
+	}
+	return res
+}
+
+// evaluate matches the url against the active watches for its bucket in Seq order.
+// If firstOnly is true, it stops at the first matched Watch and omits inactive watches.
+func (m *Matcher) evaluate(url string, firstOnly bool) []*Evaluation {
+	prefixed := m.prefixes.lookup(url)
+	res := []*Evaluation{}
+	selected := false
+	for _, cw := range m.candidates(bucketOf(url)) {
+		ev := &Evaluation{Watch: cw.watch}
+		if !cw.watch.ActiveAt(m.now) {
+			if !firstOnly {
+				ev.Inactive = true
+				res = append(res, ev)
+			}
+			continue
+		}
+		if cw.match == nil {
+			ev.Matched = prefixed[cw.index]
+		} else {
+			ev.Matched, ev.Captures = cw.match(url)
+		}
+		if ev.Matched && !selected {
+			ev.Selected = true
+			selected = true
+		}
+		res = append(res, ev)
+		if selected && firstOnly {
+			break
+		}
+	}
+	return res
+}
+
+// bucketOf returns the bucket name of the gs:// URL.
+func bucketOf(url string) string {
+	if !strings.HasPrefix(url, "gs://") {
+		return ""
+	}
+	path := url[len("gs://"):]
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
+
+// notification builds the Notification of url to the topic of the Watch.
+func (ev *Evaluation) notification(url, state string, resource map[string]interface{}) *Notification {
+	return &Notification{
+		Topic:    ev.Watch.Topic,
+		Url:      url,
+		State:    state,
+		Resource: resource,
+		Captures: ev.Captures,
+		Watch:    ev.Watch,
+	}
+}
+
+// compile returns the function to match an URL with the pattern.
+func (w *Watch) compile() (matchFunc, error) {
+	switch w.PatternType {
+	case "", PATTERN_REGEXP:
+		re, err := regexp.Compile(w.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return regexpMatchFunc(re), nil
+	case PATTERN_GLOB:
+		re, err := globToRegexp(w.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return regexpMatchFunc(re), nil
+	case PATTERN_PREFIX:
+		if w.Pattern == "" {
+			return nil, fmt.Errorf("prefix must not be blank")
+		}
+		prefix := w.Pattern
+		return func(url string) (bool, map[string]string) { return strings.HasPrefix(url, prefix), nil }, nil
+	case PATTERN_SUFFIX:
+		if w.Pattern == "" {
+			return nil, fmt.Errorf("suffix must not be blank")
+		}
+		suffix := w.Pattern
+		return func(url string) (bool, map[string]string) { return strings.HasSuffix(url, suffix), nil }, nil
+	default:
+		return nil, fmt.Errorf("Unknown pattern type %q", w.PatternType)
+	}
+}
+
+// captureNames returns the names of the named capture groups of a regexp pattern.
+func (w *Watch) captureNames() []string {
+	if w.PatternType != "" && w.PatternType != PATTERN_REGEXP {
+		return nil
+	}
+	re, err := regexp.Compile(w.Pattern)
+	if err != nil {
+		return nil
+	}
+	res := []string{}
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+func regexpMatchFunc(re *regexp.Regexp) matchFunc {
+	names := re.SubexpNames()
+	return func(url string) (bool, map[string]string) {
+		m := re.FindStringSubmatch(url)
+		if m == nil {
+			return false, nil
+		}
+		var captures map[string]string
+		for i, name := range names {
+			if name == "" || i >= len(m) {
+				continue
+			}
+			if captures == nil {
+				captures = map[string]string{}
+			}
+			captures[name] = m[i]
+		}
+		return true, captures
+	}
+}
+
+// globToRegexp converts a glob pattern to an anchored regexp.
+// `**` matches any characters including `/`, `*` matches any characters
+// except `/` and `?` matches a character except `/`.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	if glob == "" {
+		return nil, fmt.Errorf("glob must not be blank")
+	}
+	buf := []string{`\A`}
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				// `**/` also matches no directory
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					i++
+					buf = append(buf, `(?:.*/)?`)
+				} else {
+					buf = append(buf, `.*`)
+				}
+			} else {
+				buf = append(buf, `[^/]*`)
+			}
+		case '?':
+			buf = append(buf, `[^/]`)
+		default:
+			buf = append(buf, regexp.QuoteMeta(glob[i:i+1]))
+		}
+	}
+	buf = append(buf, `\z`)
+	return regexp.Compile(strings.Join(buf, ""))
+}
+
+// prefixTrie finds the prefix watches matching an URL by walking the URL once
+// instead of comparing it with every prefix.
+type prefixTrie struct {
+	children map[byte]*prefixTrie
+	indexes  []int
+}
+
+func newPrefixTrie() *prefixTrie {
+	return &prefixTrie{children: map[byte]*prefixTrie{}}
+}
+
+func (t *prefixTrie) add(prefix string, index int) {
+	node := t
+	for i := 0; i < len(prefix); i++ {
+		child, ok := node.children[prefix[i]]
+		if !ok {
+			child = newPrefixTrie()
+			node.children[prefix[i]] = child
+		}
+		node = child
+	}
+	node.indexes = append(node.indexes, index)
+}
+
+// lookup returns the set of indexes whose prefix matches the url.
+func (t *prefixTrie) lookup(url string) map[int]bool {
+	res := map[int]bool{}
+	node := t
+	for i := 0; ; i++ {
+		for _, idx := range node.indexes {
+			res[idx] = true
+		}
+		if i >= len(url) {
+			break
+		}
+		child, ok := node.children[url[i]]
+		if !ok {
+			break
+		}
+		node = child
+	}
+	return res
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// The Matcher of each namespace is cached in the memory of the instance not
+// to load and compile all the watches for every notification. The version
+// in memcache is the time of the last change of the watches, and the instances
+// rebuild their Matcher when the version differs from the cached one.
+// The watches are loaded by an eventually consistent query, so the Matcher
+// isn't cached until MATCHER_SETTLE_TIME passes after the change, and the
+// cached one is rebuilt after MATCHER_CACHE_TTL in any case.
+
+const (
+	MATCHER_VERSION_KEY = "matcher_version"
+	MATCHER_SETTLE_TIME = 10 * time.Second
+	MATCHER_CACHE_TTL   = 1 * time.Minute
+)
+
+type cachedMatcher struct {
+	version  int64
+	loadedAt time.Time
+	matcher  *Matcher
+}
+
+var matcherCache = struct {
+	sync.Mutex
+	entries map[string]*cachedMatcher // by namespace
+}{entries: map[string]*cachedMatcher{}}
+
+// namespaceOf returns the namespace of ctx.
+func namespaceOf(ctx context.Context) string {
+	return datastore.NewIncompleteKey(ctx, WATCH_KIND, nil).Namespace()
+}
+
+func newMatcherVersion() *memcache.Item {
+	return &memcache.Item{
+		Key:   MATCHER_VERSION_KEY,
+		Value: []byte(strconv.FormatInt(time.Now().UnixNano(), 10)),
+	}
+}
+
+// matcherVersion returns the version of the watches in the namespace of ctx.
+// It's the current time if the version was evicted from memcache, so the
+// evicted version is never reused.
+func matcherVersion(ctx context.Context) (int64, error) {
+	item, err := memcache.Get(ctx, MATCHER_VERSION_KEY)
+	if err == memcache.ErrCacheMiss {
+		err = memcache.Add(ctx, newMatcherVersion())
+		if err != nil && err != memcache.ErrNotStored {
+			return 0, err
+		}
+		item, err = memcache.Get(ctx, MATCHER_VERSION_KEY)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(item.Value), 10, 64)
+}
+
+// invalidateMatcher changes the version so that all the instances rebuild
+// the Matcher of the namespace of ctx.
+func invalidateMatcher(ctx context.Context) {
+	err := memcache.Set(ctx, newMatcherVersion())
+	if err != nil {
+		log.Warningf(ctx, "Failed to invalidate the matcher: %v\n", err)
+	}
+	matcherCache.Lock()
+	delete(matcherCache.entries, namespaceOf(ctx))
+	matcherCache.Unlock()
+}
+
+// matcher returns the Matcher of the watches in the namespace at now.
+// If the version isn't available from memcache, it's built without the cache
+// only from the watches which can match the files in the bucket.
+func (s *WatchService) matcher(bucket string, now time.Time) (*Matcher, error) {
+	version, err := matcherVersion(s.ctx)
+	if err != nil {
+		log.Warningf(s.ctx, "Failed to get the matcher version: %v\n", err)
+		m, err := s.buildMatcher(func() (Watches, error) { return s.ForBucket(bucket) })
+		if err != nil {
+			return nil, err
+		}
+		return m.at(now), nil
+	}
+
+	ns := namespaceOf(s.ctx)
+	matcherCache.Lock()
+	cached := matcherCache.entries[ns]
+	matcherCache.Unlock()
+	if cached != nil && cached.version == version && now.Sub(cached.loadedAt) < MATCHER_CACHE_TTL {
+		return cached.matcher.at(now), nil
+	}
+
+	m, err := s.buildMatcher(s.All)
+	if err != nil {
+		return nil, err
+	}
+	if now.Sub(time.Unix(0, version)) < MATCHER_SETTLE_TIME {
+		return m.at(now), nil
+	}
+	matcherCache.Lock()
+	matcherCache.entries[ns] = &cachedMatcher{version: version, loadedAt: now, matcher: m}
+	matcherCache.Unlock()
+	return m.at(now), nil
+}
+
+// buildMatcher loads the watches and compiles them.
+func (s *WatchService) buildMatcher(load func() (Watches, error)) (*Matcher, error) {
+	_, span := startSpan(s.ctx, "datastore.watches")
+	watches, err := load()
+	span.SetAttribute("watches", len(watches))
+	span.SetError(err)
+	span.Finish()
+	if err != nil {
+		return nil, err
+	}
+	_, span = startSpan(s.ctx, "matcher.compile")
+	m, err := NewMatcher(watches)
+	span.SetError(err)
+	span.Finish()
+	if err != nil {
+		log.Errorf(s.ctx, "Failed to compile watches: %v", err)
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	type Pattern struct {
+		glob    string
+		url     string
+		matched bool
+	}
+
+	patterns := []Pattern{
+		{"gs://bucket1/**/*.csv", "gs://bucket1/dir1/dir2/file.csv", true},
+		{"gs://bucket1/**/*.csv", "gs://bucket1/file.csv", true},
+		{"gs://bucket1/**/*.csv", "gs://bucket1/dir1/file.csvx", false},
+		{"gs://bucket1/**/*.csv", "gs://bucket10/dir1/file.csv", false},
+		{"gs://bucket1/*.csv", "gs://bucket1/file.csv", true},
+		{"gs://bucket1/*.csv", "gs://bucket1/dir1/file.csv", false},
+		{"gs://bucket1/dir?/*", "gs://bucket1/dir1/file.csv", true},
+		{"gs://bucket1/dir?/*", "gs://bucket1/dir10/file.csv", false},
+		{"gs://bucket1/dir1/**", "gs://bucket1/dir1/a/b/c", true},
+		{"gs://bucket.1/*", "gs://bucketx1/file", false},
+	}
+
+	for _, ptn := range patterns {
+		re, err := globToRegexp(ptn.glob)
+		if assert.NoError(t, err) {
+			assert.Equal(t, ptn.matched, re.MatchString(ptn.url), "%v with %v", ptn.glob, ptn.url)
+		}
+	}
+
+	_, err := globToRegexp("")
+	assert.Error(t, err)
+}
+
+func TestMatcherEvaluate(t *testing.T) {
+	watches := Watches{
+		&Watch{ID: "1", Seq: 1, PatternType: PATTERN_PREFIX, Pattern: "gs://bucket1/dir1/", Topic: "topic1"},
+		&Watch{ID: "2", Seq: 2, PatternType: PATTERN_SUFFIX, Pattern: ".dat", Topic: "topic2"},
+		&Watch{ID: "3", Seq: 3, PatternType: PATTERN_PREFIX, Pattern: "gs://bucket1/", Topic: "topic3"},
+		&Watch{ID: "4", Seq: 4, PatternType: PATTERN_GLOB, Pattern: "gs://bucket2/**/*.csv", Topic: "topic4"},
+		&Watch{ID: "5", Seq: 5, Pattern: `\Ags://bucket2/`, Topic: "topic5"},
+	}
+	m, err := NewMatcher(watches)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	type Pattern struct {
+		url      string
+		selected string
+		matched  []string
+	}
+
+	patterns := []Pattern{
+		{"gs://bucket1/dir1/file.dat", "1", []string{"1", "2", "3"}},
+		{"gs://bucket1/dir2/file.dat", "2", []string{"2", "3"}},
+		{"gs://bucket1/dir2/file.csv", "3", []string{"3"}},
+		{"gs://bucket2/dir1/file.csv", "4", []string{"4", "5"}},
+		{"gs://bucket2/file.txt", "5", []string{"5"}},
+		{"gs://bucket3/file.txt", "", []string{}},
+	}
+
+	for _, ptn := range patterns {
+		evaluations := m.evaluate(ptn.url, false)
+		assert.Equal(t, len(watches), len(evaluations))
+		matched := []string{}
+		selected := ""
+		for _, ev := range evaluations {
+			if ev.Matched {
+				matched = append(matched, ev.Watch.ID)
+			}
+			if ev.Selected {
+				selected = ev.Watch.ID
+			}
+		}
+		assert.Equal(t, ptn.matched, matched, ptn.url)
+		assert.Equal(t, ptn.selected, selected, ptn.url)
+
+		// firstOnly stops at the selected Watch
+		evaluations = m.evaluate(ptn.url, true)
+		last := evaluations[len(evaluations)-1]
+		if ptn.selected == "" {
+			assert.Equal(t, len(watches), len(evaluations))
+		} else {
+			assert.Equal(t, ptn.selected, last.Watch.ID)
+			assert.True(t, last.Selected)
+		}
+	}
+
+	// Invalid pattern
+	_, err = NewMatcher(Watches{&Watch{PatternType: "unknown", Pattern: "foo"}})
+	assert.Error(t, err)
+}
+
+func TestMatcherEvaluateWithBucket(t *testing.T) {
+	watches := Watches{
+		&Watch{ID: "1", Seq: 1, Bucket: "bucket1", Pattern: `/dir1/`, Topic: "topic1"},
+		&Watch{ID: "2", Seq: 2, Pattern: `\.dat\z`, Topic: "topic2"},
+		&Watch{ID: "3", Seq: 3, Bucket: "bucket2", Pattern: `/dir1/`, Topic: "topic3"},
+		&Watch{ID: "4", Seq: 4, Bucket: "bucket1", PatternType: PATTERN_SUFFIX, Pattern: ".csv", Topic: "topic4"},
+	}
+	m, err := NewMatcher(watches)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	type Pattern struct {
+		url       string
+		selected  string
+		evaluated []string
+	}
+
+	patterns := []Pattern{
+		{"gs://bucket1/dir1/file.dat", "1", []string{"1", "2", "4"}},
+		{"gs://bucket1/dir2/file.csv", "4", []string{"1", "2", "4"}},
+		{"gs://bucket2/dir1/file.csv", "3", []string{"2", "3"}},
+		{"gs://bucket3/dir1/file.csv", "", []string{"2"}},
+		{"gs://bucket3/dir1/file.dat", "2", []string{"2"}},
+	}
+
+	for _, ptn := range patterns {
+		evaluated := []string{}
+		selected := ""
+		for _, ev := range m.evaluate(ptn.url, false) {
+			evaluated = append(evaluated, ev.Watch.ID)
+			if ev.Selected {
+				selected = ev.Watch.ID
+			}
+		}
+		assert.Equal(t, ptn.evaluated, evaluated, ptn.url)
+		assert.Equal(t, ptn.selected, selected, ptn.url)
+	}
+}
+
+func TestWatchesGroupByBucket(t *testing.T) {
+	watches := Watches{
+		&Watch{ID: "1", Seq: 1, Bucket: "bucket2"},
+		&Watch{ID: "2", Seq: 2},
+		&Watch{ID: "3", Seq: 3, Bucket: "bucket1"},
+		&Watch{ID: "4", Seq: 4, Bucket: "bucket2"},
+	}
+	groups := watches.GroupByBucket()
+	if assert.Equal(t, 3, len(groups)) {
+		assert.Equal(t, "", groups[0].Bucket)
+		assert.Equal(t, Watches{watches[1]}, groups[0].Watches)
+		assert.Equal(t, "bucket1", groups[1].Bucket)
+		assert.Equal(t, Watches{watches[2]}, groups[1].Watches)
+		assert.Equal(t, "bucket2", groups[2].Bucket)
+		assert.Equal(t, Watches{watches[0], watches[3]}, groups[2].Watches)
+	}
+}
+
+func TestMatcherEvaluateCaptures(t *testing.T) {
+	watches := Watches{
+		&Watch{ID: "1", Seq: 1, Pattern: `\Ags://b/tenant=(?P<tenant>[^/]+)/date=(?P<date>[^/]+)/`, Topic: "topic1"},
+		&Watch{ID: "2", Seq: 2, Pattern: `\Ags://b/(\w+)/`, Topic: "topic2"},
+	}
+	m, err := NewMatcher(watches)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	evaluations := m.evaluate("gs://b/tenant=acme/date=2017-02-20/x.csv", true)
+	if assert.Equal(t, 1, len(evaluations)) {
+		assert.Equal(t, map[string]string{"tenant": "acme", "date": "2017-02-20"}, evaluations[0].Captures)
+		n := evaluations[0].notification("gs://b/tenant=acme/date=2017-02-20/x.csv", "exists", nil)
+		assert.Equal(t, "topic1", n.Topic)
+		assert.Equal(t, evaluations[0].Captures, n.Captures)
+	}
+
+	// Unnamed groups are not captured
+	evaluations = m.evaluate("gs://b/dir1/x.csv", true)
+	if assert.Equal(t, 2, len(evaluations)) {
+		assert.True(t, evaluations[1].Selected)
+		assert.Nil(t, evaluations[1].Captures)
+	}
+}
+
+func TestMatcherEvaluateWithSchedule(t *testing.T) {
+	now := time.Date(2017, 3, 10, 12, 0, 0, 0, time.UTC)
+	watches := Watches{
+		&Watch{ID: "1", Seq: 1, Pattern: `\.csv\z`, Topic: "topic1", Disabled: true},
+		&Watch{ID: "2", Seq: 2, Pattern: `\.csv\z`, Topic: "topic2", ActiveFrom: now.Add(time.Hour)},
+		&Watch{ID: "3", Seq: 3, Pattern: `\.csv\z`, Topic: "topic3", ActiveUntil: now},
+		&Watch{ID: "4", Seq: 4, Pattern: `\.csv\z`, Topic: "topic4", ActiveFrom: now, ActiveUntil: now.Add(time.Hour)},
+	}
+	m, err := NewMatcher(watches)
+	if !assert.NoError(t, err) {
+		return
+	}
+	m.now = now
+
+	evaluations := m.evaluate("gs://bucket1/file.csv", false)
+	if assert.Equal(t, 4, len(evaluations)) {
+		for _, ev := range evaluations[:3] {
+			assert.True(t, ev.Inactive, ev.Watch.ID)
+			assert.False(t, ev.Matched, ev.Watch.ID)
+		}
+		assert.False(t, evaluations[3].Inactive)
+		assert.True(t, evaluations[3].Selected)
+	}
+
+	evaluations = m.evaluate("gs://bucket1/file.csv", true)
+	if assert.Equal(t, 1, len(evaluations)) {
+		assert.Equal(t, "4", evaluations[0].Watch.ID)
+	}
+
+	m.now = now.Add(time.Hour)
+	evaluations = m.evaluate("gs://bucket1/file.csv", true)
+	if assert.Equal(t, 1, len(evaluations)) {
+		assert.Equal(t, "2", evaluations[0].Watch.ID)
+	}
+}
+
+func TestMatcherAt(t *testing.T) {
+	now := time.Date(2017, 3, 10, 12, 0, 0, 0, time.UTC)
+	watches := Watches{
+		&Watch{ID: "1", Seq: 1, Pattern: `\.csv\z`, Topic: "topic1", ActiveUntil: now},
+		&Watch{ID: "2", Seq: 2, Pattern: `\.csv\z`, Topic: "topic2"},
+	}
+	m, err := NewMatcher(watches)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	before := m.at(now.Add(-time.Hour))
+	after := m.at(now)
+	assert.Equal(t, "1", before.evaluate("gs://bucket1/file.csv", true)[0].Watch.ID)
+	assert.Equal(t, "2", after.evaluate("gs://bucket1/file.csv", true)[0].Watch.ID)
+	// The original one isn't changed
+	assert.True(t, m.now.After(now))
+}
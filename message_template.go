@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// The message templates of a Watch are Go text/template executed with the *Notification.
+// e.g. `{{.Url}}`, `{{.State}}`, `{{.Resource.bucket}}`, `{{.Captures.tenant}}`
+//
+// The attributes template has an attribute per line in the form of `name=template`.
+// The name is trimmed but the template is used as it is. Blank lines are ignored.
+//
+// The ordering key template gives the ordering key of the message.
+// ORDERING_KEY_OBJECT orders the messages of each object.
+
+const (
+	ORDERING_KEY_OBJECT = "{{.Resource.bucket}}/{{.Resource.name}}"
+
+	// Pub/Sub rejects longer ordering keys
+	MAX_ORDERING_KEY_BYTES = 1024
+
+	// STALE_ATTRIBUTE is set to "true" for the stale events flagged by the Watch.
+	STALE_ATTRIBUTE = "stale"
+)
+
+var messageTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+type attributeTemplate struct {
+	name string
+	tmpl *template.Template
+}
+
+func parseAttributesTemplate(src string) ([]*attributeTemplate, error) {
+	res := []*attributeTemplate{}
+	for i, line := range strings.Split(src, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d must be in the form of name=template: %q", i+1, line)
+		}
+		name := strings.TrimSpace(parts[0])
+		if name == "" {
+			return nil, fmt.Errorf("line %d has no attribute name: %q", i+1, line)
+		}
+		if isReservedAttribute(name) {
+			return nil, fmt.Errorf("line %d has reserved attribute name %q", i+1, name)
+		}
+		tmpl, err := template.New(name).Funcs(messageTemplateFuncs).Parse(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		res = append(res, &attributeTemplate{name, tmpl})
+	}
+	return res, nil
+}
+
+func parseDataTemplate(src string) (*template.Template, error) {
+	return template.New("data").Funcs(messageTemplateFuncs).Parse(src)
+}
+
+func parseOrderingKeyTemplate(src string) (*template.Template, error) {
+	return template.New("ordering_key").Funcs(messageTemplateFuncs).Parse(src)
+}
+
+// orderingKey returns the ordering key of the notification or "" if the Watch has no ordering key template.
+func orderingKey(n *Notification) (string, error) {
+	if n.Watch == nil || strings.TrimSpace(n.Watch.OrderingKeyTemplate) == "" {
+		return "", nil
+	}
+	tmpl, err := parseOrderingKeyTemplate(n.Watch.OrderingKeyTemplate)
+	if err != nil {
+		return "", err
+	}
+	key, err := executeTemplate(tmpl, n)
+	if err != nil {
+		return "", err
+	}
+	if len(key) > MAX_ORDERING_KEY_BYTES {
+		return "", fmt.Errorf("ordering key must be at most %d bytes but it was %d bytes", MAX_ORDERING_KEY_BYTES, len(key))
+	}
+	return key, nil
+}
+
+func executeTemplate(tmpl *template.Template, n *Notification) (string, error) {
+	buf := &bytes.Buffer{}
+	err := tmpl.Execute(buf, n)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// validateTemplates parses the templates of the Watch and executes them with a sample notification.
+func (w *Watch) validateTemplates() error {
+	attrs, err := parseAttributesTemplate(w.AttributesTemplate)
+	if err != nil {
+		return &ValidationError{fmt.Sprintf("Invalid attributes template: %v", err)}
+	}
+	data, err := parseDataTemplate(w.DataTemplate)
+	if err != nil {
+		return &ValidationError{fmt.Sprintf("Invalid data template: %v", err)}
+	}
+	sample := &Notification{
+		Topic:    w.Topic,
+		Url:      "gs://bucket/path/to/file",
+		State:    "exists",
+		Resource: map[string]interface{}{"bucket": "bucket", "name": "path/to/file"},
+		Captures: map[string]string{},
+		Watch:    w,
+	}
+	for _, attr := range attrs {
+		_, err := executeTemplate(attr.tmpl, sample)
+		if err != nil {
+			return &ValidationError{fmt.Sprintf("Invalid attributes template: %v", err)}
+		}
+	}
+	_, err = executeTemplate(data, sample)
+	if err != nil {
+		return &ValidationError{fmt.Sprintf("Invalid data template: %v", err)}
+	}
+	_, err = orderingKey(sample)
+	if err != nil {
+		return &ValidationError{fmt.Sprintf("Invalid ordering key template: %v", err)}
+	}
+	return nil
+}
+
+// buildMessage builds the message to publish for the notification.
+// The named capture groups are set as attributes. Then the attributes of the
+// attributes template of the Watch are set, or `download_files` if it's blank.
+func buildMessage(n *Notification) (*PubsubMessage, error) {
+	msg := &PubsubMessage{
+		Attributes: map[string]string{},
+	}
+	for name, value := range n.Captures {
+		msg.Attributes[name] = value
+	}
+
+	var attributesTemplate, dataTemplate string
+	if n.Watch != nil {
+		attributesTemplate, dataTemplate = n.Watch.AttributesTemplate, n.Watch.DataTemplate
+	}
+
+	if strings.TrimSpace(attributesTemplate) == "" {
+		msg.Attributes["download_files"] = n.Url
+	} else {
+		attrs, err := parseAttributesTemplate(attributesTemplate)
+		if err != nil {
+			return nil, err
+		}
+		for _, attr := range attrs {
+			value, err := executeTemplate(attr.tmpl, n)
+			if err != nil {
+				return nil, err
+			}
+			msg.Attributes[attr.name] = value
+		}
+	}
+
+	if dataTemplate != "" {
+		tmpl, err := parseDataTemplate(dataTemplate)
+		if err != nil {
+			return nil, err
+		}
+		data, err := executeTemplate(tmpl, n)
+		if err != nil {
+			return nil, err
+		}
+		msg.Data = base64.StdEncoding.EncodeToString([]byte(data))
+	}
+
+	key, err := orderingKey(n)
+	if err != nil {
+		return nil, err
+	}
+	msg.OrderingKey = key
+	if n.Stale {
+		msg.Attributes[STALE_ATTRIBUTE] = "true"
+	}
+	return msg, nil
+}
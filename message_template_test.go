@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildMessage(t *testing.T) {
+	url := "gs://bucket1/tenant=acme/x.csv"
+	n := &Notification{
+		Topic:    "projects/dummy-proj-999/topics/topic1",
+		Url:      url,
+		State:    "exists",
+		Resource: BuildData("bucket1", "tenant=acme/x.csv"),
+		Captures: map[string]string{"tenant": "acme"},
+		Watch:    &Watch{},
+	}
+
+	// Default attributes
+	msg, err := buildMessage(n)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{
+			"download_files": url,
+			"tenant":         "acme",
+		}, msg.Attributes)
+		assert.Equal(t, "", msg.Data)
+	}
+
+	// With templates
+	n.Watch = &Watch{
+		AttributesTemplate: "file={{.Url}}\n\nbucket ={{.Resource.bucket}}\r\nowner={{.Captures.tenant}}-{{.State}}\n",
+		DataTemplate:       `{"name":{{json .Resource.name}},"size":{{.Resource.size}}}`,
+	}
+	msg, err = buildMessage(n)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{
+			"file":   url,
+			"bucket": "bucket1",
+			"owner":  "acme-exists",
+			"tenant": "acme",
+		}, msg.Attributes)
+		data, err := base64.StdEncoding.DecodeString(msg.Data)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"name":"tenant=acme/x.csv","size":1660}`, string(data))
+	}
+}
+
+func TestWatchValidateTemplates(t *testing.T) {
+	type Pattern struct {
+		attributes string
+		data       string
+		err        string
+	}
+
+	patterns := []Pattern{
+		{"", "", ""},
+		{"file={{.Url}}", "{{json .Resource}}", ""},
+		{"file", "", "Invalid attributes template: line 1 must be in the form of name=template"},
+		{"a=1\n=2", "", "Invalid attributes template: line 2 has no attribute name"},
+		{"googfoo=1", "", "Invalid attributes template: line 1 has reserved attribute name"},
+		{"file={{.Url}}\ndownload_files={{.Url}}", "", `Invalid attributes template: line 2 has reserved attribute name "download_files"`},
+		{"traceparent=00-foo", "", `Invalid attributes template: line 1 has reserved attribute name "traceparent"`},
+		{"stale=false", "", `Invalid attributes template: line 1 has reserved attribute name "stale"`},
+		{"file={{.Url", "", "Invalid attributes template: line 1:"},
+		{"file={{.Unknown}}", "", "Invalid attributes template:"},
+		{"", "{{if}}", "Invalid data template:"},
+	}
+
+	for _, ptn := range patterns {
+		w := &Watch{AttributesTemplate: ptn.attributes, DataTemplate: ptn.data}
+		err := w.validateTemplates()
+		if ptn.err == "" {
+			assert.NoError(t, err, "%v %v", ptn.attributes, ptn.data)
+		} else if assert.Error(t, err, "%v %v", ptn.attributes, ptn.data) {
+			assert.Contains(t, err.Error(), ptn.err)
+		}
+	}
+}
+
+func TestBuildMessageOrderingKey(t *testing.T) {
+	n := &Notification{
+		Url:      "gs://bucket1/path/to/file",
+		State:    "exists",
+		Resource: BuildData("bucket1", "path/to/file"),
+		Watch:    &Watch{},
+	}
+
+	msg, err := buildMessage(n)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", msg.OrderingKey)
+	}
+
+	n.Watch = &Watch{OrderingKeyTemplate: ORDERING_KEY_OBJECT}
+	n.Stale = true
+	msg, err = buildMessage(n)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "bucket1/path/to/file", msg.OrderingKey)
+		assert.Equal(t, "true", msg.Attributes[STALE_ATTRIBUTE])
+	}
+
+	// Too long ordering key
+	n.Watch = &Watch{OrderingKeyTemplate: `{{.Url}}{{printf "%1024s" ""}}`}
+	_, err = buildMessage(n)
+	assert.Error(t, err)
+
+	w := &Watch{OrderingKeyTemplate: "{{.Unknown}}"}
+	err = w.validateTemplates()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Invalid ordering key template:")
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// The metrics are kept in memory of each instance and exposed on /metrics
+// in the Prometheus text format. They are reset when the instance restarts,
+// and a scrape gets the metrics of the instance which handles it.
+//
+// The bucket of an event is given by the unauthenticated request body, so the
+// bucket label has only the buckets of watches and tenants and the others are
+// counted as METRIC_OTHER_BUCKET not to make the label values unbounded.
+
+type (
+	metricsRegistry struct {
+		mu      sync.Mutex
+		metrics []metricFamily
+	}
+
+	metricFamily interface {
+		write(w io.Writer) error
+	}
+
+	counterVec struct {
+		registry *metricsRegistry
+		name     string
+		help     string
+		labels   []string
+		values   map[string]*counterValue
+	}
+
+	counterValue struct {
+		labelValues []string
+		value       float64
+	}
+
+	histogramVec struct {
+		registry *metricsRegistry
+		name     string
+		help     string
+		labels   []string
+		buckets  []float64
+		values   map[string]*histogramValue
+	}
+
+	histogramValue struct {
+		labelValues []string
+		counts      []uint64 // count of observations for each bucket, not cumulative
+		sum         float64
+		count       uint64
+	}
+)
+
+const METRIC_OTHER_BUCKET = "other"
+
+// DEFAULT_HISTOGRAM_BUCKETS are the upper bounds of histogram buckets in seconds.
+var DEFAULT_HISTOGRAM_BUCKETS = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var metrics = newMetricsRegistry()
+
+var (
+	requestsTotal = metrics.newCounter("gcs_watcher_requests_total",
+		"Number of OCN requests.", "state", "outcome")
+	requestDuration = metrics.newHistogram("gcs_watcher_request_duration_seconds",
+		"Duration of OCN requests.", "state", "outcome")
+	eventsTotal = metrics.newCounter("gcs_watcher_events_total",
+		"Number of object change events processed.", "bucket", "state", "outcome")
+	matchesTotal = metrics.newCounter("gcs_watcher_matches_total",
+		"Number of events which matched a Watch.", "bucket", "watch_id")
+	matchDuration = metrics.newHistogram("gcs_watcher_match_duration_seconds",
+		"Duration to find the Watch for an event.", "bucket")
+	publishTotal = metrics.newCounter("gcs_watcher_publish_total",
+		"Number of messages published.", "topic", "watch_id", "outcome")
+	publishDuration = metrics.newHistogram("gcs_watcher_publish_duration_seconds",
+		"Duration to publish a message.", "topic", "outcome")
+	alertsTotal = metrics.newCounter("gcs_watcher_alerts_total",
+		"Number of alerts of silent buckets.", "bucket", "notifier", "outcome")
+	messageGapsTotal = metrics.newCounter("gcs_watcher_message_gaps_total",
+		"Number of gaps and out-of-order deliveries of message numbers.", "bucket", "kind")
+	missedMessagesTotal = metrics.newCounter("gcs_watcher_missed_messages_total",
+		"Number of messages skipped by the gaps of message numbers.", "bucket")
+	staleEventsTotal = metrics.newCounter("gcs_watcher_stale_events_total",
+		"Number of events older than the last one of the object.", "bucket", "watch_id", "action")
+	resyncObjectsTotal = metrics.newCounter("gcs_watcher_resync_objects_total",
+		"Number of objects processed by resync.", "bucket", "outcome")
+)
+
+// bucketLabel returns the bucket if a Watch in the namespace of ctx or the tenant has it,
+// otherwise METRIC_OTHER_BUCKET.
+func bucketLabel(ctx context.Context, bucket string) string {
+	if bucket == "" {
+		return ""
+	}
+	if t := tenantOf(ctx); t != nil && t.AllowsBucket(bucket) {
+		return bucket
+	}
+	m, err := (&WatchService{ctx}).matcher(bucket, time.Now())
+	if err == nil && m.hasBucket(bucket) {
+		return bucket
+	}
+	return METRIC_OTHER_BUCKET
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{}
+}
+
+func (r *metricsRegistry) newCounter(name, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		registry: r,
+		name:     name,
+		help:     help,
+		labels:   labels,
+		values:   map[string]*counterValue{},
+	}
+	r.metrics = append(r.metrics, c)
+	return c
+}
+
+func (r *metricsRegistry) newHistogram(name, help string, labels ...string) *histogramVec {
+	h := &histogramVec{
+		registry: r,
+		name:     name,
+		help:     help,
+		labels:   labels,
+		buckets:  DEFAULT_HISTOGRAM_BUCKETS,
+		values:   map[string]*histogramValue{},
+	}
+	r.metrics = append(r.metrics, h)
+	return h
+}
+
+// write writes all the metrics in the Prometheus text format.
+func (r *metricsRegistry) write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		err := m.write(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func labelKey(labels, values []string) string {
+	if len(labels) != len(values) {
+		panic(fmt.Sprintf("%d label values are given for labels %v", len(values), labels))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := labelKey(c.labels, labelValues)
+	c.registry.mu.Lock()
+	defer c.registry.mu.Unlock()
+	cv, ok := c.values[key]
+	if !ok {
+		cv = &counterValue{labelValues: labelValues}
+		c.values[key] = cv
+	}
+	cv.value += v
+}
+
+func (c *counterVec) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(c.values) {
+		cv := c.values[key]
+		_, err := fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, cv.labelValues), formatValue(cv.value))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := labelKey(h.labels, labelValues)
+	h.registry.mu.Lock()
+	defer h.registry.mu.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hv.counts[i]++
+			break
+		}
+	}
+	hv.sum += v
+	hv.count++
+}
+
+// since observes the seconds elapsed from start.
+func (h *histogramVec) since(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	if err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(h.values) {
+		hv := h.values[key]
+		labels := append(append([]string{}, h.labels...), "le")
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hv.counts[i]
+			values := append(append([]string{}, hv.labelValues...), formatValue(upper))
+			_, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labels, values), cumulative)
+			if err != nil {
+				return err
+			}
+		}
+		values := append(append([]string{}, hv.labelValues...), "+Inf")
+		_, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.name, formatLabels(labels, values), hv.count,
+			h.name, formatLabels(h.labels, hv.labelValues), formatValue(hv.sum),
+			h.name, formatLabels(h.labels, hv.labelValues), hv.count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch v := m.(type) {
+	case map[string]*counterValue:
+		for key := range v {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramValue:
+		for key := range v {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, label, labelValueReplacer.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/aetest"
+)
+
+func TestMetricsRegistryWrite(t *testing.T) {
+	r := newMetricsRegistry()
+	c := r.newCounter("test_total", "Test counter.", "bucket", "outcome")
+	h := r.newHistogram("test_duration_seconds", "Test histogram.", "topic")
+	h.buckets = []float64{0.1, 1}
+
+	c.inc("bucket1", "ok")
+	c.inc("bucket1", "ok")
+	c.add(0.5, "bucket\"2\"", "error")
+	h.observe(0.05, "topic1")
+	h.observe(0.5, "topic1")
+	h.observe(2, "topic1")
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, r.write(buf))
+	assert.Equal(t, strings.Join([]string{
+		`# HELP test_total Test counter.`,
+		`# TYPE test_total counter`,
+		`test_total{bucket="bucket\"2\"",outcome="error"} 0.5`,
+		`test_total{bucket="bucket1",outcome="ok"} 2`,
+		`# HELP test_duration_seconds Test histogram.`,
+		`# TYPE test_duration_seconds histogram`,
+		`test_duration_seconds_bucket{topic="topic1",le="0.1"} 1`,
+		`test_duration_seconds_bucket{topic="topic1",le="1"} 2`,
+		`test_duration_seconds_bucket{topic="topic1",le="+Inf"} 3`,
+		`test_duration_seconds_sum{topic="topic1"} 2.55`,
+		`test_duration_seconds_count{topic="topic1"} 3`,
+		``,
+	}, "\n"), buf.String())
+
+	// The number of label values must match
+	assert.Panics(t, func() { c.inc("bucket1") })
+}
+
+func TestPubsubNotifierObserve(t *testing.T) {
+	topic := "projects/dummy-proj-999/topics/metrics-test"
+	n := &Notification{Topic: topic, Watch: &Watch{ID: "watch1"}}
+
+	// Not instrumented (dry run)
+	(&PubsubNotifier{}).observe(n, "success", time.Now())
+	(&PubsubNotifier{instrumented: true}).observe(n, "success", time.Now())
+	(&PubsubNotifier{instrumented: true}).observe(n, "invalid_message", time.Time{})
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, metrics.write(buf))
+	out := buf.String()
+	assert.Contains(t, out, `gcs_watcher_publish_total{topic="`+topic+`",watch_id="watch1",outcome="success"} 1`+"\n")
+	assert.Contains(t, out, `gcs_watcher_publish_total{topic="`+topic+`",watch_id="watch1",outcome="invalid_message"} 1`+"\n")
+	assert.Contains(t, out, `gcs_watcher_publish_duration_seconds_count{topic="`+topic+`",outcome="success"} 1`+"\n")
+	assert.NotContains(t, out, `gcs_watcher_publish_duration_seconds_count{topic="`+topic+`",outcome="invalid_message"}`)
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	h := &handler{}
+	e := echo.New()
+	get := func(auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(echo.GET, "/metrics", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		assert.NoError(t, h.metrics(e.NewContext(req, rec)))
+		return rec
+	}
+
+	// Not found without METRICS_TOKEN
+	os.Unsetenv("METRICS_TOKEN")
+	assert.Equal(t, http.StatusNotFound, get("").Code)
+	assert.Equal(t, http.StatusNotFound, get("Bearer ").Code)
+
+	os.Setenv("METRICS_TOKEN", "secret")
+	defer os.Unsetenv("METRICS_TOKEN")
+	assert.Equal(t, http.StatusUnauthorized, get("").Code)
+	assert.Equal(t, http.StatusUnauthorized, get("Bearer wrong").Code)
+	rec := get("Bearer secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "# TYPE gcs_watcher_requests_total counter")
+}
+
+func TestBucketLabel(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, WATCH_KIND)
+
+	service := &WatchService{ctx}
+	w := &Watch{Seq: 1, Bucket: "bucket1", Pattern: `\.csv\z`, Topic: "projects/dummy-proj-999/topics/foo"}
+	assert.NoError(t, service.Create(w))
+
+	retryWith(10, func() func() {
+		if label := bucketLabel(ctx, "bucket1"); label != "bucket1" {
+			return func() { t.Fatalf("Expected bucket1 but got %v", label) }
+		}
+		return nil
+	})
+	assert.Equal(t, METRIC_OTHER_BUCKET, bucketLabel(ctx, "unknown-bucket"))
+	assert.Equal(t, "", bucketLabel(ctx, ""))
+
+	// The buckets of the tenant
+	tctx, err := withTenant(ctx, &Tenant{Name: "team1", Buckets: []string{"bucket2"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "bucket2", bucketLabel(tctx, "bucket2"))
+	assert.Equal(t, METRIC_OTHER_BUCKET, bucketLabel(tctx, "bucket1"))
+}
@@ -4,7 +4,18 @@ import (
 	"golang.org/x/net/context"
 )
 
+// Notification is what a Notifier notifies of a file.
+type Notification struct {
+	Topic    string
+	Url      string
+	State    string                 // X-Goog-Resource-State
+	Resource map[string]interface{} // the object resource given as OCN request body
+	Captures map[string]string      // named capture groups of the matched Watch pattern
+	Watch    *Watch
+	Stale    bool // true if the event is older than the last one of the object
+}
+
 type Notifier interface {
-	Updated(ctx context.Context, topic, url string) error
-	Deleted(ctx context.Context, topic, url string) error
+	Updated(ctx context.Context, n *Notification) error
+	Deleted(ctx context.Context, n *Notification) error
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// OCN requests are processed independently, so the events of an object can be
+// processed out of order. ObjectState keeps the latest version of each object
+// whose event was published by the watches which check stale events. An event
+// older than it is dropped or flagged by the stale attribute. The version is
+// advanced only after the message is published, so a failed event doesn't make
+// its retries or the other events stale.
+//
+// The versions are compared by generation, metageneration and then the state,
+// where not_exists is later than exists of the same generation.
+//
+// The cron job deletes the ObjectStates not updated for OBJECT_STATE_TTL.
+
+type (
+	ObjectState struct {
+		Url            string `datastore:",noindex"`
+		Generation     int64
+		Metageneration int64
+		State          string
+		UpdatedAt      time.Time
+	}
+
+	ObjectStateService struct {
+		ctx context.Context
+	}
+)
+
+const (
+	OBJECT_STATE_KIND = "ObjectStates"
+	OBJECT_STATE_TTL  = 7 * 24 * time.Hour
+
+	// The number of ObjectStates deleted at once
+	OBJECT_STATE_DELETE_BATCH = 500
+
+	// The action of the stale events which are found after they are published
+	STALE_PUBLISHED = "published"
+)
+
+// objectVersionOf returns the ObjectState of the event.
+func objectVersionOf(url, state string, resource map[string]interface{}) (*ObjectState, error) {
+	generation, err := int64Of(resource["generation"])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid generation: %v", err)
+	}
+	metageneration, err := int64Of(resource["metageneration"])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid metageneration: %v", err)
+	}
+	return &ObjectState{
+		Url:            url,
+		Generation:     generation,
+		Metageneration: metageneration,
+		State:          state,
+	}, nil
+}
+
+// int64Of returns the number of the object resource field, which is a string in JSON.
+func int64Of(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case nil:
+		return 0, nil
+	case string:
+		return strconv.ParseInt(n, 10, 64)
+	case float64:
+		return int64(n), nil
+	case int:
+		return int64(n), nil
+	default:
+		return 0, fmt.Errorf("%T (%v) is not a number", v, v)
+	}
+}
+
+func stateRank(state string) int {
+	if state == "not_exists" {
+		return 1
+	}
+	return 0
+}
+
+// Before returns true if the version of st is older than the other.
+func (st *ObjectState) Before(other *ObjectState) bool {
+	if st.Generation != other.Generation {
+		return st.Generation < other.Generation
+	}
+	if st.Metageneration != other.Metageneration {
+		return st.Metageneration < other.Metageneration
+	}
+	return stateRank(st.State) < stateRank(other.State)
+}
+
+// key returns the key by the hash of the URL since an object name may be longer than a key name.
+func (s *ObjectStateService) key(url string) *datastore.Key {
+	sum := sha256.Sum256([]byte(url))
+	return datastore.NewKey(s.ctx, OBJECT_STATE_KIND, hex.EncodeToString(sum[:]), 0, nil)
+}
+
+// IsStale returns true if the event is older than the last one of the object.
+// The same version isn't stale so that the retries of the event can succeed.
+func (s *ObjectStateService) IsStale(v *ObjectState) (bool, error) {
+	last := ObjectState{}
+	err := datastore.Get(s.ctx, s.key(v.Url), &last)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	}
+	if err != nil {
+		log.Errorf(s.ctx, "ObjectStateService.IsStale(%v) [%T]%v\n", v, err, err)
+		return false, err
+	}
+	return v.Before(&last), nil
+}
+
+// Advance records the version of the published event unless it's older than the last one.
+// It returns true if the event is stale.
+func (s *ObjectStateService) Advance(v *ObjectState) (bool, error) {
+	key := s.key(v.Url)
+	stale := false
+	err := datastore.RunInTransaction(s.ctx, func(tc context.Context) error {
+		stale = false
+		last := ObjectState{}
+		err := datastore.Get(tc, key, &last)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil && v.Before(&last) {
+			stale = true
+			return nil
+		}
+		v.UpdatedAt = time.Now()
+		_, err = datastore.Put(tc, key, v)
+		return err
+	}, nil)
+	if err != nil {
+		log.Errorf(s.ctx, "ObjectStateService.Advance(%v) [%T]%v\n", v, err, err)
+		return false, err
+	}
+	return stale, nil
+}
+
+// DeleteBefore deletes the ObjectStates updated before t and returns the number of them.
+func (s *ObjectStateService) DeleteBefore(t time.Time) (int, error) {
+	deleted := 0
+	for {
+		q := datastore.NewQuery(OBJECT_STATE_KIND).Filter("UpdatedAt <", t).KeysOnly().Limit(OBJECT_STATE_DELETE_BATCH)
+		keys, err := q.GetAll(s.ctx, nil)
+		if err != nil {
+			log.Errorf(s.ctx, "ObjectStateService.DeleteBefore(%v) [%T]%v\n", t, err, err)
+			return deleted, err
+		}
+		if len(keys) == 0 {
+			return deleted, nil
+		}
+		err = datastore.DeleteMulti(s.ctx, keys)
+		if err != nil {
+			log.Errorf(s.ctx, "ObjectStateService.DeleteBefore(%v) [%T]%v\n", t, err, err)
+			return deleted, err
+		}
+		deleted += len(keys)
+		if len(keys) < OBJECT_STATE_DELETE_BATCH {
+			return deleted, nil
+		}
+	}
+}
+
+// cleanupObjectStates is requested by the cron job in cron.yaml.
+// It deletes the expired ObjectStates of all the tenants.
+func (h *handler) cleanupObjectStates(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	tenants, err := (&TenantService{ctx}).All()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	before := time.Now().Add(-OBJECT_STATE_TTL)
+	var firstErr error
+	for _, t := range append([]*Tenant{nil}, tenants...) {
+		tctx, err := withTenant(ctx, t)
+		if err == nil {
+			var deleted int
+			deleted, err = (&ObjectStateService{tctx}).DeleteBefore(before)
+			if deleted > 0 {
+				log.Infof(tctx, "Deleted %v object states updated before %v\n", deleted, before)
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return c.String(http.StatusInternalServerError, firstErr.Error())
+	}
+	return c.String(http.StatusOK, "OK")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestObjectStateBefore(t *testing.T) {
+	v := func(generation, metageneration int64, state string) *ObjectState {
+		return &ObjectState{Generation: generation, Metageneration: metageneration, State: state}
+	}
+	assert.True(t, v(1, 2, "exists").Before(v(2, 1, "exists")))
+	assert.True(t, v(2, 1, "exists").Before(v(2, 2, "exists")))
+	assert.True(t, v(2, 2, "exists").Before(v(2, 2, "not_exists")))
+	assert.False(t, v(2, 2, "exists").Before(v(2, 2, "exists")))
+	assert.False(t, v(2, 2, "not_exists").Before(v(2, 2, "exists")))
+	assert.False(t, v(3, 1, "exists").Before(v(2, 5, "not_exists")))
+}
+
+func TestObjectVersionOf(t *testing.T) {
+	v, err := objectVersionOf("gs://bucket1/file", "exists", map[string]interface{}{
+		"generation":     "1487649840178000",
+		"metageneration": "2",
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1487649840178000), v.Generation)
+		assert.Equal(t, int64(2), v.Metageneration)
+		assert.Equal(t, "exists", v.State)
+	}
+
+	_, err = objectVersionOf("gs://bucket1/file", "exists", map[string]interface{}{"generation": "x"})
+	assert.Error(t, err)
+}
+
+func TestObjectStateServiceAdvance(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, OBJECT_STATE_KIND)
+	service := &ObjectStateService{ctx}
+	url := "gs://bucket1/path/to/file"
+	advance := func(generation int64, state string) bool {
+		stale, err := service.Advance(&ObjectState{Url: url, Generation: generation, Metageneration: 1, State: state})
+		assert.NoError(t, err)
+		return stale
+	}
+
+	assert.False(t, advance(2, "exists"))
+	// Retry
+	assert.False(t, advance(2, "exists"))
+	// Overwritten generation comes late
+	assert.True(t, advance(1, "exists"))
+	assert.False(t, advance(2, "not_exists"))
+	assert.True(t, advance(2, "exists"))
+	assert.False(t, advance(3, "exists"))
+
+	// Other objects are independent
+	stale, err := service.Advance(&ObjectState{Url: url + "2", Generation: 1, Metageneration: 1, State: "exists"})
+	assert.NoError(t, err)
+	assert.False(t, stale)
+}
+
+func TestObjectStateServiceIsStale(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, OBJECT_STATE_KIND)
+	service := &ObjectStateService{ctx}
+	url := "gs://bucket1/path/to/file"
+	isStale := func(generation int64) bool {
+		stale, err := service.IsStale(&ObjectState{Url: url, Generation: generation, Metageneration: 1, State: "exists"})
+		assert.NoError(t, err)
+		return stale
+	}
+
+	assert.False(t, isStale(2))
+	// Not recorded until it's published
+	assert.False(t, isStale(1))
+
+	_, err = service.Advance(&ObjectState{Url: url, Generation: 2, Metageneration: 1, State: "exists"})
+	assert.NoError(t, err)
+	assert.True(t, isStale(1))
+	assert.False(t, isStale(2))
+	assert.False(t, isStale(3))
+}
+
+func TestObjectStateServiceDeleteBefore(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, OBJECT_STATE_KIND)
+	service := &ObjectStateService{ctx}
+	now := time.Now()
+	old := &ObjectState{Url: "gs://bucket1/old", Generation: 1, UpdatedAt: now.Add(-OBJECT_STATE_TTL - time.Hour)}
+	_, err = datastore.Put(ctx, service.key(old.Url), old)
+	assert.NoError(t, err)
+	recent := &ObjectState{Url: "gs://bucket1/recent", Generation: 1, UpdatedAt: now}
+	_, err = datastore.Put(ctx, service.key(recent.Url), recent)
+	assert.NoError(t, err)
+
+	deleted, err := service.DeleteBefore(now.Add(-OBJECT_STATE_TTL))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+
+	err = datastore.Get(ctx, service.key(old.Url), &ObjectState{})
+	assert.Equal(t, datastore.ErrNoSuchEntity, err)
+	err = datastore.Get(ctx, service.key(recent.Url), &ObjectState{})
+	assert.NoError(t, err)
+}
+
+func TestAdvanceObjectStateAfterNewerOne(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, OBJECT_STATE_KIND)
+	w := &Watch{ID: "stale-watch1", StaleEvents: STALE_DROP}
+	url := "gs://bucket1/path/to/file"
+	// Both events passed the check and the newer one was published first
+	advanceObjectState(ctx, w, &ObjectState{Url: url, Generation: 3, Metageneration: 1, State: "exists"})
+	advanceObjectState(ctx, w, &ObjectState{Url: url, Generation: 2, Metageneration: 1, State: "exists"})
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, metrics.write(buf))
+	assert.Contains(t, buf.String(), `watch_id="stale-watch1",action="published"} 1`+"\n")
+
+	// The newer version is kept
+	stale, err := (&ObjectStateService{ctx}).IsStale(&ObjectState{Url: url, Generation: 2, Metageneration: 1, State: "exists"})
+	assert.NoError(t, err)
+	assert.True(t, stale)
+}
@@ -7,8 +7,6 @@ import (
 	"io/ioutil"
 
 	"golang.org/x/net/context"
-
-	"google.golang.org/appengine/log"
 )
 
 type (
@@ -20,53 +18,172 @@ type (
 )
 
 func (dp *DefaultProcessor) Run(ctx context.Context, state string, body io.ReadCloser) error {
+	ctx, span := startSpan(ctx, "processor.run")
+	defer span.Finish()
 	notifier, err := NewPubsubNotifier(ctx)
 	if err != nil {
+		span.SetError(err)
 		return err
 	}
-	return dp.execute(ctx, notifier, state, body)
+	err = dp.execute(ctx, notifier, state, body)
+	span.SetError(err)
+	return err
 }
 
+// execute publishes the message of the notification to the topic of the matched Watch.
+// The records of the notification (recordActivity, recordMatch, advanceObjectState
+// and checkMessageNumber of the handler) only log their failures and don't return
+// them not to fail the notification, which OCN retries and publishes again.
 func (dp *DefaultProcessor) execute(ctx context.Context, notifier Notifier, state string, body io.ReadCloser) error {
+	_, readSpan := startSpan(ctx, "processor.read_body")
 	bytes, err := ioutil.ReadAll(body)
 	if err != nil {
+		readSpan.SetError(err)
+		readSpan.Finish()
 		return err
 	}
 
 	var obj map[string]interface{}
 	err = json.Unmarshal(bytes, &obj)
+	readSpan.SetAttribute("bytes", len(bytes))
+	readSpan.SetError(err)
+	readSpan.Finish()
 	if err != nil {
+		eventsTotal.inc("", state, "invalid")
+		loggerOf(ctx).Error(ctx, "Invalid request body", "error", err)
 		return err
 	}
-	log.Infof(ctx, "%v\n", obj)
 
-	bucket, ok := obj["bucket"].(string)
-	if !ok {
-		return fmt.Errorf("bucket must be a string but it was an %T (%v)", obj["bucket"], obj["bucket"])
+	url, err := objectUrl(obj)
+	if err != nil {
+		eventsTotal.inc("", state, "invalid")
+		loggerOf(ctx).Error(ctx, "Invalid object resource", "error", err)
+		return err
 	}
-	name, ok := obj["name"].(string)
-	if !ok {
-		return fmt.Errorf("name must be a string but it was an %T (%v)", obj["name"], obj["name"])
+	bucket := bucketOf(url)
+	label := bucketLabel(ctx, bucket)
+	logger := loggerOf(ctx).With("bucket", bucket, "object", obj["name"], "generation", obj["generation"])
+	ctx = withLogger(ctx, logger)
+	logger.Info(ctx, "Object change received", "content_type", obj["contentType"], "size", obj["size"])
+
+	if t := tenantOf(ctx); t != nil && !t.AllowsBucket(bucket) {
+		logger.Warning(ctx, "Bucket is not allowed for the tenant")
+		eventsTotal.inc(label, state, "not_allowed")
+		return nil
 	}
-	url := "gs://" + bucket + "/" + name
+
+	(&BucketAlertService{ctx}).recordActivity(bucket)
 
 	service := &WatchService{ctx}
-	topic, err := service.topicFor(url)
+	ev, err := service.topicFor(url)
 	if err != nil {
+		eventsTotal.inc(label, state, "error")
 		return err
 	}
-	if topic == "" {
-		log.Infof(ctx, "No topic found for %q", url)
+	if ev == nil {
+		logger.Info(ctx, "No topic found")
+		eventsTotal.inc(label, state, "no_match")
 		return nil
 	}
+	logger = logger.With("watch_id", ev.Watch.ID, "topic", ev.Watch.Topic)
+	ctx = withLogger(ctx, logger)
+
+	n := ev.notification(url, state, obj)
+	var version *ObjectState
+	if ev.Watch.checksStale() {
+		var stale bool
+		version, stale, err = checkStale(ctx, url, state, obj)
+		if err != nil {
+			eventsTotal.inc(label, state, "error")
+			return err
+		}
+		if stale {
+			staleEventsTotal.inc(label, ev.Watch.ID, ev.Watch.StaleEvents)
+			logger.Warning(ctx, "Stale event received", "stale_events", ev.Watch.StaleEvents, "metageneration", obj["metageneration"])
+			if ev.Watch.StaleEvents == STALE_DROP {
+				eventsTotal.inc(label, state, "stale")
+				return nil
+			}
+			n.Stale = true
+		}
+	}
+
+	if ev.Watch.DebounceSeconds > 0 {
+		err = (&DebounceService{ctx}).Add(n)
+		if err != nil {
+			eventsTotal.inc(label, state, "error")
+			return err
+		}
+		logger.Info(ctx, "Event is delayed", "debounce_seconds", ev.Watch.DebounceSeconds)
+		eventsTotal.inc(label, state, "debounced")
+		return nil
+	}
+
+	err = notify(ctx, notifier, state, n)
+	service.recordMatch(ev.Watch, url, err)
+	if err != nil {
+		eventsTotal.inc(label, state, "error")
+		return err
+	}
+	eventsTotal.inc(label, state, "notified")
+	if version != nil {
+		advanceObjectState(ctx, ev.Watch, version)
+	}
+	return nil
+}
 
+// checkStale returns the version of the event and true if it's older than the last one of the object.
+func checkStale(ctx context.Context, url, state string, obj map[string]interface{}) (*ObjectState, bool, error) {
+	v, err := objectVersionOf(url, state, obj)
+	if err != nil {
+		loggerOf(ctx).Error(ctx, "Invalid object resource", "error", err)
+		return nil, false, err
+	}
+	stale, err := (&ObjectStateService{ctx}).IsStale(v)
+	if err != nil {
+		return nil, false, err
+	}
+	return v, stale, nil
+}
+
+// advanceObjectState records the version of the published event.
+// The check before publishing and this are not in a transaction, so an older event
+// processed concurrently can be published after the newer one. It's found here
+// and counted as STALE_PUBLISHED, but the message can't be recalled.
+func advanceObjectState(ctx context.Context, w *Watch, v *ObjectState) {
+	logger := loggerOf(ctx)
+	stale, err := (&ObjectStateService{ctx}).Advance(v)
+	if err != nil {
+		logger.Error(ctx, "Failed to record the object state", "error", err)
+		return
+	}
+	if stale {
+		staleEventsTotal.inc(bucketLabel(ctx, bucketOf(v.Url)), w.ID, STALE_PUBLISHED)
+		logger.Warning(ctx, "Stale event was published", "stale_events", w.StaleEvents, "generation", v.Generation, "metageneration", v.Metageneration)
+	}
+}
+
+// objectUrl builds the gs:// URL from the object resource of an OCN request body.
+func objectUrl(obj map[string]interface{}) (string, error) {
+	bucket, ok := obj["bucket"].(string)
+	if !ok {
+		return "", fmt.Errorf("bucket must be a string but it was an %T (%v)", obj["bucket"], obj["bucket"])
+	}
+	name, ok := obj["name"].(string)
+	if !ok {
+		return "", fmt.Errorf("name must be a string but it was an %T (%v)", obj["name"], obj["name"])
+	}
+	return "gs://" + bucket + "/" + name, nil
+}
+
+// notify calls the notifier method for the given resource state.
+func notify(ctx context.Context, notifier Notifier, state string, n *Notification) error {
 	switch state {
 	case "exists":
-		err = notifier.Updated(ctx, topic, url)
+		return notifier.Updated(ctx, n)
 	case "not_exists":
-		err = notifier.Deleted(ctx, topic, url)
+		return notifier.Deleted(ctx, n)
 	default:
-		err = fmt.Errorf("Unknown state %v is given", state)
+		return fmt.Errorf("Unknown state %v is given", state)
 	}
-	return err
 }
@@ -45,12 +45,12 @@ type (
 	}
 )
 
-func (dn *dummyNotifier) Updated(ctx context.Context, topic, url string) error {
-	dn.updated = append(dn.updated, TopicUrl{topic, url})
+func (dn *dummyNotifier) Updated(ctx context.Context, n *Notification) error {
+	dn.updated = append(dn.updated, TopicUrl{n.Topic, n.Url})
 	return nil
 }
-func (dn *dummyNotifier) Deleted(ctx context.Context, topic, url string) error {
-	dn.deleted = append(dn.deleted, TopicUrl{topic, url})
+func (dn *dummyNotifier) Deleted(ctx context.Context, n *Notification) error {
+	dn.deleted = append(dn.deleted, TopicUrl{n.Topic, n.Url})
 	return nil
 }
 
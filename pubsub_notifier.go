@@ -1,70 +1,163 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
 	"golang.org/x/net/context"
-	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	pubsub "google.golang.org/api/pubsub/v1"
-	"google.golang.org/appengine/log"
 )
 
+// PUBSUB_BASE_URL is the endpoint of the Pub/Sub REST API.
+const PUBSUB_BASE_URL = "https://pubsub.googleapis.com/v1/"
+
 type (
+	// PubsubMessage is the message to publish. pubsub.PubsubMessage of the
+	// google-api-go-client in glide.lock doesn't have OrderingKey, and the newer
+	// client doesn't support Go 1.6 of the App Engine SDK, so the message is
+	// published by the REST API directly.
+	PubsubMessage struct {
+		Data        string            `json:"data,omitempty"`
+		Attributes  map[string]string `json:"attributes,omitempty"`
+		OrderingKey string            `json:"orderingKey,omitempty"`
+	}
+
 	Publisher interface {
-		Publish(topic string, msg *pubsub.PubsubMessage) (*pubsub.PublishResponse, error)
+		Publish(topic string, msg *PubsubMessage) (*pubsub.PublishResponse, error)
 	}
 
 	pubsubPublisher struct {
-		topicsService *pubsub.ProjectsTopicsService
+		client  *http.Client
+		baseURL string
 	}
 
 	PubsubNotifier struct {
 		publisher Publisher
+		// instrumented records the metrics of publishing. Dry runs are not recorded.
+		instrumented bool
 	}
 )
 
-func (pp *pubsubPublisher) Publish(topic string, msg *pubsub.PubsubMessage) (*pubsub.PublishResponse, error) {
-	req := &pubsub.PublishRequest{
-		Messages: []*pubsub.PubsubMessage{msg},
+// newPubsubPublisher creates a Publisher with the application default credentials.
+func newPubsubPublisher(ctx context.Context) (Publisher, error) {
+	client, err := newPubsubClient(ctx)
+	if err != nil {
+		return nil, err
 	}
-	return pp.topicsService.Publish(topic, req).Do()
+	return &pubsubPublisher{client, PUBSUB_BASE_URL}, nil
 }
 
-func NewPubsubNotifier(ctx context.Context) (Notifier, error) {
-	// https://github.com/google/google-api-go-client#application-default-credentials-example
-	client, err := google.DefaultClient(ctx, pubsub.PubsubScope)
+// Publish calls projects.topics.publish of the REST API.
+// https://cloud.google.com/pubsub/docs/reference/rest/v1/projects.topics/publish
+func (pp *pubsubPublisher) Publish(topic string, msg *PubsubMessage) (*pubsub.PublishResponse, error) {
+	body, err := json.Marshal(map[string][]*PubsubMessage{"messages": {msg}})
+	if err != nil {
+		return nil, err
+	}
+	res, err := pp.client.Post(pp.baseURL+topic+":publish", "application/json", bytes.NewReader(body))
 	if err != nil {
-		log.Errorf(ctx, "Failed to create DefaultClient\n")
 		return nil, err
 	}
+	defer res.Body.Close()
+	err = googleapi.CheckResponse(res)
+	if err != nil {
+		return nil, err
+	}
+	ret := &pubsub.PublishResponse{}
+	err = json.NewDecoder(res.Body).Decode(ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
 
-	// Creates a pubsubClient
-	service, err := pubsub.New(client)
+func NewPubsubNotifier(ctx context.Context) (Notifier, error) {
+	publisher, err := newPubsubPublisher(ctx)
 	if err != nil {
-		log.Errorf(ctx, "Failed to create pubsub.Service with %v: %v\n", client)
 		return nil, err
 	}
 
-	notifier := PubsubNotifier{&pubsubPublisher{service.Projects.Topics}}
+	notifier := PubsubNotifier{publisher, true}
 	return &notifier, nil
 }
 
-func (n *PubsubNotifier) Updated(ctx context.Context, topic, url string) error {
-	log.Debugf(ctx, "PubsubNotifier#Updated topic: %v url: %v\n", topic, url)
+// RESERVED_ATTRIBUTES are the attribute names which PubsubNotifier sets by itself.
+var RESERVED_ATTRIBUTES = []string{
+	"download_files",
+	TRACEPARENT,
+	STALE_ATTRIBUTE,
+}
+
+// isReservedAttribute returns true if the name can't be used as a custom attribute.
+// Pub/Sub reserves the names starting with "goog".
+func isReservedAttribute(name string) bool {
+	if strings.HasPrefix(strings.ToLower(name), "goog") {
+		return true
+	}
+	for _, reserved := range RESERVED_ATTRIBUTES {
+		if name == reserved {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *PubsubNotifier) Updated(ctx context.Context, notification *Notification) error {
+	topic, url := notification.Topic, notification.Url
+	logger := loggerOf(ctx)
+	logger.Debug(ctx, "PubsubNotifier#Updated", "topic", topic, "url", url)
 
 	// https://github.com/google/google-api-go-client/blob/master/examples/pubsub.go#L236-L244
-	msg := &pubsub.PubsubMessage{
-		Attributes: map[string]string{
-			"download_files": url,
-		},
-	}
-	log.Debugf(ctx, "PubsubNotifier#Updated before Publish %v to %v\n", msg, topic)
-	if _, err := n.publisher.Publish(topic, msg); err != nil {
-		log.Errorf(ctx, "Failed to publish the update message of %v cause of %v\n", url, err)
+	msg, err := buildMessage(notification)
+	if err != nil {
+		logger.Error(ctx, "Failed to build the update message", "topic", topic, "error", err)
+		n.observe(notification, "invalid_message", time.Time{})
 		return err
 	}
+	ctx, span := startSpan(ctx, "pubsub.publish")
+	defer span.Finish()
+	span.SetAttribute("topic", topic)
+	if traceparent := span.Traceparent(); traceparent != "" {
+		msg.Attributes[TRACEPARENT] = traceparent
+	}
+	start := time.Now()
+	res, err := n.publisher.Publish(topic, msg)
+	span.SetError(err)
+	if err != nil {
+		logger.Error(ctx, "Failed to publish the update message", "topic", topic, "error", err, "latency_ms", latencyMillis(start))
+		n.observe(notification, "error", start)
+		return err
+	}
+	n.observe(notification, "success", start)
+	messageID := ""
+	if res != nil && len(res.MessageIds) > 0 {
+		messageID = res.MessageIds[0]
+	}
+	span.SetAttribute("message_id", messageID)
+	logger.Info(ctx, "Published the update message", "topic", topic, "message_id", messageID, "latency_ms", latencyMillis(start))
 
 	return nil
 }
 
-func (n *PubsubNotifier) Deleted(ctx context.Context, topic, url string) error {
+// observe records the outcome of publishing. The duration is recorded unless start is zero.
+func (n *PubsubNotifier) observe(notification *Notification, outcome string, start time.Time) {
+	if !n.instrumented {
+		return
+	}
+	watchID := ""
+	if notification.Watch != nil {
+		watchID = notification.Watch.ID
+	}
+	publishTotal.inc(notification.Topic, watchID, outcome)
+	if !start.IsZero() {
+		publishDuration.since(start, notification.Topic, outcome)
+	}
+}
+
+func (n *PubsubNotifier) Deleted(ctx context.Context, notification *Notification) error {
 	return nil
 }
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -10,11 +13,11 @@ import (
 
 type (
 	dummyPublisher struct {
-		messages []*pubsub.PubsubMessage
+		messages []*PubsubMessage
 	}
 )
 
-func (dp *dummyPublisher) Publish(topic string, msg *pubsub.PubsubMessage) (*pubsub.PublishResponse, error) {
+func (dp *dummyPublisher) Publish(topic string, msg *PubsubMessage) (*pubsub.PublishResponse, error) {
 	dp.messages = append(dp.messages, msg)
 	return &pubsub.PublishResponse{}, nil
 }
@@ -27,11 +30,11 @@ func TestNotifierFileUpdated(t *testing.T) {
 	}
 	defer done()
 
-	publisher := &dummyPublisher{[]*pubsub.PubsubMessage{}}
-	notifier := &PubsubNotifier{publisher}
+	publisher := &dummyPublisher{[]*PubsubMessage{}}
+	notifier := &PubsubNotifier{publisher: publisher}
 
 	url := "gs://test-bucket01/path/to/file"
-	err = notifier.Updated(ctx, "topic", url)
+	err = notifier.Updated(ctx, &Notification{Topic: "topic", Url: url})
 	assert.NoError(t, err)
 	assert.Equal(t, 1, len(publisher.messages))
 
@@ -39,4 +42,73 @@ func TestNotifierFileUpdated(t *testing.T) {
 	assert.Equal(t, map[string]string{
 		"download_files": url,
 	}, msg.Attributes)
+
+	// With captures
+	publisher.messages = []*PubsubMessage{}
+	url = "gs://test-bucket01/tenant=acme/date=2017-02-20/x.csv"
+	err = notifier.Updated(ctx, &Notification{
+		Topic: "topic",
+		Url:   url,
+		Captures: map[string]string{
+			"tenant": "acme",
+			"date":   "2017-02-20",
+		},
+	})
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(publisher.messages)) {
+		assert.Equal(t, map[string]string{
+			"download_files": url,
+			"tenant":         "acme",
+			"date":           "2017-02-20",
+		}, publisher.messages[0].Attributes)
+	}
+}
+
+func TestIsReservedAttribute(t *testing.T) {
+	assert.True(t, isReservedAttribute("download_files"))
+	assert.True(t, isReservedAttribute("googclient_foo"))
+	assert.True(t, isReservedAttribute("Goog"))
+	assert.False(t, isReservedAttribute("tenant"))
+}
+
+func TestPubsubPublisherPublish(t *testing.T) {
+	var path string
+	var req map[string][]map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"messageIds":["1"]}`))
+	}))
+	defer server.Close()
+
+	publisher := &pubsubPublisher{http.DefaultClient, server.URL + "/v1/"}
+	msg := &PubsubMessage{Attributes: map[string]string{"foo": "bar"}, OrderingKey: "bucket1/file1"}
+	res, err := publisher.Publish("projects/proj1/topics/topic1", msg)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"1"}, res.MessageIds)
+	}
+	assert.Equal(t, "/v1/projects/proj1/topics/topic1:publish", path)
+	if assert.Equal(t, 1, len(req["messages"])) {
+		assert.Equal(t, "bucket1/file1", req["messages"][0]["orderingKey"])
+		assert.Equal(t, map[string]interface{}{"foo": "bar"}, req["messages"][0]["attributes"])
+	}
+
+	// Without ordering key
+	msg.OrderingKey = ""
+	_, err = publisher.Publish("projects/proj1/topics/topic1", msg)
+	assert.NoError(t, err)
+	_, ok := req["messages"][0]["orderingKey"]
+	assert.False(t, ok)
+}
+
+func TestPubsubPublisherPublishError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":{"code":404,"message":"Resource not found"}}`, http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	publisher := &pubsubPublisher{http.DefaultClient, server.URL + "/v1/"}
+	_, err := publisher.Publish("projects/proj1/topics/unknown", &PubsubMessage{})
+	assert.Error(t, err)
 }
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	storage "google.golang.org/api/storage/v1"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// The resync of a bucket processes the objects updated since the given time
+// as "exists" notifications. It's requested when a gap of the message numbers
+// is detected. Only the objects under the prefixes which the watches of the
+// bucket can match are listed, and a ResyncJob is started for each prefix.
+// Each task processes a page of the objects and saves the page token of the
+// next page in the ResyncJob, so a retried task restarts from the checkpoint.
+// The objects which were notified already are notified again.
+
+// ResyncJob is the progress of the resync of the objects under a prefix.
+type ResyncJob struct {
+	Bucket     string
+	Prefix     string
+	Since      time.Time
+	PageToken  string `datastore:",noindex"` // of the next page
+	Pages      int    // processed pages
+	Objects    int    // processed objects updated since Since
+	StartedAt  time.Time
+	UpdatedAt  time.Time
+	FinishedAt time.Time
+}
+
+const (
+	RESYNC_PATH      = "/tasks/resync"
+	RESYNC_JOB_KIND  = "ResyncJobs"
+	RESYNC_PAGE_SIZE = 100
+
+	// The resync starts this duration before the last message not to miss the objects updated meanwhile.
+	RESYNC_MARGIN = time.Minute
+)
+
+func resyncOnGap() bool {
+	return os.Getenv("RESYNC_ON_GAP") == "true"
+}
+
+// resyncPrefix returns the prefix of the object names which the Watch can match in the bucket.
+// It returns false if the Watch can't match any object in the bucket.
+func (w *Watch) resyncPrefix(bucket string) (string, bool) {
+	if w.Bucket != "" && w.Bucket != bucket {
+		return "", false
+	}
+	var urlPrefix string
+	switch w.PatternType {
+	case PATTERN_PREFIX:
+		urlPrefix = w.Pattern
+	case PATTERN_GLOB:
+		if i := strings.IndexAny(w.Pattern, "*?"); i >= 0 {
+			urlPrefix = w.Pattern[:i]
+		} else {
+			urlPrefix = w.Pattern
+		}
+	case "", PATTERN_REGEXP:
+		urlPrefix = regexpPrefix(w.Pattern)
+	}
+	base := "gs://" + bucket + "/"
+	switch {
+	case strings.HasPrefix(urlPrefix, base):
+		return urlPrefix[len(base):], true
+	case strings.HasPrefix(base, urlPrefix):
+		return "", true
+	default:
+		return "", false
+	}
+}
+
+// regexpPrefix returns the literal prefix of the regexp anchored at the beginning of the URL.
+// It returns blank if the regexp isn't anchored.
+func regexpPrefix(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil || re.Op != syntax.OpConcat || len(re.Sub) == 0 || re.Sub[0].Op != syntax.OpBeginText {
+		return ""
+	}
+	res := ""
+	for _, sub := range re.Sub[1:] {
+		if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+			break
+		}
+		res += string(sub.Rune)
+	}
+	return res
+}
+
+// resyncPrefixes returns the prefixes to resync the bucket for the watches.
+// The prefixes under another prefix are omitted.
+func resyncPrefixes(watches Watches, bucket string) []string {
+	prefixes := []string{}
+	for _, w := range watches {
+		if prefix, ok := w.resyncPrefix(bucket); ok {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	res := []string{}
+	for _, prefix := range prefixes {
+		if len(res) > 0 && strings.HasPrefix(prefix, res[len(res)-1]) {
+			continue
+		}
+		res = append(res, prefix)
+	}
+	return res
+}
+
+// startResync starts the jobs to resync the objects of the bucket updated since
+// in the tenant of the context. Nothing is started if no Watch can match the objects.
+func startResync(ctx context.Context, bucket string, since time.Time) ([]*datastore.Key, error) {
+	watches, err := (&WatchService{ctx}).ForBucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	keys := []*datastore.Key{}
+	for _, prefix := range resyncPrefixes(watches, bucket) {
+		now := time.Now()
+		job := &ResyncJob{Bucket: bucket, Prefix: prefix, Since: since, StartedAt: now, UpdatedAt: now}
+		var key *datastore.Key
+		err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+			var err error
+			key, err = datastore.Put(tc, datastore.NewIncompleteKey(tc, RESYNC_JOB_KIND, nil), job)
+			if err != nil {
+				return err
+			}
+			return enqueueResync(tc, key, 0)
+		}, nil)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// enqueueResync adds the task to process the page of the ResyncJob in the tenant of the context.
+func enqueueResync(ctx context.Context, key *datastore.Key, page int) error {
+	params := url.Values{
+		"job":  {key.Encode()},
+		"page": {strconv.Itoa(page)},
+	}
+	if t := tenantOf(ctx); t != nil {
+		params.Set("tenant", t.Name)
+	}
+	_, err := taskqueue.Add(ctx, taskqueue.NewPOSTTask(RESYNC_PATH, params), "")
+	return err
+}
+
+// updatedSince returns true if the object is updated at or after since.
+func updatedSince(obj *storage.Object, since time.Time) bool {
+	updated, err := time.Parse(time.RFC3339Nano, obj.Updated)
+	if err != nil {
+		return true
+	}
+	return !updated.Before(since)
+}
+
+// resync processes a page of the ResyncJob. It returns 500 to retry the task
+// from the same page if any object fails. The task of a processed page is
+// ignored not to process the following pages twice.
+func (h *handler) resync(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	logger := newLogger().With("job", c.FormValue("job"), "page", c.FormValue("page"))
+	ctx = withLogger(ctx, logger)
+	key, err := datastore.DecodeKey(c.FormValue("job"))
+	if err != nil {
+		// The task is dropped since it can't succeed by retries
+		logger.Error(ctx, "Invalid resync task", "error", err)
+		return c.String(http.StatusOK, "Invalid task")
+	}
+	page, err := strconv.Atoi(c.FormValue("page"))
+	if err != nil {
+		logger.Error(ctx, "Invalid resync task", "error", err)
+		return c.String(http.StatusOK, "Invalid task")
+	}
+	if name := c.FormValue("tenant"); name != "" {
+		logger = logger.With("tenant", name)
+		ctx = withLogger(ctx, logger)
+	}
+	tctx, err := withTenantNamed(ctx, c.FormValue("tenant"))
+	if err != nil {
+		logger.Error(ctx, "Failed to find tenant", "error", err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	ctx = tctx
+
+	job := ResyncJob{}
+	err = datastore.Get(ctx, key, &job)
+	if err == datastore.ErrNoSuchEntity {
+		logger.Warning(ctx, "Resync job not found")
+		return c.String(http.StatusOK, "Job not found")
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	if job.Pages != page || !job.FinishedAt.IsZero() {
+		logger.Info(ctx, "Resync page was processed already", "pages", job.Pages)
+		return c.String(http.StatusOK, "Processed already")
+	}
+	logger = logger.With("bucket", job.Bucket, "prefix", job.Prefix)
+	ctx = withLogger(ctx, logger)
+
+	client, err := google.DefaultClient(ctx, storage.DevstorageReadOnlyScope)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	service, err := storage.New(client)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	call := service.Objects.List(job.Bucket).MaxResults(RESYNC_PAGE_SIZE)
+	if job.Prefix != "" {
+		call = call.Prefix(job.Prefix)
+	}
+	if job.PageToken != "" {
+		call = call.PageToken(job.PageToken)
+	}
+	objects, err := call.Do()
+	if err != nil {
+		logger.Error(ctx, "Failed to list objects", "error", err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	label := bucketLabel(ctx, job.Bucket)
+	processed, failed := 0, 0
+	for _, obj := range objects.Items {
+		if !updatedSince(obj, job.Since) {
+			continue
+		}
+		err := h.resyncObject(ctx, obj)
+		resyncObjectsTotal.inc(label, outcomeOf(err))
+		if err != nil {
+			logger.Error(ctx, "Failed to resync object", "object", obj.Name, "error", err)
+			failed++
+		}
+		processed++
+	}
+	if failed > 0 {
+		return c.String(http.StatusInternalServerError, "Failed to resync objects")
+	}
+
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		current := ResyncJob{}
+		err := datastore.Get(tc, key, &current)
+		if err != nil {
+			return err
+		}
+		if current.Pages != page {
+			return nil
+		}
+		current.PageToken = objects.NextPageToken
+		current.Pages++
+		current.Objects += processed
+		current.UpdatedAt = time.Now()
+		if objects.NextPageToken == "" {
+			current.FinishedAt = current.UpdatedAt
+		}
+		_, err = datastore.Put(tc, key, &current)
+		if err != nil {
+			return err
+		}
+		if objects.NextPageToken == "" {
+			return nil
+		}
+		return enqueueResync(tc, key, current.Pages)
+	}, nil)
+	if err != nil {
+		logger.Error(ctx, "Failed to save the resync checkpoint", "error", err)
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	logger.Info(ctx, "Resync page processed", "objects", len(objects.Items), "processed", processed)
+	return c.String(http.StatusOK, "OK")
+}
+
+// resyncObject processes the object as the body of an "exists" notification.
+func (h *handler) resyncObject(ctx context.Context, obj *storage.Object) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return h.processor.Run(ctx, "exists", ioutil.NopCloser(bytes.NewReader(b)))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestRegexpPrefix(t *testing.T) {
+	patterns := map[string]string{
+		`\Ags://bucket1/dir1/`:                     "gs://bucket1/dir1/",
+		`^gs://bucket1/dir1/.*\.csv`:               "gs://bucket1/dir1/",
+		`\Ags://bucket1/(?P<tenant>[^/]+)/`:        "gs://bucket1/",
+		`\Ags://bucket1/dir\.1/`:                   "gs://bucket1/dir.1/",
+		`(?i)\Ags://bucket1/dir1/`:                 "",
+		`\.csv\z`:                                  "",
+		`gs://bucket1/dir1/`:                       "",
+		`\Ags://bucket1/(?P<dir>dir1|dir2)/x\.csv`: "gs://bucket1/",
+		`(`: "",
+	}
+	for pattern, expected := range patterns {
+		assert.Equal(t, expected, regexpPrefix(pattern), pattern)
+	}
+}
+
+func TestResyncPrefixes(t *testing.T) {
+	watches := Watches{
+		{Pattern: `\Ags://bucket1/dir1/sub/`},
+		{Pattern: `\Ags://bucket1/dir1/`},
+		{PatternType: PATTERN_GLOB, Pattern: `gs://bucket1/dir2/**/*.csv`},
+		{PatternType: PATTERN_PREFIX, Pattern: `gs://bucket1/dir3/file`},
+		{Bucket: "bucket2", Pattern: `\.csv\z`},
+		{Pattern: `\Ags://bucket2/`},
+	}
+	assert.Equal(t, []string{"dir1/", "dir2/", "dir3/file"}, resyncPrefixes(watches, "bucket1"))
+
+	// The whole bucket for the unanchored pattern
+	assert.Equal(t, []string{""}, resyncPrefixes(watches, "bucket2"))
+
+	// Patterns which match the bucket name partially
+	watches = Watches{
+		{PatternType: PATTERN_PREFIX, Pattern: `gs://bucket`},
+		{Pattern: `\Ags://bucket10/`},
+	}
+	assert.Equal(t, []string{""}, resyncPrefixes(watches, "bucket1"))
+	assert.Equal(t, []string{}, resyncPrefixes(Watches{{Pattern: `\Ags://bucket10/`}}, "bucket1"))
+	assert.Equal(t, []string{""}, resyncPrefixes(Watches{{PatternType: PATTERN_SUFFIX, Pattern: `.csv`}}, "bucket1"))
+}
+
+func TestStartResync(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, WATCH_KIND)
+
+	service := &WatchService{ctx}
+	for i, ptn := range []string{`\Ags://bucket1/dir1/`, `\Ags://bucket1/dir2/`} {
+		w := &Watch{Seq: i + 1, Pattern: ptn, Topic: "projects/dummy-proj-999/topics/foo"}
+		assert.NoError(t, service.Create(w))
+	}
+	retryWith(10, func() func() {
+		watches, err := service.ForBucket("bucket1")
+		if err != nil || len(watches) != 2 {
+			return func() { t.Fatalf("Expected 2 watches but got %v, %v", watches, err) }
+		}
+		return nil
+	})
+
+	since := time.Now().Add(-time.Hour)
+	keys, err := startResync(ctx, "bucket1", since)
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(keys)) {
+		prefixes := []string{}
+		for _, key := range keys {
+			job := ResyncJob{}
+			assert.NoError(t, datastore.Get(ctx, key, &job))
+			assert.Equal(t, "bucket1", job.Bucket)
+			assert.True(t, job.Since.Equal(since))
+			assert.Equal(t, 0, job.Pages)
+			assert.True(t, job.FinishedAt.IsZero())
+			prefixes = append(prefixes, job.Prefix)
+		}
+		assert.Equal(t, []string{"dir1/", "dir2/"}, prefixes)
+	}
+
+	// No Watch matches the bucket
+	keys, err = startResync(ctx, "bucket2", since)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// Role is the role of a Google account on the admin pages.
+// Roles are stored in the namespace of each tenant, so a user can have
+// different roles for different tenants.
+type Role struct {
+	Email string `form:"email" json:"email" datastore:"-"` // from key
+	Role  string `form:"role" json:"role"`
+}
+
+const (
+	ROLE_KIND = "Roles"
+
+	ROLE_VIEWER = "viewer" // can see watches and use the rule tester
+	ROLE_EDITOR = "editor" // can also create, update, delete and reorder watches
+	ROLE_OWNER  = "owner"  // can also manage roles
+)
+
+var (
+	ROLES = []string{ROLE_VIEWER, ROLE_EDITOR, ROLE_OWNER}
+)
+
+type ForbiddenError struct {
+	msg string
+}
+
+func (e *ForbiddenError) Error() string {
+	return e.msg
+}
+
+func roleLevel(role string) int {
+	for i, r := range ROLES {
+		if r == role {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// hasRole returns true if role is required or a stronger one.
+func hasRole(role, required string) bool {
+	return roleLevel(role) > 0 && roleLevel(role) >= roleLevel(required)
+}
+
+func (r *Role) Validate() error {
+	if !strings.Contains(r.Email, "@") {
+		return &ValidationError{fmt.Sprintf("Invalid email: %v", r.Email)}
+	}
+	if roleLevel(r.Role) == 0 {
+		return &ValidationError{fmt.Sprintf("Invalid role: %v", r.Role)}
+	}
+	return nil
+}
+
+type RoleService struct {
+	ctx context.Context
+}
+
+func (s *RoleService) key(email string) *datastore.Key {
+	return datastore.NewKey(s.ctx, ROLE_KIND, strings.ToLower(email), 0, nil)
+}
+
+func (s *RoleService) All() ([]*Role, error) {
+	res := []*Role{}
+	keys, err := datastore.NewQuery(ROLE_KIND).GetAll(s.ctx, &res)
+	if err != nil {
+		log.Errorf(s.ctx, "RoleService.All [%T]%v\n", err, err)
+		return nil, err
+	}
+	for i, key := range keys {
+		res[i].Email = key.StringID()
+	}
+	sort.Sort(rolesByEmail(res))
+	return res, nil
+}
+
+func (s *RoleService) Find(email string) (*Role, error) {
+	r := Role{}
+	err := datastore.Get(s.ctx, s.key(email), &r)
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+		return nil, &EntityNotFound{err}
+	case err != nil:
+		log.Errorf(s.ctx, "RoleService.Find(%v) [%T]%v\n", email, err, err)
+		return nil, err
+	}
+	r.Email = strings.ToLower(email)
+	return &r, nil
+}
+
+// Save creates or updates the role of the email.
+func (s *RoleService) Save(r *Role) error {
+	r.Email = strings.ToLower(strings.TrimSpace(r.Email))
+	err := r.Validate()
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(s.ctx, s.key(r.Email), r)
+	if err != nil {
+		log.Errorf(s.ctx, "RoleService.Save(%v) [%T]%v\n", r, err, err)
+		return err
+	}
+	return nil
+}
+
+func (s *RoleService) Delete(email string) error {
+	return datastore.Delete(s.ctx, s.key(email))
+}
+
+// Current returns the role of the signed-in user, or "" if the user has no role.
+// App Engine administrators are owners of every namespace.
+func (s *RoleService) Current() (string, error) {
+	u := user.Current(s.ctx)
+	if u == nil {
+		return "", nil
+	}
+	if u.Admin {
+		return ROLE_OWNER, nil
+	}
+	r, err := s.Find(u.Email)
+	switch err.(type) {
+	case nil:
+		return r.Role, nil
+	case *EntityNotFound:
+		return "", nil
+	default:
+		return "", err
+	}
+}
+
+// authorize returns ForbiddenError unless the signed-in user has the role.
+func (s *RoleService) authorize(required string) error {
+	role, err := s.Current()
+	if err != nil {
+		return err
+	}
+	if !hasRole(role, required) {
+		email := ""
+		if u := user.Current(s.ctx); u != nil {
+			email = u.Email
+		}
+		return &ForbiddenError{fmt.Sprintf("%v role is required for %v", required, email)}
+	}
+	return nil
+}
+
+type rolesByEmail []*Role
+
+func (r rolesByEmail) Len() int {
+	return len(r)
+}
+
+func (r rolesByEmail) Less(i, j int) bool {
+	return r[i].Email < r[j].Email
+}
+
+func (r rolesByEmail) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/user"
+)
+
+func TestHasRole(t *testing.T) {
+	assert.True(t, hasRole(ROLE_OWNER, ROLE_VIEWER))
+	assert.True(t, hasRole(ROLE_OWNER, ROLE_OWNER))
+	assert.True(t, hasRole(ROLE_EDITOR, ROLE_EDITOR))
+	assert.False(t, hasRole(ROLE_VIEWER, ROLE_EDITOR))
+	assert.False(t, hasRole(ROLE_EDITOR, ROLE_OWNER))
+	assert.False(t, hasRole("", ROLE_VIEWER))
+	assert.False(t, hasRole("unknown", ROLE_VIEWER))
+
+	assert.NoError(t, (&Role{Email: "foo@example.com", Role: ROLE_EDITOR}).Validate())
+	assert.Error(t, (&Role{Email: "foo", Role: ROLE_EDITOR}).Validate())
+	assert.Error(t, (&Role{Email: "foo@example.com", Role: "admin"}).Validate())
+}
+
+func TestRoleServiceCurrent(t *testing.T) {
+	inst, err := aetest.NewInstance(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Close()
+
+	newContext := func(u *user.User) *RoleService {
+		req, err := inst.NewRequest("GET", "/admin/watches", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u != nil {
+			aetest.Login(u, req)
+		}
+		return &RoleService{appengine.NewContext(req)}
+	}
+
+	service := newContext(nil)
+	ClearDatastore(t, service.ctx, ROLE_KIND)
+	assert.NoError(t, service.Save(&Role{Email: " Editor@example.com", Role: ROLE_EDITOR}))
+
+	// Not signed in
+	role, err := service.Current()
+	assert.NoError(t, err)
+	assert.Equal(t, "", role)
+
+	// The email is case insensitive
+	service = newContext(&user.User{Email: "editor@EXAMPLE.com"})
+	role, err = service.Current()
+	assert.NoError(t, err)
+	assert.Equal(t, ROLE_EDITOR, role)
+	assert.NoError(t, service.authorize(ROLE_VIEWER))
+	assert.IsType(t, &ForbiddenError{}, service.authorize(ROLE_OWNER))
+
+	// No role
+	service = newContext(&user.User{Email: "other@example.com"})
+	assert.IsType(t, &ForbiddenError{}, service.authorize(ROLE_VIEWER))
+
+	// App Engine administrator
+	service = newContext(&user.User{Email: "admin@example.com", Admin: true})
+	role, err = service.Current()
+	assert.NoError(t, err)
+	assert.Equal(t, ROLE_OWNER, role)
+
+	// Roles are separated by tenant
+	tctx, err := withTenant(service.ctx, &Tenant{Name: "team1"})
+	if assert.NoError(t, err) {
+		_, err = (&RoleService{tctx}).Find("editor@example.com")
+		assert.IsType(t, &EntityNotFound{}, err)
+	}
+}
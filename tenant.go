@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// Tenant is a team which shares the watcher deployment.
+// The watches and the other entities of a tenant are stored in the Datastore
+// namespace of its name. The Tenant itself is stored in the default namespace.
+type Tenant struct {
+	Name          string   `form:"name" json:"name" datastore:"-"` // from key
+	Buckets       []string `form:"-" json:"buckets"`               // buckets whose notifications are accepted
+	TopicProjects []string `form:"-" json:"topic_projects"`        // projects of topics which watches can publish to
+}
+
+const (
+	TENANT_KIND = "Tenants"
+)
+
+var (
+	// Datastore namespace must match this
+	TENANT_NAME_REGEXP = regexp.MustCompile(`\A[0-9A-Za-z._-]{1,100}\z`)
+)
+
+func (t *Tenant) Validate() error {
+	if !TENANT_NAME_REGEXP.MatchString(t.Name) {
+		return &ValidationError{fmt.Sprintf("Invalid tenant name: %v", t.Name)}
+	}
+	for _, bucket := range t.Buckets {
+		if !BUCKET_REGEXP.MatchString(bucket) {
+			return &ValidationError{fmt.Sprintf("Invalid bucket: %v", bucket)}
+		}
+	}
+	return nil
+}
+
+// AllowsBucket returns true if the tenant accepts the notifications of the bucket.
+func (t *Tenant) AllowsBucket(bucket string) bool {
+	for _, b := range t.Buckets {
+		if b == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsTopic returns true if the tenant can publish messages to the topic.
+func (t *Tenant) AllowsTopic(topic string) bool {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 2 {
+		return false
+	}
+	for _, p := range t.TopicProjects {
+		if p == parts[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// BucketsText returns the buckets for the form.
+func (t *Tenant) BucketsText() string {
+	return strings.Join(t.Buckets, "\n")
+}
+
+// TopicProjectsText returns the topic projects for the form.
+func (t *Tenant) TopicProjectsText() string {
+	return strings.Join(t.TopicProjects, "\n")
+}
+
+// splitLines returns the non-blank lines of s trimmed.
+func splitLines(s string) []string {
+	res := []string{}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
+type tenantKey struct{}
+
+// withTenant returns the context in the namespace of the tenant.
+// It returns ctx in the default namespace if t is nil.
+func withTenant(ctx context.Context, t *Tenant) (context.Context, error) {
+	if t == nil {
+		return appengine.Namespace(ctx, "")
+	}
+	nsCtx, err := appengine.Namespace(ctx, t.Name)
+	if err != nil {
+		return nil, err
+	}
+	return context.WithValue(nsCtx, tenantKey{}, t), nil
+}
+
+// withTenantNamed returns the context of the tenant of the name.
+// It's used for the tasks which are given the tenant name. It returns ctx if name is blank.
+func withTenantNamed(ctx context.Context, name string) (context.Context, error) {
+	if name == "" {
+		return ctx, nil
+	}
+	t, err := (&TenantService{ctx}).Find(name)
+	if err != nil {
+		return nil, err
+	}
+	return withTenant(ctx, t)
+}
+
+// tenantOf returns the tenant of the context or nil for the default namespace.
+func tenantOf(ctx context.Context) *Tenant {
+	t, _ := ctx.Value(tenantKey{}).(*Tenant)
+	return t
+}
+
+// validateTenant returns ValidationError if the Watch is out of the tenant of the context.
+func validateTenant(ctx context.Context, w *Watch) error {
+	t := tenantOf(ctx)
+	if t == nil {
+		return nil
+	}
+	if w.Bucket != "" && !t.AllowsBucket(w.Bucket) {
+		return &ValidationError{fmt.Sprintf("Bucket %v is not allowed for tenant %v", w.Bucket, t.Name)}
+	}
+	if !t.AllowsTopic(w.Topic) {
+		return &ValidationError{fmt.Sprintf("Topic %v is not allowed for tenant %v", w.Topic, t.Name)}
+	}
+	return nil
+}
+
+// TenantService stores tenants in the default namespace whatever the namespace of ctx is.
+type TenantService struct {
+	ctx context.Context
+}
+
+func (s *TenantService) rootContext() (context.Context, error) {
+	return appengine.Namespace(s.ctx, "")
+}
+
+func (s *TenantService) All() ([]*Tenant, error) {
+	ctx, err := s.rootContext()
+	if err != nil {
+		return nil, err
+	}
+	res := []*Tenant{}
+	keys, err := datastore.NewQuery(TENANT_KIND).GetAll(ctx, &res)
+	if err != nil {
+		log.Errorf(s.ctx, "TenantService.All [%T]%v\n", err, err)
+		return nil, err
+	}
+	for i, key := range keys {
+		res[i].Name = key.StringID()
+	}
+	sort.Sort(tenantsByName(res))
+	return res, nil
+}
+
+func (s *TenantService) Find(name string) (*Tenant, error) {
+	ctx, err := s.rootContext()
+	if err != nil {
+		return nil, err
+	}
+	if !TENANT_NAME_REGEXP.MatchString(name) {
+		return nil, &EntityNotFound{fmt.Errorf("Invalid tenant name: %v", name)}
+	}
+	t := Tenant{}
+	err = datastore.Get(ctx, datastore.NewKey(ctx, TENANT_KIND, name, 0, nil), &t)
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+		return nil, &EntityNotFound{err}
+	case err != nil:
+		log.Errorf(s.ctx, "TenantService.Find(%v) [%T]%v\n", name, err, err)
+		return nil, err
+	}
+	t.Name = name
+	return &t, nil
+}
+
+// Save creates or updates the tenant.
+func (s *TenantService) Save(t *Tenant) error {
+	err := t.Validate()
+	if err != nil {
+		return err
+	}
+	ctx, err := s.rootContext()
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(ctx, datastore.NewKey(ctx, TENANT_KIND, t.Name, 0, nil), t)
+	if err != nil {
+		log.Errorf(s.ctx, "TenantService.Save(%v) [%T]%v\n", t, err, err)
+		return err
+	}
+	return nil
+}
+
+// Delete deletes the tenant. The entities in its namespace are kept.
+func (s *TenantService) Delete(name string) error {
+	ctx, err := s.rootContext()
+	if err != nil {
+		return err
+	}
+	return datastore.Delete(ctx, datastore.NewKey(ctx, TENANT_KIND, name, 0, nil))
+}
+
+type tenantsByName []*Tenant
+
+func (t tenantsByName) Len() int {
+	return len(t)
+}
+
+func (t tenantsByName) Less(i, j int) bool {
+	return t[i].Name < t[j].Name
+}
+
+func (t tenantsByName) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+}
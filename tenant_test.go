@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestTenantAllows(t *testing.T) {
+	tenant := &Tenant{
+		Name:          "team1",
+		Buckets:       []string{"bucket1", "bucket2"},
+		TopicProjects: []string{"proj1"},
+	}
+	assert.True(t, tenant.AllowsBucket("bucket1"))
+	assert.True(t, tenant.AllowsBucket("bucket2"))
+	assert.False(t, tenant.AllowsBucket("bucket3"))
+	assert.False(t, tenant.AllowsBucket(""))
+
+	assert.True(t, tenant.AllowsTopic("projects/proj1/topics/topic1"))
+	assert.False(t, tenant.AllowsTopic("projects/proj2/topics/topic1"))
+	assert.False(t, tenant.AllowsTopic("proj1"))
+
+	assert.NoError(t, tenant.Validate())
+	assert.Error(t, (&Tenant{Name: ""}).Validate())
+	assert.Error(t, (&Tenant{Name: "team/1"}).Validate())
+	assert.Error(t, (&Tenant{Name: "team1", Buckets: []string{"Invalid Bucket"}}).Validate())
+
+	assert.Equal(t, []string{"a", "b"}, splitLines(" a\r\n\nb \n"))
+}
+
+func TestTenantWatches(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, TENANT_KIND)
+	tenants := &TenantService{ctx}
+	tenant := &Tenant{
+		Name:          "team1",
+		Buckets:       []string{"bucket1"},
+		TopicProjects: []string{"proj1"},
+	}
+	assert.NoError(t, tenants.Save(tenant))
+
+	found, err := tenants.Find("team1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, tenant, found)
+	}
+	_, err = tenants.Find("unknown")
+	assert.IsType(t, &EntityNotFound{}, err)
+
+	tctx, err := withTenant(ctx, found)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "team1", datastore.NewKey(tctx, WATCH_KIND, "", 1, nil).Namespace())
+	assert.Equal(t, found, tenantOf(tctx))
+	assert.Nil(t, tenantOf(ctx))
+
+	// Tenants are always stored in the default namespace
+	found, err = (&TenantService{tctx}).Find("team1")
+	assert.NoError(t, err)
+
+	service := &WatchService{tctx}
+	w := &Watch{Seq: 1, Bucket: "bucket1", Pattern: `\.csv\z`, Topic: "projects/proj1/topics/topic1"}
+	assert.NoError(t, service.Create(w))
+
+	err = service.Create(&Watch{Seq: 2, Bucket: "bucket2", Pattern: `\.csv\z`, Topic: "projects/proj1/topics/topic1"})
+	if assert.Error(t, err) {
+		assert.Regexp(t, "Bucket bucket2 is not allowed", err.Error())
+	}
+	err = service.Create(&Watch{Seq: 3, Pattern: `\.csv\z`, Topic: "projects/proj2/topics/topic1"})
+	if assert.Error(t, err) {
+		assert.Regexp(t, "Topic .* is not allowed", err.Error())
+	}
+
+	// The watch of the tenant can't be found in the default namespace
+	_, err = (&WatchService{ctx}).Find(w.ID)
+	assert.IsType(t, &EntityNotFound{}, err)
+	found2, err := service.Find(w.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, w.Pattern, found2.Pattern)
+	}
+}
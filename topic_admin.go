@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	pubsub "google.golang.org/api/pubsub/v1"
+	"google.golang.org/appengine/log"
+)
+
+// TOPIC_PUBLISH_PERMISSION is the permission which the service account needs to publish.
+const TOPIC_PUBLISH_PERMISSION = "pubsub.topics.publish"
+
+var (
+	SUBSCRIPTION_REGEXP      = regexp.MustCompile(`\Aprojects/[^/]+/subscriptions/[^/]+\z`)
+	SUBSCRIPTION_NAME_REGEXP = regexp.MustCompile(`\A[A-Za-z][-_.~+%A-Za-z0-9]{2,254}\z`)
+)
+
+type (
+	// TopicAdmin checks and creates the topics which watches publish messages to.
+	TopicAdmin interface {
+		// CheckTopic returns ValidationError if the topic doesn't exist or
+		// the service account isn't allowed to publish to it.
+		CheckTopic(topic string) error
+		// CreateTopic creates the topic. It does nothing if the topic already exists.
+		CreateTopic(topic string) error
+		// CreateSubscription creates the pull subscription of the topic.
+		CreateSubscription(subscription, topic string) error
+	}
+
+	pubsubTopicAdmin struct {
+		topicsService        *pubsub.ProjectsTopicsService
+		subscriptionsService *pubsub.ProjectsSubscriptionsService
+	}
+
+	// DestinationOptions are the options to create the destination of a new Watch.
+	DestinationOptions struct {
+		CreateTopic  bool   `form:"create_topic" json:"create_topic"`
+		Subscription string `form:"subscription" json:"subscription"` // name or full path of the pull subscription to create
+	}
+
+	// Destination is a topic and the watches which publish to it.
+	Destination struct {
+		Topic   string  `json:"topic"`
+		Watches Watches `json:"watches"`
+		Error   string  `json:"error,omitempty"`
+	}
+)
+
+// newPubsubClient creates an HTTP client with the application default credentials for Pub/Sub.
+func newPubsubClient(ctx context.Context) (*http.Client, error) {
+	// https://github.com/google/google-api-go-client#application-default-credentials-example
+	client, err := google.DefaultClient(ctx, pubsub.PubsubScope)
+	if err != nil {
+		log.Errorf(ctx, "Failed to create DefaultClient\n")
+		return nil, err
+	}
+	return client, nil
+}
+
+// newPubsubService creates a Pub/Sub service with the application default credentials.
+func newPubsubService(ctx context.Context) (*pubsub.Service, error) {
+	client, err := newPubsubClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Creates a pubsubClient
+	service, err := pubsub.New(client)
+	if err != nil {
+		log.Errorf(ctx, "Failed to create pubsub.Service with %v: %v\n", client, err)
+		return nil, err
+	}
+	return service, nil
+}
+
+func NewPubsubTopicAdmin(ctx context.Context) (TopicAdmin, error) {
+	service, err := newPubsubService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &pubsubTopicAdmin{service.Projects.Topics, service.Projects.Subscriptions}, nil
+}
+
+func (a *pubsubTopicAdmin) CreateTopic(topic string) error {
+	_, err := a.topicsService.Create(topic, &pubsub.Topic{}).Do()
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusConflict {
+		return nil
+	}
+	if err != nil {
+		return topicCheckError(topic, err)
+	}
+	return nil
+}
+
+func (a *pubsubTopicAdmin) CreateSubscription(subscription, topic string) error {
+	_, err := a.subscriptionsService.Create(subscription, &pubsub.Subscription{Topic: topic}).Do()
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusConflict {
+		return &ValidationError{fmt.Sprintf("Subscription already exists: %v", subscription)}
+	}
+	if err != nil {
+		return topicCheckError(topic, err)
+	}
+	return nil
+}
+
+func (a *pubsubTopicAdmin) CheckTopic(topic string) error {
+	_, err := a.topicsService.Get(topic).Do()
+	if err != nil {
+		return topicCheckError(topic, err)
+	}
+	req := &pubsub.TestIamPermissionsRequest{
+		Permissions: []string{TOPIC_PUBLISH_PERMISSION},
+	}
+	res, err := a.topicsService.TestIamPermissions(topic, req).Do()
+	if err != nil {
+		return topicCheckError(topic, err)
+	}
+	for _, p := range res.Permissions {
+		if p == TOPIC_PUBLISH_PERMISSION {
+			return nil
+		}
+	}
+	return &ValidationError{fmt.Sprintf("Not allowed to publish to topic %v", topic)}
+}
+
+// topicCheckError converts the errors of the Pub/Sub API which the user can fix into ValidationError.
+func topicCheckError(topic string, err error) error {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		return err
+	}
+	switch apiErr.Code {
+	case http.StatusNotFound:
+		return &ValidationError{fmt.Sprintf("Topic not found: %v", topic)}
+	case http.StatusForbidden:
+		return &ValidationError{fmt.Sprintf("Not allowed to access topic %v", topic)}
+	default:
+		return err
+	}
+}
+
+// subscriptionPath returns the full path of the subscription.
+// A subscription name without project is in the project of the topic.
+func (o *DestinationOptions) subscriptionPath(topic string) (string, error) {
+	if SUBSCRIPTION_REGEXP.MatchString(o.Subscription) {
+		return o.Subscription, nil
+	}
+	if !SUBSCRIPTION_NAME_REGEXP.MatchString(o.Subscription) || strings.HasPrefix(strings.ToLower(o.Subscription), "goog") {
+		return "", &ValidationError{fmt.Sprintf("Invalid subscription: %v", o.Subscription)}
+	}
+	project := strings.Split(topic, "/")[1]
+	return fmt.Sprintf("projects/%v/subscriptions/%v", project, o.Subscription), nil
+}
+
+// createDestination creates the topic and the subscription given by the options.
+func createDestination(admin TopicAdmin, topic string, opts *DestinationOptions) error {
+	var subscription string
+	if opts.Subscription != "" {
+		var err error
+		subscription, err = opts.subscriptionPath(topic)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.CreateTopic {
+		err := admin.CreateTopic(topic)
+		if err != nil {
+			return err
+		}
+	}
+	if subscription != "" {
+		return admin.CreateSubscription(subscription, topic)
+	}
+	return nil
+}
+
+// checkDestinations checks the topic of each Destination of the watches.
+func checkDestinations(admin TopicAdmin, watches Watches) []*Destination {
+	destinations := map[string]*Destination{}
+	for _, w := range watches {
+		d, ok := destinations[w.Topic]
+		if !ok {
+			d = &Destination{Topic: w.Topic, Watches: Watches{}}
+			destinations[w.Topic] = d
+		}
+		d.Watches = append(d.Watches, w)
+	}
+	res := []*Destination{}
+	for _, d := range destinations {
+		err := admin.CheckTopic(d.Topic)
+		if err != nil {
+			d.Error = err.Error()
+		}
+		res = append(res, d)
+	}
+	sort.Sort(destinationsByTopic(res))
+	return res
+}
+
+type destinationsByTopic []*Destination
+
+func (d destinationsByTopic) Len() int {
+	return len(d)
+}
+
+func (d destinationsByTopic) Less(i, j int) bool {
+	return d[i].Topic < d[j].Topic
+}
+
+func (d destinationsByTopic) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+}
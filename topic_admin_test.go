@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+)
+
+// fakeTopicAdmin returns the error for the topic or the subscription,
+// and records the created topics and subscriptions.
+type fakeTopicAdmin struct {
+	errors        map[string]error
+	checked       []string
+	topics        []string
+	subscriptions map[string]string
+}
+
+func (a *fakeTopicAdmin) CheckTopic(topic string) error {
+	a.checked = append(a.checked, topic)
+	return a.errors[topic]
+}
+
+func (a *fakeTopicAdmin) CreateTopic(topic string) error {
+	if err := a.errors[topic]; err != nil {
+		return err
+	}
+	a.topics = append(a.topics, topic)
+	return nil
+}
+
+func (a *fakeTopicAdmin) CreateSubscription(subscription, topic string) error {
+	if err := a.errors[subscription]; err != nil {
+		return err
+	}
+	if a.subscriptions == nil {
+		a.subscriptions = map[string]string{}
+	}
+	a.subscriptions[subscription] = topic
+	return nil
+}
+
+func TestTopicCheckError(t *testing.T) {
+	topic := "projects/dummy-proj-999/topics/topic1"
+	err := topicCheckError(topic, &googleapi.Error{Code: http.StatusNotFound})
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(t, "Topic not found: "+topic, err.Error())
+	}
+	err = topicCheckError(topic, &googleapi.Error{Code: http.StatusForbidden})
+	assert.IsType(t, &ValidationError{}, err)
+	err = topicCheckError(topic, &googleapi.Error{Code: http.StatusInternalServerError})
+	assert.IsType(t, &googleapi.Error{}, err)
+	err = topicCheckError(topic, errors.New("connection refused"))
+	assert.Equal(t, "connection refused", err.Error())
+}
+
+func TestCheckDestinations(t *testing.T) {
+	topic1 := "projects/dummy-proj-999/topics/topic1"
+	topic2 := "projects/dummy-proj-999/topics/topic2"
+	admin := &fakeTopicAdmin{
+		errors: map[string]error{
+			topic2: &ValidationError{fmt.Sprintf("Topic not found: %v", topic2)},
+		},
+	}
+	watches := Watches{
+		&Watch{ID: "1", Seq: 1, Topic: topic2},
+		&Watch{ID: "2", Seq: 2, Topic: topic1},
+		&Watch{ID: "3", Seq: 3, Topic: topic2},
+	}
+	res := checkDestinations(admin, watches)
+	if assert.Equal(t, 2, len(res)) {
+		assert.Equal(t, topic1, res[0].Topic)
+		assert.Equal(t, "", res[0].Error)
+		assert.Equal(t, Watches{watches[1]}, res[0].Watches)
+		assert.Equal(t, topic2, res[1].Topic)
+		assert.Equal(t, "Topic not found: "+topic2, res[1].Error)
+		assert.Equal(t, Watches{watches[0], watches[2]}, res[1].Watches)
+	}
+	// Each topic is checked once
+	assert.Equal(t, 2, len(admin.checked))
+}
+
+func TestAdminHandlerCheckTopic(t *testing.T) {
+	topic1 := "projects/dummy-proj-999/topics/topic1"
+	topic2 := "projects/dummy-proj-999/topics/topic2"
+	admin := &fakeTopicAdmin{
+		errors: map[string]error{
+			topic2: &ValidationError{"Not allowed to publish to topic " + topic2},
+		},
+	}
+	h := &adminHandler{
+		topicAdmin: func(ctx context.Context) (TopicAdmin, error) {
+			return admin, nil
+		},
+	}
+	ctx := context.Background()
+
+	// Disabled
+	assert.NoError(t, h.checkTopic(ctx, &Watch{Topic: topic2}))
+	assert.Empty(t, admin.checked)
+
+	h.checkTopics = true
+	assert.NoError(t, h.checkTopic(ctx, &Watch{Topic: topic1}))
+	assert.IsType(t, &ValidationError{}, h.checkTopic(ctx, &Watch{Topic: topic2}))
+	// Invalid topic isn't sent to Pub/Sub
+	assert.NoError(t, h.checkTopic(ctx, &Watch{Topic: "topic1"}))
+	assert.Equal(t, []string{topic1, topic2}, admin.checked)
+}
+
+func TestCreateDestination(t *testing.T) {
+	topic1 := "projects/dummy-proj-999/topics/topic1"
+	sub1 := "projects/dummy-proj-999/subscriptions/sub1"
+	admin := &fakeTopicAdmin{
+		errors: map[string]error{
+			"projects/other-proj/subscriptions/sub2": &ValidationError{"Subscription already exists"},
+		},
+	}
+
+	// Nothing to create
+	assert.NoError(t, createDestination(admin, topic1, &DestinationOptions{}))
+	assert.Empty(t, admin.topics)
+	assert.Empty(t, admin.subscriptions)
+
+	// Subscription name is in the project of the topic
+	assert.NoError(t, createDestination(admin, topic1, &DestinationOptions{CreateTopic: true, Subscription: "sub1"}))
+	assert.Equal(t, []string{topic1}, admin.topics)
+	assert.Equal(t, map[string]string{sub1: topic1}, admin.subscriptions)
+
+	// Full path of the subscription
+	err := createDestination(admin, topic1, &DestinationOptions{Subscription: "projects/other-proj/subscriptions/sub2"})
+	assert.IsType(t, &ValidationError{}, err)
+
+	// Invalid subscription names are rejected before creating the topic
+	for _, name := range []string{"s", "1sub", "goog-sub", "projects/dummy-proj-999/topics/sub"} {
+		err = createDestination(admin, topic1, &DestinationOptions{CreateTopic: true, Subscription: name})
+		assert.IsType(t, &ValidationError{}, err, name)
+	}
+	assert.Equal(t, []string{topic1}, admin.topics)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// A minimal tracer which propagates the W3C Trace Context: a Span has a trace
+// ID, its own ID and its parent's ID, and it's given to the SpanExporter when
+// finished. The trace context is propagated by the traceparent header and the
+// traceparent attribute of Pub/Sub messages.
+//
+// This is not OpenTelemetry. The OpenTelemetry Go API requires Go 1.13 or later,
+// but the go1 runtime of App Engine standard environment is older. The spans
+// can be exported by an exporter registered by RegisterSpanExporter.
+//
+//	ctx, span := startSpan(ctx, "matcher.compile")
+//	defer span.Finish()
+//
+// startSpan returns a nil Span, whose methods do nothing, if the context has no Tracer.
+
+type (
+	Tracer struct {
+		exporter SpanExporter
+	}
+
+	Span struct {
+		TraceID    string
+		SpanID     string
+		ParentID   string
+		Name       string
+		Start      time.Time
+		End        time.Time
+		Attributes map[string]interface{}
+		Error      string
+
+		ctx    context.Context
+		tracer *Tracer
+		mu     sync.Mutex
+	}
+
+	SpanExporter interface {
+		ExportSpan(ctx context.Context, span *Span)
+	}
+
+	// InMemoryExporter keeps the finished spans. It's used in tests.
+	InMemoryExporter struct {
+		mu    sync.Mutex
+		spans []*Span
+	}
+
+	// logExporter writes the finished spans to the log.
+	logExporter struct{}
+
+	tracerKey struct{}
+	spanKey   struct{}
+)
+
+const TRACEPARENT = "traceparent"
+
+var (
+	TRACEPARENT_REGEXP         = regexp.MustCompile(`\A00-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}\z`)
+	CLOUD_TRACE_CONTEXT_REGEXP = regexp.MustCompile(`\A([0-9a-f]{32})/([0-9]+)`)
+)
+
+// spanExporters are the factories of the exporters by TRACE_EXPORTER name.
+var spanExporters = map[string]func() SpanExporter{
+	"log": func() SpanExporter { return &logExporter{} },
+}
+
+// RegisterSpanExporter adds an exporter which is used if TRACE_EXPORTER is the name.
+// It must be called in init before defaultTracer is used.
+func RegisterSpanExporter(name string, factory func() SpanExporter) {
+	spanExporters[name] = factory
+	defaultTracer = tracerFromEnv()
+}
+
+// defaultTracer is used for the notification requests. It propagates the
+// trace context even if TRACE_EXPORTER isn't set, but exports nothing then.
+var defaultTracer = tracerFromEnv()
+
+func tracerFromEnv() *Tracer {
+	if factory, ok := spanExporters[os.Getenv("TRACE_EXPORTER")]; ok {
+		return &Tracer{exporter: factory()}
+	}
+	return &Tracer{}
+}
+
+// withTracer returns the context which starts spans with the Tracer.
+func withTracer(ctx context.Context, t *Tracer) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+func tracerOf(ctx context.Context) *Tracer {
+	t, _ := ctx.Value(tracerKey{}).(*Tracer)
+	return t
+}
+
+func spanOf(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// withRemoteParent returns the context whose spans are the children of the
+// span given by the traceparent or X-Cloud-Trace-Context header value.
+func withRemoteParent(ctx context.Context, traceparent, cloudTraceContext string) context.Context {
+	if m := TRACEPARENT_REGEXP.FindStringSubmatch(traceparent); m != nil && !isZeroID(m[1]) && !isZeroID(m[2]) {
+		return context.WithValue(ctx, spanKey{}, &Span{TraceID: m[1], SpanID: m[2]})
+	}
+	if m := CLOUD_TRACE_CONTEXT_REGEXP.FindStringSubmatch(cloudTraceContext); m != nil {
+		spanID, err := strconv.ParseUint(m[2], 10, 64)
+		if err == nil && spanID != 0 {
+			return context.WithValue(ctx, spanKey{}, &Span{TraceID: m[1], SpanID: fmt.Sprintf("%016x", spanID)})
+		}
+	}
+	return ctx
+}
+
+func isZeroID(id string) bool {
+	return strings.Trim(id, "0") == ""
+}
+
+// startSpan starts a Span as a child of the span of the context.
+func startSpan(ctx context.Context, name string) (context.Context, *Span) {
+	t := tracerOf(ctx)
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{
+		SpanID:     newTraceID(8),
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: map[string]interface{}{},
+		tracer:     t,
+	}
+	if parent := spanOf(ctx); parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+	} else {
+		s.TraceID = newTraceID(16)
+	}
+	s.ctx = context.WithValue(ctx, spanKey{}, s)
+	return s.ctx, s
+}
+
+func newTraceID(size int) string {
+	b := make([]byte, size)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = map[string]interface{}{}
+	}
+	s.Attributes[key] = value
+}
+
+// SetError records the error if err isn't nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = err.Error()
+}
+
+// Finish ends the Span and exports it.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.End = time.Now()
+	s.mu.Unlock()
+	if s.tracer.exporter != nil {
+		s.tracer.exporter.ExportSpan(s.ctx, s)
+	}
+}
+
+// Traceparent returns the W3C traceparent header value of the Span.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+func (s *Span) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+func (e *InMemoryExporter) ExportSpan(ctx context.Context, span *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns the finished spans in the order of finish.
+func (e *InMemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*Span{}, e.spans...)
+}
+
+// SpanNamed returns the first finished Span with the name or nil.
+func (e *InMemoryExporter) SpanNamed(name string) *Span {
+	for _, s := range e.Spans() {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (e *logExporter) ExportSpan(ctx context.Context, span *Span) {
+	keyValues := []interface{}{
+		"trace_id", span.TraceID,
+		"span_id", span.SpanID,
+		"parent_span_id", span.ParentID,
+		"span", span.Name,
+		"duration_ms", float64(span.Duration()) / float64(time.Millisecond),
+		"attributes", span.Attributes,
+	}
+	if span.Error != "" {
+		keyValues = append(keyValues, "error", span.Error)
+	}
+	loggerOf(ctx).Info(ctx, "Span finished", keyValues...)
+}
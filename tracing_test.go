@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestStartSpan(t *testing.T) {
+	exporter := &InMemoryExporter{}
+	ctx := withTracer(context.Background(), &Tracer{exporter: exporter})
+
+	ctx, root := startSpan(ctx, "ocn.request")
+	_, child := startSpan(ctx, "processor.run")
+	child.SetAttribute("bucket", "bucket1")
+	child.SetError(errors.New("failure"))
+	child.Finish()
+	root.Finish()
+
+	assert.Equal(t, 2, len(exporter.Spans()))
+	assert.Equal(t, "processor.run", exporter.Spans()[0].Name)
+	assert.Equal(t, 32, len(root.TraceID))
+	assert.Equal(t, 16, len(root.SpanID))
+	assert.Equal(t, "", root.ParentID)
+	assert.Equal(t, root.TraceID, child.TraceID)
+	assert.Equal(t, root.SpanID, child.ParentID)
+	assert.Equal(t, "bucket1", child.Attributes["bucket"])
+	assert.Equal(t, "failure", child.Error)
+	assert.Equal(t, "00-"+child.TraceID+"-"+child.SpanID+"-01", child.Traceparent())
+	assert.Nil(t, exporter.SpanNamed("unknown"))
+}
+
+func TestStartSpanWithoutTracer(t *testing.T) {
+	ctx, span := startSpan(context.Background(), "ocn.request")
+	assert.Nil(t, span)
+	assert.Nil(t, spanOf(ctx))
+
+	// The methods of nil Span do nothing
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("failure"))
+	span.Finish()
+	assert.Equal(t, "", span.Traceparent())
+}
+
+func TestWithRemoteParent(t *testing.T) {
+	exporter := &InMemoryExporter{}
+	ctx := withTracer(context.Background(), &Tracer{exporter: exporter})
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	// traceparent
+	_, span := startSpan(withRemoteParent(ctx, "00-"+traceID+"-00f067aa0ba902b7-01", ""), "ocn.request")
+	assert.Equal(t, traceID, span.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", span.ParentID)
+
+	// X-Cloud-Trace-Context
+	_, span = startSpan(withRemoteParent(ctx, "", traceID+"/255;o=1"), "ocn.request")
+	assert.Equal(t, traceID, span.TraceID)
+	assert.Equal(t, "00000000000000ff", span.ParentID)
+
+	// Invalid values
+	invalids := []string{
+		"",
+		"00-" + traceID + "-0000000000000000-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"01-" + traceID,
+	}
+	for _, v := range invalids {
+		_, span = startSpan(withRemoteParent(ctx, v, ""), "ocn.request")
+		assert.NotEqual(t, traceID, span.TraceID, v)
+		assert.Equal(t, "", span.ParentID, v)
+	}
+}
+
+func TestTracerFromEnv(t *testing.T) {
+	defer os.Setenv("TRACE_EXPORTER", os.Getenv("TRACE_EXPORTER"))
+	original := defaultTracer
+	defer func() {
+		delete(spanExporters, "memory")
+		defaultTracer = original
+	}()
+
+	// The trace context is propagated without exporter
+	os.Setenv("TRACE_EXPORTER", "")
+	tracer := tracerFromEnv()
+	if assert.NotNil(t, tracer) {
+		assert.Nil(t, tracer.exporter)
+	}
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	ctx := withRemoteParent(withTracer(context.Background(), tracer), "00-"+traceID+"-00f067aa0ba902b7-01", "")
+	_, span := startSpan(ctx, "pubsub.publish")
+	assert.Regexp(t, "\\A00-"+traceID+"-[0-9a-f]{16}-01\\z", span.Traceparent())
+	span.Finish()
+
+	os.Setenv("TRACE_EXPORTER", "log")
+	assert.IsType(t, &logExporter{}, tracerFromEnv().exporter)
+
+	// Registered exporter
+	exporter := &InMemoryExporter{}
+	os.Setenv("TRACE_EXPORTER", "memory")
+	RegisterSpanExporter("memory", func() SpanExporter { return exporter })
+	_, span = startSpan(withTracer(context.Background(), defaultTracer), "ocn.request")
+	span.Finish()
+	assert.NotNil(t, exporter.SpanNamed("ocn.request"))
+}
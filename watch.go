@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"regexp"
 	"sort"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
@@ -18,6 +19,24 @@ func (e *EntityNotFound) Error() string {
 	return e.cause.Error()
 }
 
+// ConflictError means the Watch was updated by someone else after it was loaded.
+type ConflictError struct {
+	msg string
+}
+
+func (e *ConflictError) Error() string {
+	return e.msg
+}
+
+// ignoreFieldMismatch ignores the properties saved by older versions,
+// such as the ID of watches which is taken from the key.
+func ignoreFieldMismatch(err error) error {
+	if _, ok := err.(*datastore.ErrFieldMismatch); ok {
+		return nil
+	}
+	return err
+}
+
 type ValidationError struct {
 	msg string
 }
@@ -27,35 +46,174 @@ func (e *ValidationError) Error() string {
 }
 
 type Watch struct {
-	ID      string `form:"-",datastore:"-"` // from key
-	Seq     int    `form:"seq"`
-	Pattern string `form:"pattern"`
-	Topic   string `form:"topic"`
+	ID          string `form:"-" json:"id" datastore:"-"` // from key
+	Version     int    `form:"version" json:"version"`    // incremented by every update
+	Seq         int    `form:"seq" json:"seq"`
+	Bucket      string `form:"bucket" json:"bucket"`             // matches files in any bucket if blank
+	PatternType string `form:"pattern_type" json:"pattern_type"` // PATTERN_REGEXP if blank
+	Pattern     string `form:"pattern" json:"pattern"`
+	Topic       string `form:"topic" json:"topic"`
+
+	// Schedule. The zero values mean the Watch is always active.
+	Disabled    bool      `form:"-" json:"disabled"`
+	ActiveFrom  time.Time `form:"-" json:"active_from"`
+	ActiveUntil time.Time `form:"-" json:"active_until"`
+
+	// Message templates. See message_template.go
+	AttributesTemplate string `form:"attributes_template" json:"attributes_template" datastore:",noindex"`
+	DataTemplate       string `form:"data_template" json:"data_template" datastore:",noindex"`
+
+	// Ordering. The message is published without ordering key if OrderingKeyTemplate is blank.
+	// See object_state.go for StaleEvents.
+	OrderingKeyTemplate string `form:"ordering_key_template" json:"ordering_key_template" datastore:",noindex"`
+	StaleEvents         string `form:"stale_events" json:"stale_events"` // STALE_PUBLISH if blank
+
+	// Debounce. The events are published soon if it's 0. See debounce.go
+	DebounceSeconds int `form:"debounce_seconds" json:"debounce_seconds"`
 }
 
+const (
+	PATTERN_REGEXP = "regexp"
+	PATTERN_GLOB   = "glob"
+	PATTERN_PREFIX = "prefix"
+	PATTERN_SUFFIX = "suffix"
+)
+
+const (
+	STALE_PUBLISH = "publish" // publishes stale events without checking
+	STALE_FLAG    = "flag"    // publishes stale events with the stale attribute
+	STALE_DROP    = "drop"    // doesn't publish stale events
+)
+
 var (
-	TOPIC_REGEXP = regexp.MustCompile(`\Aprojects/[^/]+/topics/[^/]+\z`)
+	TOPIC_REGEXP  = regexp.MustCompile(`\Aprojects/[^/]+/topics/[^/]+\z`)
+	BUCKET_REGEXP = regexp.MustCompile(`\A[a-z0-9][-_.a-z0-9]{1,220}[a-z0-9]\z`)
+
+	PATTERN_TYPES = []string{PATTERN_REGEXP, PATTERN_GLOB, PATTERN_PREFIX, PATTERN_SUFFIX}
+	STALE_EVENTS  = []string{STALE_PUBLISH, STALE_FLAG, STALE_DROP}
 )
 
 func (w *Watch) Validate() error {
-	_, err := regexp.Compile(w.Pattern)
+	if w.Bucket != "" && !BUCKET_REGEXP.MatchString(w.Bucket) {
+		return &ValidationError{fmt.Sprintf("Invalid bucket: %v", w.Bucket)}
+	}
+	_, err := w.compile()
 	if err != nil {
 		return &ValidationError{fmt.Sprintf("Invalid pattern: %v cause of %v", w.Pattern, err)}
 	}
+	for _, name := range w.captureNames() {
+		if isReservedAttribute(name) {
+			return &ValidationError{fmt.Sprintf("Invalid pattern: %v cause of reserved attribute name %q", w.Pattern, name)}
+		}
+	}
 	if !TOPIC_REGEXP.MatchString(w.Topic) {
 		return &ValidationError{fmt.Sprintf("Invalid topic: %v", w.Topic)}
 	}
-	return nil
+	if !w.ActiveFrom.IsZero() && !w.ActiveUntil.IsZero() && !w.ActiveFrom.Before(w.ActiveUntil) {
+		return &ValidationError{fmt.Sprintf("Active from %v must be before active until %v", w.ActiveFrom, w.ActiveUntil)}
+	}
+	if w.StaleEvents != "" && w.StaleEvents != STALE_PUBLISH && w.StaleEvents != STALE_FLAG && w.StaleEvents != STALE_DROP {
+		return &ValidationError{fmt.Sprintf("Invalid stale events: %v", w.StaleEvents)}
+	}
+	if w.DebounceSeconds < 0 || w.DebounceSeconds > MAX_DEBOUNCE_SECONDS {
+		return &ValidationError{fmt.Sprintf("Debounce seconds must be between 0 and %d: %v", MAX_DEBOUNCE_SECONDS, w.DebounceSeconds)}
+	}
+	return w.validateTemplates()
+}
+
+// ActiveAt returns true if the Watch is enabled and t is in its schedule.
+func (w *Watch) ActiveAt(t time.Time) bool {
+	if w.Disabled {
+		return false
+	}
+	if !w.ActiveFrom.IsZero() && t.Before(w.ActiveFrom) {
+		return false
+	}
+	if !w.ActiveUntil.IsZero() && !t.Before(w.ActiveUntil) {
+		return false
+	}
+	return true
+}
+
+// ActiveFromValue returns ActiveFrom for the form.
+func (w *Watch) ActiveFromValue() string {
+	return formTime(w.ActiveFrom)
+}
+
+// ActiveUntilValue returns ActiveUntil for the form.
+func (w *Watch) ActiveUntilValue() string {
+	return formTime(w.ActiveUntil)
+}
+
+func formTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(FORM_TIME_LAYOUT)
+}
+
+// StaleEventsName returns StaleEvents including the default.
+func (w *Watch) StaleEventsName() string {
+	if w.StaleEvents == "" {
+		return STALE_PUBLISH
+	}
+	return w.StaleEvents
+}
+
+// checksStale returns true if the events of the Watch are checked with ObjectState.
+func (w *Watch) checksStale() bool {
+	return w.StaleEventsName() != STALE_PUBLISH
+}
+
+// PatternTypeName returns the pattern type including the default.
+func (w *Watch) PatternTypeName() string {
+	if w.PatternType == "" {
+		return PATTERN_REGEXP
+	}
+	return w.PatternType
 }
 
 type Watches []*Watch
 
+// BucketWatches is a group of watches for a bucket.
+// Bucket is blank for the watches matching files in any bucket.
+type BucketWatches struct {
+	Bucket  string
+	Watches Watches
+}
+
+// GroupByBucket groups the watches by bucket keeping the order of each group.
+// The group without bucket comes first and the others are sorted by bucket name.
+func (w Watches) GroupByBucket() []*BucketWatches {
+	groups := map[string]*BucketWatches{}
+	names := []string{}
+	for _, watch := range w {
+		g, ok := groups[watch.Bucket]
+		if !ok {
+			g = &BucketWatches{Bucket: watch.Bucket, Watches: Watches{}}
+			groups[watch.Bucket] = g
+			names = append(names, watch.Bucket)
+		}
+		g.Watches = append(g.Watches, watch)
+	}
+	sort.Strings(names)
+	res := []*BucketWatches{}
+	for _, name := range names {
+		res = append(res, groups[name])
+	}
+	return res
+}
+
 func (w Watches) Len() int {
 	return len(w)
 }
 
+// Less compares Seq and then ID not to depend on the order of query results.
 func (w Watches) Less(i, j int) bool {
-	return w[i].Seq < w[j].Seq
+	if w[i].Seq != w[j].Seq {
+		return w[i].Seq < w[j].Seq
+	}
+	return w[i].ID < w[j].ID
 }
 
 func (w Watches) Swap(i, j int) {
@@ -75,6 +233,23 @@ func (s *WatchService) All() (Watches, error) {
 	return s.AllWith(q)
 }
 
+// ForBucket returns the watches for the bucket and the ones without bucket in Seq order.
+// They're filtered in memory since the watches saved before Bucket was added
+// don't have the property and equality filters can't find them.
+func (s *WatchService) ForBucket(bucket string) (Watches, error) {
+	watches, err := s.All()
+	if err != nil {
+		return nil, err
+	}
+	res := Watches{}
+	for _, w := range watches {
+		if w.Bucket == "" || w.Bucket == bucket {
+			res = append(res, w)
+		}
+	}
+	return res, nil
+}
+
 func (s *WatchService) AllWith(q *datastore.Query) (Watches, error) {
 	log.Debugf(s.ctx, "AllWith #0\n")
 	iter := q.Run(s.ctx)
@@ -83,6 +258,7 @@ func (s *WatchService) AllWith(q *datastore.Query) (Watches, error) {
 	for {
 		obj := Watch{}
 		key, err := iter.Next(&obj)
+		err = ignoreFieldMismatch(err)
 		if err == datastore.Done {
 			break
 		}
@@ -93,24 +269,37 @@ func (s *WatchService) AllWith(q *datastore.Query) (Watches, error) {
 		obj.ID = key.Encode()
 		res = append(res, &obj)
 	}
-	sort.Sort(res)
+	sort.Stable(res)
 	log.Debugf(s.ctx, "AllWith => %v\n", res)
 	for i, w := range res {
-		log.Debugf(s.ctx, "AllWith %v: %v, %v, %v\n", i, w.Seq, w.Pattern, w.Topic)
+		log.Debugf(s.ctx, "AllWith %v: %v, %v, %v, %v\n", i, w.Seq, w.Bucket, w.Pattern, w.Topic)
 	}
 	return res, nil
 }
 
+// decodeKey decodes the id of a Watch. It returns EntityNotFound if the key
+// is in another namespace not to touch the watches of other tenants.
+func (s *WatchService) decodeKey(id string) (*datastore.Key, error) {
+	key, err := datastore.DecodeKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if key.Namespace() != datastore.NewIncompleteKey(s.ctx, WATCH_KIND, nil).Namespace() {
+		return nil, &EntityNotFound{fmt.Errorf("Watch not found for id: %v", id)}
+	}
+	return key, nil
+}
+
 func (s *WatchService) Find(id string) (*Watch, error) {
 	log.Debugf(s.ctx, "WatchService.Find(%v)\n", id)
-	key, err := datastore.DecodeKey(id)
+	key, err := s.decodeKey(id)
 	if err != nil {
 		log.Errorf(s.ctx, "WatchService.Find(%v) [%T]%v\n", id, err, err)
 		return nil, err
 	}
 	log.Debugf(s.ctx, "WatchService.Find(%v) key: %v\n", id, key)
 	obj := Watch{}
-	err = datastore.Get(s.ctx, key, &obj)
+	err = ignoreFieldMismatch(datastore.Get(s.ctx, key, &obj))
 	switch {
 	case err == datastore.ErrNoSuchEntity:
 		return nil, &EntityNotFound{err}
@@ -127,60 +316,155 @@ func (s *WatchService) Create(w *Watch) error {
 	if err != nil {
 		return err
 	}
-	key := datastore.NewIncompleteKey(s.ctx, WATCH_KIND, nil)
-	res, err := datastore.Put(s.ctx, key, w)
+	err = validateTenant(s.ctx, w)
+	if err != nil {
+		return err
+	}
+	low, _, err := datastore.AllocateIDs(s.ctx, WATCH_KIND, nil, 1)
+	if err != nil {
+		log.Errorf(s.ctx, "WatchService.Create(%v) [%T]%v\n", w, err, err)
+		return err
+	}
+	key := datastore.NewKey(s.ctx, WATCH_KIND, "", low, nil)
+	err = datastore.RunInTransaction(s.ctx, func(tc context.Context) error {
+		err := s.updateSeqs(tc, func(ws *WatchSeqs) error { return ws.reserve(key.Encode(), w.Seq) })
+		if err != nil {
+			return err
+		}
+		_, err = datastore.Put(tc, key, w)
+		if err != nil {
+			return err
+		}
+		return s.addRevision(tc, key, REVISION_CREATE, w)
+	}, &datastore.TransactionOptions{XG: true})
 	if err != nil {
 		log.Errorf(s.ctx, "WatchService.Create(%v) [%T]%v\n", w, err, err)
 		return err
 	}
-	w.ID = res.Encode()
+	invalidateMatcher(s.ctx)
+	w.ID = key.Encode()
 	return nil
 }
 
+// Update saves the Watch if its Version is the same as the saved one,
+// otherwise it returns ConflictError. Version is incremented if it succeeds.
 func (s *WatchService) Update(w *Watch) error {
+	return s.update(w, REVISION_UPDATE)
+}
+
+func (s *WatchService) update(w *Watch, action string) error {
 	err := w.Validate()
 	if err != nil {
 		return err
 	}
-	key, err := datastore.DecodeKey(w.ID)
+	err = validateTenant(s.ctx, w)
 	if err != nil {
 		return err
 	}
-	_, err = datastore.Put(s.ctx, key, w)
+	key, err := s.decodeKey(w.ID)
+	if err != nil {
+		return err
+	}
+	err = datastore.RunInTransaction(s.ctx, func(tc context.Context) error {
+		current := Watch{}
+		err := ignoreFieldMismatch(datastore.Get(tc, key, &current))
+		switch {
+		case err == datastore.ErrNoSuchEntity:
+			return &EntityNotFound{err}
+		case err != nil:
+			return err
+		}
+		if current.Version != w.Version {
+			return &ConflictError{fmt.Sprintf("Watch %v was updated by someone else. Reload it and try again. version: %v, current version: %v", w.ID, w.Version, current.Version)}
+		}
+		err = s.updateSeqs(tc, func(ws *WatchSeqs) error { return ws.reserve(key.Encode(), w.Seq) })
+		if err != nil {
+			return err
+		}
+		updated := *w
+		updated.Version++
+		_, err = datastore.Put(tc, key, &updated)
+		if err != nil {
+			return err
+		}
+		return s.addRevision(tc, key, action, &updated)
+	}, &datastore.TransactionOptions{XG: true})
 	if err != nil {
 		log.Errorf(s.ctx, "WatchService.Update(%v) [%T]%v\n", w, err, err)
 		return err
 	}
+	invalidateMatcher(s.ctx)
+	w.Version++
 	return nil
 }
 
 func (s *WatchService) Delete(id string) error {
-	key, err := datastore.DecodeKey(id)
+	key, err := s.decodeKey(id)
 	if err != nil {
 		return err
 	}
-	err = datastore.Delete(s.ctx, key)
+	err = datastore.RunInTransaction(s.ctx, func(tc context.Context) error {
+		w := Watch{}
+		err := ignoreFieldMismatch(datastore.Get(tc, key, &w))
+		if err != nil {
+			return err
+		}
+		err = datastore.Delete(tc, key)
+		if err != nil {
+			return err
+		}
+		err = s.updateSeqs(tc, func(ws *WatchSeqs) error {
+			ws.remove(key.Encode())
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// The revisions are kept after the Watch is deleted
+		return s.addRevision(tc, key, REVISION_DELETE, &w)
+	}, &datastore.TransactionOptions{XG: true})
 	if err != nil {
 		return err
 	}
+	invalidateMatcher(s.ctx)
+	err = s.deleteStats(id)
+	if err != nil {
+		log.Warningf(s.ctx, "Failed to delete the stats of Watch %v: %v\n", id, err)
+	}
 	return nil
 }
 
-func (s *WatchService) topicFor(url string) (string, error) {
-	watches, err := s.All()
+func (s *WatchService) topicFor(url string) (*Evaluation, error) {
+	start := time.Now()
+	bucket := bucketOf(url)
+	label := bucketLabel(s.ctx, bucket)
+	defer matchDuration.since(start, label)
+	ctx, span := startSpan(s.ctx, "watch.topic_for")
+	defer span.Finish()
+	span.SetAttribute("bucket", bucket)
+	evaluations, err := (&WatchService{ctx}).evaluate(url, true)
 	if err != nil {
-		return "", err
+		span.SetError(err)
+		return nil, err
 	}
-	for _, w := range watches {
-		log.Debugf(s.ctx, "Pattern: %v, Topic: %v\n", w.Pattern, w.Topic)
-		re, err := regexp.Compile(w.Pattern)
-		if err != nil {
-			log.Errorf(s.ctx, "Invalid Regexp: %v", w.Pattern)
-			return "", err
-		}
-		if re.MatchString(url) {
-			return w.Topic, nil
+	for _, ev := range evaluations {
+		if ev.Selected {
+			matchesTotal.inc(label, ev.Watch.ID)
+			span.SetAttribute("watch_id", ev.Watch.ID)
+			return ev, nil
 		}
 	}
-	return "", nil
+	return nil, nil
+}
+
+// evaluate matches the url against the watches in Seq order.
+// If firstOnly is true, it stops at the first matched Watch.
+func (s *WatchService) evaluate(url string, firstOnly bool) ([]*Evaluation, error) {
+	m, err := s.matcher(bucketOf(url), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	_, span := startSpan(s.ctx, "matcher.evaluate")
+	defer span.Finish()
+	return m.evaluate(url, firstOnly), nil
 }
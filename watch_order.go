@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	REVISION_REORDER = "reorder"
+
+	WATCH_SEQS_KIND = "WatchSeqs"
+	WATCH_SEQS_NAME = "default"
+
+	// MAX_REORDER is the max number of watches changed by a reorder
+	// because a cross-group transaction can touch 25 entity groups at most
+	// including WatchSeqs.
+	MAX_REORDER = 24
+)
+
+// WatchSeqs is the Seq values in use in a namespace. It's read and written in
+// the transactions which change Seq, so two watches saved at the same time
+// can't have the same Seq.
+type WatchSeqs struct {
+	Seqs     []int    `datastore:",noindex"`
+	WatchIDs []string `datastore:",noindex"`
+}
+
+// holder returns the id of the Watch which has the seq or blank.
+func (ws *WatchSeqs) holder(seq int) string {
+	for i, v := range ws.Seqs {
+		if v == seq {
+			return ws.WatchIDs[i]
+		}
+	}
+	return ""
+}
+
+func (ws *WatchSeqs) remove(id string) {
+	for i, v := range ws.WatchIDs {
+		if v == id {
+			ws.Seqs = append(ws.Seqs[:i], ws.Seqs[i+1:]...)
+			ws.WatchIDs = append(ws.WatchIDs[:i], ws.WatchIDs[i+1:]...)
+			return
+		}
+	}
+}
+
+// reserve sets the seq of the Watch. It returns ValidationError if another Watch has the seq.
+func (ws *WatchSeqs) reserve(id string, seq int) error {
+	if other := ws.holder(seq); other != "" && other != id {
+		return &ValidationError{fmt.Sprintf("Seq %v is already used by %v", seq, other)}
+	}
+	ws.remove(id)
+	ws.Seqs = append(ws.Seqs, seq)
+	ws.WatchIDs = append(ws.WatchIDs, id)
+	return nil
+}
+
+func (s *WatchService) seqsKey(ctx context.Context) *datastore.Key {
+	return datastore.NewKey(ctx, WATCH_SEQS_KIND, WATCH_SEQS_NAME, 0, nil)
+}
+
+// loadSeqs returns the Seq values in use in the transaction. They're built
+// from all the watches only for the first time.
+func (s *WatchService) loadSeqs(tc context.Context) (*WatchSeqs, error) {
+	res := &WatchSeqs{}
+	err := datastore.Get(tc, s.seqsKey(tc), res)
+	if err != datastore.ErrNoSuchEntity {
+		return res, err
+	}
+	watches, err := s.All()
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range watches {
+		res.Seqs = append(res.Seqs, w.Seq)
+		res.WatchIDs = append(res.WatchIDs, w.ID)
+	}
+	return res, nil
+}
+
+// updateSeqs changes the Seq values in use by f in the transaction.
+func (s *WatchService) updateSeqs(tc context.Context, f func(ws *WatchSeqs) error) error {
+	ws, err := s.loadSeqs(tc)
+	if err != nil {
+		return err
+	}
+	err = f(ws)
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(tc, s.seqsKey(tc), ws)
+	return err
+}
+
+// Reorder renumbers Seq of the watches in the order of ids in a transaction.
+// ids must have all the watches. The Seq values in use are reassigned
+// so that only the moved watches are changed.
+func (s *WatchService) Reorder(ids []string) error {
+	watches, err := s.All()
+	if err != nil {
+		return err
+	}
+	byID := map[string]*Watch{}
+	for _, w := range watches {
+		byID[w.ID] = w
+	}
+	if len(ids) != len(watches) {
+		return &ValidationError{fmt.Sprintf("Watches are changed. Reload and try again. expected %v watches but %v given", len(watches), len(ids))}
+	}
+
+	seqs := newSeqs(watches)
+	changes := map[string]int{}
+	for i, id := range ids {
+		w, ok := byID[id]
+		if !ok {
+			return &ValidationError{fmt.Sprintf("Watches are changed. Reload and try again. Watch not found for id: %v", id)}
+		}
+		delete(byID, id)
+		if w.Seq != seqs[i] {
+			changes[id] = seqs[i]
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	if len(changes) > MAX_REORDER {
+		return &ValidationError{fmt.Sprintf("Too many watches to move at once. %v watches are moved but the max is %v", len(changes), MAX_REORDER)}
+	}
+
+	opts := &datastore.TransactionOptions{XG: true}
+	err = datastore.RunInTransaction(s.ctx, func(tc context.Context) error {
+		err := s.updateSeqs(tc, func(ws *WatchSeqs) error {
+			for id := range changes {
+				ws.remove(id)
+			}
+			for id, seq := range changes {
+				if err := ws.reserve(id, seq); err != nil {
+					return &ValidationError{fmt.Sprintf("Watches are changed. Reload and try again. %v", err)}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for id, seq := range changes {
+			key, err := s.decodeKey(id)
+			if err != nil {
+				return err
+			}
+			w := Watch{}
+			err = ignoreFieldMismatch(datastore.Get(tc, key, &w))
+			if err != nil {
+				return err
+			}
+			w.Seq = seq
+			w.Version++
+			_, err = datastore.Put(tc, key, &w)
+			if err != nil {
+				return err
+			}
+			err = s.addRevision(tc, key, REVISION_REORDER, &w)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, opts)
+	if err != nil {
+		log.Errorf(s.ctx, "WatchService.Reorder(%v) [%T]%v\n", ids, err, err)
+		return err
+	}
+	invalidateMatcher(s.ctx)
+	return nil
+}
+
+// Move moves the Watch up (delta < 0) or down (delta > 0) among the watches
+// of the same bucket by swapping Seq with the neighbor.
+func (s *WatchService) Move(w *Watch, delta int) error {
+	watches, err := s.All()
+	if err != nil {
+		return err
+	}
+	ids := []string{}
+	group := []int{} // indexes of the watches in the same bucket
+	for i, watch := range watches {
+		ids = append(ids, watch.ID)
+		if watch.Bucket == w.Bucket {
+			group = append(group, i)
+		}
+	}
+	for j, i := range group {
+		if watches[i].ID != w.ID {
+			continue
+		}
+		k := j + delta
+		if k < 0 || k >= len(group) {
+			return nil // already at the top or the bottom
+		}
+		ids[i], ids[group[k]] = ids[group[k]], ids[i]
+		return s.Reorder(ids)
+	}
+	return &EntityNotFound{fmt.Errorf("Watch not found for id: %v", w.ID)}
+}
+
+// newSeqs returns the sorted Seq values of the watches made strictly increasing.
+func newSeqs(watches Watches) []int {
+	res := []int{}
+	for _, w := range watches {
+		res = append(res, w.Seq)
+	}
+	sort.Ints(res)
+	for i := 1; i < len(res); i++ {
+		if res[i] <= res[i-1] {
+			res[i] = res[i-1] + 1
+		}
+	}
+	return res
+}
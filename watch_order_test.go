@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/aetest"
+)
+
+func TestNewSeqs(t *testing.T) {
+	assert.Equal(t, []int{}, newSeqs(Watches{}))
+	assert.Equal(t, []int{1, 3, 5}, newSeqs(Watches{{Seq: 5}, {Seq: 1}, {Seq: 3}}))
+	assert.Equal(t, []int{1, 2, 3, 4}, newSeqs(Watches{{Seq: 2}, {Seq: 1}, {Seq: 1}, {Seq: 2}}))
+}
+
+func TestWatchesSortWithID(t *testing.T) {
+	watches := Watches{
+		{ID: "c", Seq: 2},
+		{ID: "b", Seq: 1},
+		{ID: "a", Seq: 2},
+	}
+	sort.Stable(watches)
+	ids := []string{}
+	for _, w := range watches {
+		ids = append(ids, w.ID)
+	}
+	assert.Equal(t, []string{"b", "a", "c"}, ids)
+}
+
+func TestWatchSeqsReserve(t *testing.T) {
+	ws := &WatchSeqs{}
+	assert.NoError(t, ws.reserve("a", 1))
+	assert.NoError(t, ws.reserve("b", 2))
+	assert.Equal(t, "a", ws.holder(1))
+
+	err := ws.reserve("b", 1)
+	if assert.Error(t, err) {
+		assert.IsType(t, &ValidationError{}, err)
+		assert.Regexp(t, "Seq 1 is already used by a", err.Error())
+	}
+
+	// Changing its own Seq
+	assert.NoError(t, ws.reserve("a", 3))
+	assert.Equal(t, "", ws.holder(1))
+	assert.NoError(t, ws.reserve("b", 1))
+	assert.Equal(t, []int{3, 1}, ws.Seqs)
+	assert.Equal(t, []string{"a", "b"}, ws.WatchIDs)
+
+	ws.remove("a")
+	assert.Equal(t, "", ws.holder(3))
+	assert.Equal(t, []string{"b"}, ws.WatchIDs)
+}
+
+func TestWatchReorder(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, WATCH_KIND)
+
+	service := &WatchService{ctx}
+	watches := []*Watch{
+		{Seq: 10, Pattern: `\Ags://bucket1/dir1/`, Topic: "projects/dummy-proj-999/topics/topic1"},
+		{Seq: 20, Bucket: "bucket2", Pattern: `/dir1/`, Topic: "projects/dummy-proj-999/topics/topic2"},
+		{Seq: 30, Pattern: `\Ags://bucket1/dir2/`, Topic: "projects/dummy-proj-999/topics/topic3"},
+	}
+	for _, watch := range watches {
+		err = service.Create(watch)
+		assert.NoError(t, err)
+	}
+
+	seqs := func() []int {
+		res := []int{}
+		for _, w := range watches {
+			found, err := service.Find(w.ID)
+			assert.NoError(t, err)
+			res = append(res, found.Seq)
+		}
+		return res
+	}
+
+	// Wait until the query results have the Seq values
+	waitForSeqs := func(expected []int) {
+		retryWith(10, func() func() {
+			r, err := service.All()
+			if !assert.NoError(t, err) {
+				return nil
+			}
+			bySeq := map[string]int{}
+			for _, w := range r {
+				bySeq[w.ID] = w.Seq
+			}
+			for i, w := range watches {
+				if bySeq[w.ID] != expected[i] {
+					return func() {
+						t.Fatalf("Seq of watches[%v] expects %v but was %v\n", i, expected[i], bySeq[w.ID])
+					}
+				}
+			}
+			return nil
+		})
+	}
+	waitForSeqs([]int{10, 20, 30})
+
+	// Duplicated Seq
+	dup := &Watch{Seq: 20, Pattern: `\Ags://bucket1/dir3/`, Topic: "projects/dummy-proj-999/topics/topic1"}
+	err = service.Create(dup)
+	if assert.Error(t, err) {
+		assert.Regexp(t, "Seq 20 is already used", err.Error())
+	}
+
+	// Move down in the group without bucket swaps with the 3rd one
+	err = service.Move(watches[0], 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{30, 20, 10}, seqs())
+	waitForSeqs([]int{30, 20, 10})
+
+	// Moving the top one up does nothing
+	w, err := service.Find(watches[2].ID)
+	assert.NoError(t, err)
+	err = service.Move(w, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{30, 20, 10}, seqs())
+
+	// Reorder all
+	err = service.Reorder([]string{watches[1].ID, watches[0].ID, watches[2].ID})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{20, 10, 30}, seqs())
+	waitForSeqs([]int{20, 10, 30})
+
+	// Missing watches
+	err = service.Reorder([]string{watches[1].ID, watches[0].ID})
+	if assert.Error(t, err) {
+		assert.IsType(t, &ValidationError{}, err)
+	}
+}
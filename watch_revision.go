@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+const (
+	WATCH_REVISION_KIND = "WatchRevisions"
+
+	REVISION_CREATE   = "create"
+	REVISION_UPDATE   = "update"
+	REVISION_DELETE   = "delete"
+	REVISION_ROLLBACK = "rollback"
+)
+
+// WatchRevision is a snapshot of a Watch saved as a child entity of the Watch.
+// It's created for each change of the Watch.
+type WatchRevision struct {
+	ID        string `datastore:"-"` // IntID of the key
+	Action    string
+	Author    string // email of the signed-in user
+	CreatedAt time.Time
+	Watch     Watch // values after the action, or before the deletion
+}
+
+// FieldDiff is a changed field of a Watch between revisions.
+type FieldDiff struct {
+	Name   string
+	Before string
+	After  string
+}
+
+// RevisionDiff is a revision with the changes from the previous revision.
+type RevisionDiff struct {
+	Revision *WatchRevision
+	Changes  []*FieldDiff
+}
+
+// fields returns the fields of the Watch to compare between revisions.
+func (w *Watch) fields() [][2]string {
+	return [][2]string{
+		{"Seq", strconv.Itoa(w.Seq)},
+		{"Bucket", w.Bucket},
+		{"Type", w.PatternTypeName()},
+		{"Pattern", w.Pattern},
+		{"Topic", w.Topic},
+		{"Attributes template", w.AttributesTemplate},
+		{"Data template", w.DataTemplate},
+		{"Ordering key template", w.OrderingKeyTemplate},
+		{"Stale events", w.StaleEventsName()},
+		{"Debounce seconds", strconv.Itoa(w.DebounceSeconds)},
+		{"Enabled", strconv.FormatBool(!w.Disabled)},
+		{"Active from", w.ActiveFromValue()},
+		{"Active until", w.ActiveUntilValue()},
+	}
+}
+
+// diffWatches returns the changed fields from before to after.
+// before may be nil for the first revision.
+func diffWatches(before, after *Watch) []*FieldDiff {
+	res := []*FieldDiff{}
+	afterFields := after.fields()
+	var beforeFields [][2]string
+	if before != nil {
+		beforeFields = before.fields()
+	}
+	for i, f := range afterFields {
+		b := ""
+		if beforeFields != nil {
+			b = beforeFields[i][1]
+		}
+		if before == nil || b != f[1] {
+			res = append(res, &FieldDiff{Name: f[0], Before: b, After: f[1]})
+		}
+	}
+	return res
+}
+
+func (s *WatchService) addRevision(ctx context.Context, key *datastore.Key, action string, w *Watch) error {
+	rev := &WatchRevision{
+		Action:    action,
+		CreatedAt: time.Now(),
+		Watch:     *w,
+	}
+	if u := user.Current(s.ctx); u != nil {
+		rev.Author = u.Email
+	}
+	revKey := datastore.NewIncompleteKey(ctx, WATCH_REVISION_KIND, key)
+	_, err := datastore.Put(ctx, revKey, rev)
+	if err != nil {
+		log.Errorf(s.ctx, "WatchService.addRevision(%v, %v) [%T]%v\n", key, action, err, err)
+		return err
+	}
+	return nil
+}
+
+// Revisions returns the revisions of the Watch from the newest one.
+func (s *WatchService) Revisions(id string) ([]*WatchRevision, error) {
+	key, err := s.decodeKey(id)
+	if err != nil {
+		return nil, err
+	}
+	q := datastore.NewQuery(WATCH_REVISION_KIND).Ancestor(key)
+	res := []*WatchRevision{}
+	keys, err := q.GetAll(s.ctx, &res)
+	err = ignoreFieldMismatch(err)
+	if err != nil {
+		log.Errorf(s.ctx, "WatchService.Revisions(%v) [%T]%v\n", id, err, err)
+		return nil, err
+	}
+	for i, k := range keys {
+		res[i].ID = strconv.FormatInt(k.IntID(), 10)
+		res[i].Watch.ID = id
+	}
+	// Sort in memory not to require a composite index
+	sort.Sort(revisionsByNewest(res))
+	return res, nil
+}
+
+// RevisionDiffs returns the revisions of the Watch from the newest one with their changes.
+func (s *WatchService) RevisionDiffs(id string) ([]*RevisionDiff, error) {
+	revs, err := s.Revisions(id)
+	if err != nil {
+		return nil, err
+	}
+	res := []*RevisionDiff{}
+	for i, rev := range revs {
+		var before *Watch
+		if i+1 < len(revs) {
+			before = &revs[i+1].Watch
+		}
+		res = append(res, &RevisionDiff{Revision: rev, Changes: diffWatches(before, &rev.Watch)})
+	}
+	return res, nil
+}
+
+// Rollback updates the Watch with the values of the revision.
+// The Version of w must be the current one as Update.
+func (s *WatchService) Rollback(w *Watch, revisionID string) error {
+	key, err := s.decodeKey(w.ID)
+	if err != nil {
+		return err
+	}
+	intID, err := strconv.ParseInt(revisionID, 10, 64)
+	if err != nil {
+		return &EntityNotFound{fmt.Errorf("Invalid revision id: %v", revisionID)}
+	}
+	rev := WatchRevision{}
+	err = ignoreFieldMismatch(datastore.Get(s.ctx, datastore.NewKey(s.ctx, WATCH_REVISION_KIND, "", intID, key), &rev))
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+		return &EntityNotFound{err}
+	case err != nil:
+		log.Errorf(s.ctx, "WatchService.Rollback(%v, %v) [%T]%v\n", w.ID, revisionID, err, err)
+		return err
+	}
+	version := w.Version
+	*w = rev.Watch
+	w.ID = key.Encode()
+	w.Version = version
+	return s.update(w, REVISION_ROLLBACK)
+}
+
+type revisionsByNewest []*WatchRevision
+
+func (r revisionsByNewest) Len() int {
+	return len(r)
+}
+
+func (r revisionsByNewest) Less(i, j int) bool {
+	return r[i].CreatedAt.After(r[j].CreatedAt)
+}
+
+func (r revisionsByNewest) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
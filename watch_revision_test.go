@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/aetest"
+)
+
+func TestDiffWatches(t *testing.T) {
+	before := &Watch{Seq: 1, Pattern: `\Ags://bucket1/`, Topic: "projects/dummy-proj-999/topics/foo"}
+	after := &Watch{Seq: 1, Pattern: `\Ags://bucket2/`, Topic: "projects/dummy-proj-999/topics/foo", Disabled: true}
+
+	changes := diffWatches(before, after)
+	assert.Equal(t, []*FieldDiff{
+		{Name: "Pattern", Before: `\Ags://bucket1/`, After: `\Ags://bucket2/`},
+		{Name: "Enabled", Before: "true", After: "false"},
+	}, changes)
+
+	// All fields are changes for the first revision
+	changes = diffWatches(nil, after)
+	assert.Equal(t, len(after.fields()), len(changes))
+}
+
+func TestWatchRevisions(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, WATCH_KIND)
+	ClearDatastore(t, ctx, WATCH_REVISION_KIND)
+
+	service := &WatchService{ctx}
+	watch := &Watch{
+		Seq:     1,
+		Pattern: `\Ags://bucket1/dir1/`,
+		Topic:   "projects/dummy-proj-999/topics/foo",
+	}
+	err = service.Create(watch)
+	assert.NoError(t, err)
+
+	watch.Pattern = `\Ags://bucket1/dir2/`
+	err = service.Update(watch)
+	assert.NoError(t, err)
+
+	revs, err := service.RevisionDiffs(watch.ID)
+	if assert.NoError(t, err) && assert.Equal(t, 2, len(revs)) {
+		assert.Equal(t, REVISION_UPDATE, revs[0].Revision.Action)
+		assert.Equal(t, []*FieldDiff{
+			{Name: "Pattern", Before: `\Ags://bucket1/dir1/`, After: `\Ags://bucket1/dir2/`},
+		}, revs[0].Changes)
+		assert.Equal(t, REVISION_CREATE, revs[1].Revision.Action)
+	}
+
+	// Rollback to the first revision
+	err = service.Rollback(watch, revs[1].Revision.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, `\Ags://bucket1/dir1/`, watch.Pattern)
+
+	found, err := service.Find(watch.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `\Ags://bucket1/dir1/`, found.Pattern)
+	}
+	revs, err = service.RevisionDiffs(watch.ID)
+	if assert.NoError(t, err) && assert.Equal(t, 3, len(revs)) {
+		assert.Equal(t, REVISION_ROLLBACK, revs[0].Revision.Action)
+	}
+
+	// Unknown revision
+	err = service.Rollback(watch, "12345")
+	if assert.Error(t, err) {
+		assert.IsType(t, &EntityNotFound{}, err)
+	}
+
+	// Revisions are kept after deletion
+	err = service.Delete(watch.ID)
+	assert.NoError(t, err)
+	revs, err = service.RevisionDiffs(watch.ID)
+	if assert.NoError(t, err) && assert.Equal(t, 4, len(revs)) {
+		assert.Equal(t, REVISION_DELETE, revs[0].Revision.Action)
+	}
+}
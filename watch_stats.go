@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// The matches are counted in memcache not to write Datastore for every
+// notification, and the cron job flushes the counts into the shard entities
+// every minute. So the admin page shows the statistics a minute ago, and the
+// counts evicted from memcache before the flush are lost. The older versions
+// wrote WATCH_STAT_SHARDS shards at random, so WatchStat aggregates them all.
+
+type (
+	WatchStatShard struct {
+		WatchID        string
+		Count          int64
+		ErrorCount     int64
+		LastMatchedAt  time.Time
+		LastMatchedUrl string `datastore:",noindex"`
+		LastErrorAt    time.Time
+		LastError      string `datastore:",noindex"`
+	}
+
+	WatchStat struct {
+		Count          int64     `json:"count"`
+		ErrorCount     int64     `json:"error_count"`
+		LastMatchedAt  time.Time `json:"last_matched_at"`
+		LastMatchedUrl string    `json:"last_matched_url"`
+		LastErrorAt    time.Time `json:"last_error_at"`
+		LastError      string    `json:"last_error"`
+	}
+
+	// pendingStat is the statistics of a Watch in memcache not flushed yet.
+	pendingStat struct {
+		Count      int64
+		ErrorCount int64
+		Matched    *lastMatch
+		Failed     *lastMatch
+	}
+
+	lastMatch struct {
+		At    time.Time `json:"at"`
+		Url   string    `json:"url"`
+		Error string    `json:"error,omitempty"`
+	}
+
+	// watchesByStat sorts the watches by a statistic in descending order.
+	watchesByStat struct {
+		Watches
+		stats map[string]*WatchStat
+		key   string
+	}
+)
+
+const (
+	WATCH_STAT_SHARD_KIND = "WatchStatShards"
+	WATCH_STAT_SHARDS     = 20
+
+	// The names of the pending statistics in memcache
+	STAT_PENDING_COUNT       = "count"
+	STAT_PENDING_ERROR_COUNT = "error_count"
+	STAT_PENDING_MATCHED     = "matched"
+	STAT_PENDING_FAILED      = "failed"
+
+	STAT_SORT_SEQ          = "seq"
+	STAT_SORT_COUNT        = "count"
+	STAT_SORT_LAST_MATCHED = "last_matched"
+	STAT_SORT_LAST_ERROR   = "last_error"
+)
+
+var STAT_SORT_KEYS = []string{STAT_SORT_SEQ, STAT_SORT_COUNT, STAT_SORT_LAST_MATCHED, STAT_SORT_LAST_ERROR}
+
+// add aggregates the shard into the stat.
+func (st *WatchStat) add(shard *WatchStatShard) {
+	st.Count += shard.Count
+	st.ErrorCount += shard.ErrorCount
+	if shard.LastMatchedAt.After(st.LastMatchedAt) {
+		st.LastMatchedAt = shard.LastMatchedAt
+		st.LastMatchedUrl = shard.LastMatchedUrl
+	}
+	if shard.LastErrorAt.After(st.LastErrorAt) {
+		st.LastErrorAt = shard.LastErrorAt
+		st.LastError = shard.LastError
+	}
+}
+
+// LastMatchedValue returns the last matched time for the admin page.
+func (st *WatchStat) LastMatchedValue() string {
+	return formTime(st.LastMatchedAt)
+}
+
+// LastErrorValue returns the last error time for the admin page.
+func (st *WatchStat) LastErrorValue() string {
+	return formTime(st.LastErrorAt)
+}
+
+// addPending adds the statistics not flushed yet to the shard.
+func (shard *WatchStatShard) addPending(p *pendingStat) {
+	shard.Count += p.Count
+	shard.ErrorCount += p.ErrorCount
+	if p.Matched != nil && p.Matched.At.After(shard.LastMatchedAt) {
+		shard.LastMatchedAt = p.Matched.At
+		shard.LastMatchedUrl = p.Matched.Url
+	}
+	if p.Failed != nil && p.Failed.At.After(shard.LastErrorAt) {
+		shard.LastErrorAt = p.Failed.At
+		shard.LastError = p.Failed.Error
+	}
+}
+
+func pendingStatKey(id, name string) string {
+	return "watch_stat:" + id + ":" + name
+}
+
+// recordMatch records that the Watch matched the url, and err of its notification if any.
+func (s *WatchService) recordMatch(w *Watch, url string, notifyErr error) {
+	now := time.Now()
+	_, err := memcache.Increment(s.ctx, pendingStatKey(w.ID, STAT_PENDING_COUNT), 1, 0)
+	if err == nil {
+		err = memcache.JSON.Set(s.ctx, &memcache.Item{
+			Key:    pendingStatKey(w.ID, STAT_PENDING_MATCHED),
+			Object: &lastMatch{At: now, Url: url},
+		})
+	}
+	if err == nil && notifyErr != nil {
+		_, err = memcache.Increment(s.ctx, pendingStatKey(w.ID, STAT_PENDING_ERROR_COUNT), 1, 0)
+		if err == nil {
+			err = memcache.JSON.Set(s.ctx, &memcache.Item{
+				Key:    pendingStatKey(w.ID, STAT_PENDING_FAILED),
+				Object: &lastMatch{At: now, Url: url, Error: notifyErr.Error()},
+			})
+		}
+	}
+	if err != nil {
+		log.Warningf(s.ctx, "Failed to record the match of Watch %v: %v\n", w.ID, err)
+	}
+}
+
+// takeCounter returns the count in memcache and subtracts it.
+// The counts added meanwhile are kept for the next flush.
+func (s *WatchService) takeCounter(key string) (int64, error) {
+	item, err := memcache.Get(s.ctx, key)
+	if err == memcache.ErrCacheMiss {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(string(item.Value), 10, 64)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	_, err = memcache.Increment(s.ctx, key, -n, 0)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// getLastMatch returns the last match in memcache or nil.
+func (s *WatchService) getLastMatch(key string) (*lastMatch, error) {
+	m := &lastMatch{}
+	_, err := memcache.JSON.Get(s.ctx, key, m)
+	if err == memcache.ErrCacheMiss {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// takePending takes the statistics of the Watch from memcache.
+// It returns nil if the Watch hasn't matched since the last flush.
+func (s *WatchService) takePending(id string) (*pendingStat, error) {
+	p := &pendingStat{}
+	var err error
+	p.Count, err = s.takeCounter(pendingStatKey(id, STAT_PENDING_COUNT))
+	if err != nil || p.Count == 0 {
+		return nil, err
+	}
+	p.ErrorCount, err = s.takeCounter(pendingStatKey(id, STAT_PENDING_ERROR_COUNT))
+	if err != nil {
+		s.restorePending(id, p)
+		return nil, err
+	}
+	// The last matches are kept in memcache since Datastore keeps the later one
+	p.Matched, err = s.getLastMatch(pendingStatKey(id, STAT_PENDING_MATCHED))
+	if err == nil {
+		p.Failed, err = s.getLastMatch(pendingStatKey(id, STAT_PENDING_FAILED))
+	}
+	if err != nil {
+		s.restorePending(id, p)
+		return nil, err
+	}
+	return p, nil
+}
+
+// restorePending adds the counts taken back to memcache to flush them next time.
+func (s *WatchService) restorePending(id string, p *pendingStat) {
+	counts := map[string]int64{
+		STAT_PENDING_COUNT:       p.Count,
+		STAT_PENDING_ERROR_COUNT: p.ErrorCount,
+	}
+	for name, n := range counts {
+		if n == 0 {
+			continue
+		}
+		_, err := memcache.Increment(s.ctx, pendingStatKey(id, name), n, 0)
+		if err != nil {
+			log.Warningf(s.ctx, "Failed to restore the %v of Watch %v: %v\n", name, id, err)
+		}
+	}
+}
+
+// flushStats saves the statistics of the watches in memcache into Datastore.
+func (s *WatchService) flushStats() error {
+	watches, err := s.All()
+	if err != nil {
+		return err
+	}
+	for _, w := range watches {
+		p, err := s.takePending(w.ID)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			continue
+		}
+		key := s.statShardKey(w.ID, 0)
+		err = datastore.RunInTransaction(s.ctx, func(tc context.Context) error {
+			shard := WatchStatShard{}
+			err := datastore.Get(tc, key, &shard)
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			shard.WatchID = w.ID
+			shard.addPending(p)
+			_, err = datastore.Put(tc, key, &shard)
+			return err
+		}, nil)
+		if err != nil {
+			log.Errorf(s.ctx, "WatchService.flushStats(%v) [%T]%v\n", w.ID, err, err)
+			s.restorePending(w.ID, p)
+			return err
+		}
+	}
+	return nil
+}
+
+// flushWatchStats is requested by the cron job in cron.yaml.
+// It flushes the statistics of the watches of all the tenants.
+func (h *handler) flushWatchStats(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	tenants, err := (&TenantService{ctx}).All()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	var firstErr error
+	for _, t := range append([]*Tenant{nil}, tenants...) {
+		tctx, err := withTenant(ctx, t)
+		if err == nil {
+			err = (&WatchService{tctx}).flushStats()
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return c.String(http.StatusInternalServerError, firstErr.Error())
+	}
+	return c.String(http.StatusOK, "OK")
+}
+
+// Stats returns the statistics of the watches by Watch ID.
+func (s *WatchService) Stats() (map[string]*WatchStat, error) {
+	shards := []*WatchStatShard{}
+	_, err := datastore.NewQuery(WATCH_STAT_SHARD_KIND).GetAll(s.ctx, &shards)
+	if err != nil {
+		log.Errorf(s.ctx, "WatchService.Stats [%T]%v\n", err, err)
+		return nil, err
+	}
+	res := map[string]*WatchStat{}
+	for _, shard := range shards {
+		st, ok := res[shard.WatchID]
+		if !ok {
+			st = &WatchStat{}
+			res[shard.WatchID] = st
+		}
+		st.add(shard)
+	}
+	return res, nil
+}
+
+// deleteStats deletes the statistics of the deleted Watch.
+func (s *WatchService) deleteStats(id string) error {
+	keys := []*datastore.Key{}
+	for i := 0; i < WATCH_STAT_SHARDS; i++ {
+		keys = append(keys, s.statShardKey(id, i))
+	}
+	err := datastore.DeleteMulti(s.ctx, keys)
+	if err != nil {
+		return err
+	}
+	names := []string{STAT_PENDING_COUNT, STAT_PENDING_ERROR_COUNT, STAT_PENDING_MATCHED, STAT_PENDING_FAILED}
+	for _, name := range names {
+		err := memcache.Delete(s.ctx, pendingStatKey(id, name))
+		if err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *WatchService) statShardKey(id string, shard int) *datastore.Key {
+	return datastore.NewKey(s.ctx, WATCH_STAT_SHARD_KIND, fmt.Sprintf("%v-%d", id, shard), 0, nil)
+}
+
+// SortByStat sorts the watches by the key in STAT_SORT_KEYS.
+// The watches are sorted by Seq for STAT_SORT_SEQ or an unknown key.
+func (w Watches) SortByStat(stats map[string]*WatchStat, key string) {
+	sort.Stable(w)
+	if key == STAT_SORT_SEQ {
+		return
+	}
+	sort.Stable(&watchesByStat{w, stats, key})
+}
+
+func (ws *watchesByStat) stat(i int) *WatchStat {
+	st, ok := ws.stats[ws.Watches[i].ID]
+	if !ok {
+		return &WatchStat{}
+	}
+	return st
+}
+
+func (ws *watchesByStat) Less(i, j int) bool {
+	a, b := ws.stat(i), ws.stat(j)
+	switch ws.key {
+	case STAT_SORT_COUNT:
+		return a.Count > b.Count
+	case STAT_SORT_LAST_MATCHED:
+		return a.LastMatchedAt.After(b.LastMatchedAt)
+	case STAT_SORT_LAST_ERROR:
+		return a.LastErrorAt.After(b.LastErrorAt)
+	default:
+		return false
+	}
+}
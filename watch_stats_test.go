@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/appengine/aetest"
+)
+
+func TestWatchStatAdd(t *testing.T) {
+	t1 := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	st := &WatchStat{}
+	st.add(&WatchStatShard{Count: 2, LastMatchedAt: t2, LastMatchedUrl: "gs://bucket1/2"})
+	st.add(&WatchStatShard{Count: 3, ErrorCount: 1, LastMatchedAt: t1, LastMatchedUrl: "gs://bucket1/1", LastErrorAt: t1, LastError: "error1"})
+	assert.Equal(t, &WatchStat{
+		Count:          5,
+		ErrorCount:     1,
+		LastMatchedAt:  t2,
+		LastMatchedUrl: "gs://bucket1/2",
+		LastErrorAt:    t1,
+		LastError:      "error1",
+	}, st)
+	assert.Equal(t, "2017-03-01T01:00", st.LastMatchedValue())
+}
+
+func TestWatchStatShardAddPending(t *testing.T) {
+	t1 := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	shard := &WatchStatShard{Count: 3, LastMatchedAt: t1, LastMatchedUrl: "gs://bucket1/1", LastErrorAt: t1, LastError: "error1"}
+	shard.addPending(&pendingStat{Count: 2, Matched: &lastMatch{At: t1.Add(time.Hour), Url: "gs://bucket1/2"}})
+	assert.Equal(t, int64(5), shard.Count)
+	assert.Equal(t, "gs://bucket1/2", shard.LastMatchedUrl)
+	assert.Equal(t, "error1", shard.LastError)
+
+	// The older last match in memcache doesn't overwrite the saved one
+	shard.addPending(&pendingStat{Count: 1, ErrorCount: 1,
+		Matched: &lastMatch{At: t1, Url: "gs://bucket1/old"},
+		Failed:  &lastMatch{At: t1.Add(2 * time.Hour), Url: "gs://bucket1/3", Error: "error2"},
+	})
+	assert.Equal(t, int64(6), shard.Count)
+	assert.Equal(t, int64(1), shard.ErrorCount)
+	assert.Equal(t, t1.Add(time.Hour), shard.LastMatchedAt)
+	assert.Equal(t, "gs://bucket1/2", shard.LastMatchedUrl)
+	assert.Equal(t, t1.Add(2*time.Hour), shard.LastErrorAt)
+	assert.Equal(t, "error2", shard.LastError)
+}
+
+func TestWatchesSortByStat(t *testing.T) {
+	t1 := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	watches := Watches{
+		&Watch{ID: "3", Seq: 3},
+		&Watch{ID: "1", Seq: 1},
+		&Watch{ID: "2", Seq: 2},
+		&Watch{ID: "4", Seq: 4},
+	}
+	stats := map[string]*WatchStat{
+		"1": &WatchStat{Count: 1, LastMatchedAt: t1, LastErrorAt: t1.Add(time.Hour)},
+		"2": &WatchStat{Count: 10, LastMatchedAt: t1.Add(time.Hour)},
+		"3": &WatchStat{Count: 1, LastMatchedAt: t1.Add(-time.Hour)},
+	}
+	ids := func() []string {
+		res := []string{}
+		for _, w := range watches {
+			res = append(res, w.ID)
+		}
+		return res
+	}
+
+	watches.SortByStat(stats, STAT_SORT_SEQ)
+	assert.Equal(t, []string{"1", "2", "3", "4"}, ids())
+	// The watches with the same count are in Seq order
+	watches.SortByStat(stats, STAT_SORT_COUNT)
+	assert.Equal(t, []string{"2", "1", "3", "4"}, ids())
+	watches.SortByStat(stats, STAT_SORT_LAST_MATCHED)
+	assert.Equal(t, []string{"2", "1", "3", "4"}, ids())
+	watches.SortByStat(stats, STAT_SORT_LAST_ERROR)
+	assert.Equal(t, []string{"1", "2", "3", "4"}, ids())
+	watches.SortByStat(stats, "unknown")
+	assert.Equal(t, []string{"1", "2", "3", "4"}, ids())
+}
+
+func TestWatchServiceStats(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, WATCH_KIND)
+	ClearDatastore(t, ctx, WATCH_STAT_SHARD_KIND)
+	service := &WatchService{ctx}
+	w1 := &Watch{Seq: 1, Pattern: `\.csv\z`, Topic: "projects/dummy-proj-999/topics/topic1"}
+	w2 := &Watch{Seq: 2, Pattern: `\.txt\z`, Topic: "projects/dummy-proj-999/topics/topic2"}
+	assert.NoError(t, service.Create(w1))
+	assert.NoError(t, service.Create(w2))
+
+	for i := 0; i < 5; i++ {
+		service.recordMatch(w1, "gs://bucket1/file.csv", nil)
+	}
+	service.recordMatch(w1, "gs://bucket1/last.csv", errors.New("publish failed"))
+	service.recordMatch(w2, "gs://bucket1/file.txt", nil)
+
+	// The matches are not saved until they are flushed
+	stats, err := service.Stats()
+	assert.NoError(t, err)
+	assert.Nil(t, stats[w1.ID])
+
+	retryWith(10, func() func() {
+		// The watches are loaded by an eventually consistent query
+		assert.NoError(t, service.flushStats())
+		stats, err = service.Stats()
+		if assert.NoError(t, err) && (stats[w1.ID] == nil || stats[w1.ID].Count != 6) {
+			return func() {
+				t.Fatalf("count of w1 expects 6 but was %v\n", stats[w1.ID])
+			}
+		}
+		return nil
+	})
+	st := stats[w1.ID]
+	assert.Equal(t, int64(1), st.ErrorCount)
+	assert.Equal(t, "gs://bucket1/last.csv", st.LastMatchedUrl)
+	assert.Equal(t, "publish failed", st.LastError)
+	if assert.NotNil(t, stats[w2.ID]) {
+		assert.Equal(t, int64(1), stats[w2.ID].Count)
+		assert.Equal(t, "", stats[w2.ID].LastError)
+	}
+
+	// The flushed counts are not flushed again
+	service.recordMatch(w1, "gs://bucket1/next.csv", nil)
+	assert.NoError(t, service.flushStats())
+	retryWith(10, func() func() {
+		stats, err = service.Stats()
+		if assert.NoError(t, err) && (stats[w1.ID] == nil || stats[w1.ID].Count != 7) {
+			return func() {
+				t.Fatalf("count of w1 expects 7 but was %v\n", stats[w1.ID])
+			}
+		}
+		return nil
+	})
+	assert.Equal(t, "gs://bucket1/next.csv", stats[w1.ID].LastMatchedUrl)
+
+	// The stats are deleted with the Watch
+	assert.NoError(t, service.Delete(w1.ID))
+	retryWith(10, func() func() {
+		stats, err = service.Stats()
+		if assert.NoError(t, err) && stats[w1.ID] != nil {
+			return func() {
+				t.Fatalf("stats of w1 expects to be deleted but was %v\n", stats[w1.ID])
+			}
+		}
+		return nil
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
@@ -50,6 +51,82 @@ func TestWatchCreate(t *testing.T) {
 		assert.Empty(t, watch2.ID)
 	}
 
+	// Glob pattern
+	watch4 := &Watch{
+		Seq:         4,
+		PatternType: PATTERN_GLOB,
+		Pattern:     `gs://bucket1/**/*.csv`,
+		Topic:       "projects/dummy-proj-999/topics/foo",
+	}
+	err = service.Create(watch4)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, watch4.ID)
+
+	// Blank prefix
+	watch5 := &Watch{
+		Seq:         5,
+		PatternType: PATTERN_PREFIX,
+		Pattern:     "",
+		Topic:       "projects/dummy-proj-999/topics/foo",
+	}
+	err = service.Create(watch5)
+	if assert.Error(t, err) {
+		assert.Regexp(t, `Invalid pattern`, err.Error())
+		assert.Empty(t, watch5.ID)
+	}
+
+	// Unknown pattern type
+	watch6 := &Watch{
+		Seq:         6,
+		PatternType: "wildcard",
+		Pattern:     `gs://bucket1/*`,
+		Topic:       "projects/dummy-proj-999/topics/foo",
+	}
+	err = service.Create(watch6)
+	if assert.Error(t, err) {
+		assert.Regexp(t, `Unknown pattern type`, err.Error())
+		assert.Empty(t, watch6.ID)
+	}
+
+	// Invalid bucket
+	watch7 := &Watch{
+		Seq:     7,
+		Bucket:  "gs://bucket1",
+		Pattern: `/dir1/`,
+		Topic:   "projects/dummy-proj-999/topics/foo",
+	}
+	err = service.Create(watch7)
+	if assert.Error(t, err) {
+		assert.Regexp(t, `Invalid bucket`, err.Error())
+		assert.Empty(t, watch7.ID)
+	}
+
+	// Reserved attribute name as a capture group
+	watch8 := &Watch{
+		Seq:     8,
+		Pattern: `\Ags://bucket1/(?P<download_files>.+)`,
+		Topic:   "projects/dummy-proj-999/topics/foo",
+	}
+	err = service.Create(watch8)
+	if assert.Error(t, err) {
+		assert.Regexp(t, `reserved attribute name "download_files"`, err.Error())
+		assert.Empty(t, watch8.ID)
+	}
+
+	// Invalid schedule
+	watch9 := &Watch{
+		Seq:         9,
+		Pattern:     `\Ags://bucket1/dir1/`,
+		Topic:       "projects/dummy-proj-999/topics/foo",
+		ActiveFrom:  time.Date(2017, 3, 10, 12, 0, 0, 0, time.UTC),
+		ActiveUntil: time.Date(2017, 3, 10, 11, 0, 0, 0, time.UTC),
+	}
+	err = service.Create(watch9)
+	if assert.Error(t, err) {
+		assert.Regexp(t, `must be before`, err.Error())
+		assert.Empty(t, watch9.ID)
+	}
+
 	// Invalid Topic
 	watch3 := &Watch{
 		Seq:     3,
@@ -63,3 +140,185 @@ func TestWatchCreate(t *testing.T) {
 	}
 
 }
+
+func TestWatchUpdateConflict(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, WATCH_KIND)
+
+	service := &WatchService{ctx}
+	watch := &Watch{
+		Seq:     1,
+		Pattern: `\Ags://bucket1/dir1/`,
+		Topic:   "projects/dummy-proj-999/topics/foo",
+	}
+	err = service.Create(watch)
+	assert.NoError(t, err)
+
+	// Two admins load the same Watch
+	w1, err := service.Find(watch.ID)
+	assert.NoError(t, err)
+	w2, err := service.Find(watch.ID)
+	assert.NoError(t, err)
+
+	w1.Pattern = `\Ags://bucket1/dir2/`
+	err = service.Update(w1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, w1.Version)
+
+	w2.Pattern = `\Ags://bucket1/dir3/`
+	err = service.Update(w2)
+	if assert.Error(t, err) {
+		assert.IsType(t, &ConflictError{}, err)
+		assert.Equal(t, 0, w2.Version)
+	}
+
+	found, err := service.Find(watch.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `\Ags://bucket1/dir2/`, found.Pattern)
+		assert.Equal(t, 1, found.Version)
+	}
+
+	// Update with the latest version succeeds
+	found.Pattern = `\Ags://bucket1/dir3/`
+	err = service.Update(found)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, found.Version)
+}
+
+func TestWatchLoadWithSavedID(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, WATCH_KIND)
+
+	// Watches saved by older versions have the ID property
+	key := datastore.NewIncompleteKey(ctx, WATCH_KIND, nil)
+	props := datastore.PropertyList{
+		{Name: "ID", Value: "old-id"},
+		{Name: "Seq", Value: int64(1)},
+		{Name: "Pattern", Value: `\Ags://bucket1/dir1/`},
+		{Name: "Topic", Value: "projects/dummy-proj-999/topics/foo"},
+	}
+	key, err = datastore.Put(ctx, key, &props)
+	assert.NoError(t, err)
+
+	service := &WatchService{ctx}
+	found, err := service.Find(key.Encode())
+	if assert.NoError(t, err) {
+		assert.Equal(t, key.Encode(), found.ID)
+		assert.Equal(t, `\Ags://bucket1/dir1/`, found.Pattern)
+	}
+
+	// The ID isn't saved again
+	found.Pattern = `\Ags://bucket1/dir2/`
+	err = service.Update(found)
+	assert.NoError(t, err)
+	saved := datastore.PropertyList{}
+	err = datastore.Get(ctx, key, &saved)
+	assert.NoError(t, err)
+	for _, p := range saved {
+		assert.NotEqual(t, "ID", p.Name)
+	}
+}
+
+func TestWatchMatcherCache(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, WATCH_KIND)
+
+	service := &WatchService{ctx}
+	ns := namespaceOf(ctx)
+	version1, err := matcherVersion(ctx)
+	assert.NoError(t, err)
+
+	// The Matcher isn't cached soon after the change
+	_, err = service.matcher("bucket1", time.Now())
+	assert.NoError(t, err)
+	assert.Nil(t, matcherCache.entries[ns])
+
+	// The Matcher is cached while the version isn't changed
+	later := time.Now().Add(MATCHER_SETTLE_TIME)
+	m1, err := service.matcher("bucket1", later)
+	assert.NoError(t, err)
+	if assert.NotNil(t, matcherCache.entries[ns]) {
+		assert.Equal(t, version1, matcherCache.entries[ns].version)
+	}
+	m2, err := service.matcher("bucket1", later)
+	assert.NoError(t, err)
+	assert.Equal(t, m1.buckets, m2.buckets)
+
+	// Creating a Watch changes the version
+	watch := &Watch{Seq: 1, Pattern: `\Ags://bucket1/`, Topic: "projects/dummy-proj-999/topics/foo"}
+	assert.NoError(t, service.Create(watch))
+	version2, err := matcherVersion(ctx)
+	assert.NoError(t, err)
+	assert.NotEqual(t, version1, version2)
+	assert.Nil(t, matcherCache.entries[ns])
+
+	// Deleting it too
+	later = time.Now().Add(MATCHER_SETTLE_TIME)
+	_, err = service.matcher("bucket1", later)
+	assert.NoError(t, err)
+	assert.NotNil(t, matcherCache.entries[ns])
+	assert.NoError(t, service.Delete(watch.ID))
+	version3, err := matcherVersion(ctx)
+	assert.NoError(t, err)
+	assert.NotEqual(t, version2, version3)
+	assert.Nil(t, matcherCache.entries[ns])
+
+	// Expired after MATCHER_CACHE_TTL
+	later = time.Now().Add(MATCHER_SETTLE_TIME)
+	_, err = service.matcher("bucket1", later)
+	assert.NoError(t, err)
+	if assert.NotNil(t, matcherCache.entries[ns]) {
+		_, err = service.matcher("bucket1", later.Add(MATCHER_CACHE_TTL))
+		assert.NoError(t, err)
+		assert.Equal(t, later.Add(MATCHER_CACHE_TTL), matcherCache.entries[ns].loadedAt)
+	}
+}
+
+func TestWatchForBucket(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ClearDatastore(t, ctx, WATCH_KIND)
+
+	service := &WatchService{ctx}
+	for i, bucket := range []string{"bucket1", "", "bucket2", "bucket1"} {
+		w := &Watch{Seq: 4 - i, Bucket: bucket, Pattern: `\.csv\z`, Topic: "projects/dummy-proj-999/topics/foo"}
+		assert.NoError(t, service.Create(w))
+	}
+	// Watches saved before Bucket was added don't have the property
+	props := datastore.PropertyList{
+		{Name: "Seq", Value: int64(5)},
+		{Name: "Pattern", Value: `\.txt\z`},
+		{Name: "Topic", Value: "projects/dummy-proj-999/topics/foo"},
+	}
+	_, err = datastore.Put(ctx, datastore.NewIncompleteKey(ctx, WATCH_KIND, nil), &props)
+	assert.NoError(t, err)
+
+	retryWith(10, func() func() {
+		watches, err := service.ForBucket("bucket1")
+		if err != nil || len(watches) != 4 {
+			return func() { t.Fatalf("Expected 4 watches but got %v, %v", watches, err) }
+		}
+		assert.Equal(t, []int{1, 3, 4, 5}, []int{watches[0].Seq, watches[1].Seq, watches[2].Seq, watches[3].Seq})
+		assert.Equal(t, "", watches[3].Bucket)
+		return nil
+	})
+}